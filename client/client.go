@@ -0,0 +1,235 @@
+// Package client downloads files from and uploads files to TFTP servers.
+//
+// A Client only holds settings, every Get and Put makes a transfer of its own so one Client can be used by many goroutines at once.
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/moretiles/tftpcpd/internal"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// transfer modes
+const (
+	ModeOctet    = internal.ModeOctet
+	ModeNetascii = internal.ModeNetascii
+)
+
+// failures the server reported or a transfer ran into, compare with errors.Is
+var (
+	ErrNotFound          = internal.ErrNotFound
+	ErrAccessViolation   = internal.ErrAccessViolation
+	ErrDiskFull          = internal.ErrDiskFull
+	ErrIllegalOperation  = internal.ErrIllegalOperation
+	ErrUnknownTransferId = internal.ErrUnknownTransferId
+	ErrFileExists        = internal.ErrFileExists
+	ErrOptionRefused     = internal.ErrOptionRefused
+)
+
+// TFTP error code matching err, 0 when nothing more specific fits
+func ErrorCode(err error) uint16 {
+	return internal.ErrorCode(err)
+}
+
+/*
+ * Where a client gets the packet conn each transfer uses.
+ * Addresses handed out by the conns must be *net.UDPAddr.
+ */
+type Network interface {
+	// listen on laddr, a port of 0 picks one that is free
+	ListenPacket(laddr *net.UDPAddr) (net.PacketConn, error)
+}
+
+/*
+ * Settings shared by every transfer a client makes.
+ * The zero value of each field other than Address picks a sensible default.
+ */
+type Client struct {
+	// host:port of the server
+	Address string
+	// ModeOctet unless set
+	Mode string
+	// times a message is sent again when the server does not respond, 5 unless set, negative for none
+	Retries int
+	// multiply the time waited for a response by this after every resend, 2 unless set
+	Backoff float64
+	// where events are logged, nil to throw them away
+	Log   io.Writer
+	Debug bool
+	// nil for real UDP sockets
+	Network Network
+}
+
+// client for the server at address using the defaults for everything else
+func New(address string) *Client {
+	return &Client{Address: address}
+}
+
+/*
+ * Options asked for at the start of a transfer, the server may acknowledge fewer or smaller ones.
+ * Zero leaves an option out so the default from RFC 1350 is used.
+ */
+type Options struct {
+	// bytes in each data message, between 8 and 65464
+	BlockSize int
+	// time waited for each response, sent in whole seconds between 1 and 255
+	Timeout time.Duration
+	// data messages sent before waiting for an acknowledgement, between 1 and 65535
+	WindowSize int
+	// ask the server for the size of a download, uploads tell the server their size whenever it is known
+	TransferSize bool
+}
+
+// how a transfer went
+type Result struct {
+	// bytes of the file sent or received
+	Bytes int64
+	// size the server reported for a download or that was announced for an upload, -1 when unknown
+	TransferSize int64
+	// values the transfer ended up using
+	BlockSize  int
+	WindowSize int
+	Timeout    time.Duration
+	// options the server acknowledged, empty when it ignored them all
+	Options  map[string]string
+	Duration time.Duration
+}
+
+// download filename from the server into writer
+func (client *Client) Get(ctx context.Context, filename string, writer io.Writer, options *Options) (Result, error) {
+	var result Result
+
+	inner, err := client.start()
+	if err != nil {
+		return result, err
+	}
+	defer inner.Close()
+
+	requested, err := options.requested()
+	if err != nil {
+		return result, err
+	}
+	if options != nil && options.TransferSize {
+		requested["tsize"] = "0"
+	}
+
+	stats, err := inner.Get(ctx, filename, func() (io.Writer, error) { return writer, nil }, requested)
+	if err != nil {
+		return result, err
+	}
+
+	return newResult(stats), nil
+}
+
+// upload everything read from reader to the server as filename, size is -1 when unknown
+func (client *Client) Put(ctx context.Context, filename string, reader io.Reader, size int64, options *Options) (Result, error) {
+	var result Result
+
+	inner, err := client.start()
+	if err != nil {
+		return result, err
+	}
+	defer inner.Close()
+
+	requested, err := options.requested()
+	if err != nil {
+		return result, err
+	}
+	if size >= 0 {
+		requested["tsize"] = strconv.FormatInt(size, 10)
+	}
+
+	stats, err := inner.Put(ctx, filename, reader, requested)
+	if err != nil {
+		return result, err
+	}
+
+	return newResult(stats), nil
+}
+
+// each transfer gets an internal client of its own so that a Client never needs closing
+func (client *Client) start() (*internal.Client, error) {
+	var cfg internal.Config = internal.Config{
+		Debug:     client.Debug,
+		Retries:   client.Retries,
+		Backoff:   client.Backoff,
+		LogOutput: client.Log,
+		Mode:      client.Mode,
+		Address:   client.Address,
+	}
+
+	if cfg.Mode == "" {
+		cfg.Mode = ModeOctet
+	}
+	if cfg.Mode != ModeOctet && cfg.Mode != ModeNetascii {
+		return nil, errors.New("Unsupported transfer mode: " + cfg.Mode)
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = 5
+	} else if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = 2
+	}
+	if cfg.LogOutput == nil {
+		cfg.LogOutput = io.Discard
+	}
+	if client.Network != nil {
+		cfg.Network = client.Network
+	}
+
+	return internal.NewClient(cfg)
+}
+
+// options as they are sent in a request
+func (options *Options) requested() (map[string]string, error) {
+	var requested map[string]string = make(map[string]string)
+
+	if options == nil {
+		return requested, nil
+	}
+	if options.BlockSize != 0 {
+		if options.BlockSize < 8 || options.BlockSize > 65464 {
+			return nil, errors.New("Block size must be between 8 and 65464 bytes")
+		}
+		requested["blksize"] = strconv.Itoa(options.BlockSize)
+	}
+	if options.Timeout != 0 {
+		seconds := options.Timeout.Round(time.Second) / time.Second
+		if seconds < 1 || seconds > 255 {
+			return nil, errors.New("Timeout must be between 1 and 255 seconds")
+		}
+		requested["timeout"] = strconv.FormatInt(int64(seconds), 10)
+	}
+	if options.WindowSize != 0 {
+		if options.WindowSize < 1 || options.WindowSize > 65535 {
+			return nil, errors.New("Window size must be between 1 and 65535 blocks")
+		}
+		requested["windowsize"] = strconv.Itoa(options.WindowSize)
+	}
+
+	return requested, nil
+}
+
+func newResult(stats internal.TransferStats) Result {
+	var result Result = Result{
+		Bytes:        int64(stats.Bytes),
+		TransferSize: -1,
+		BlockSize:    int(stats.BlockSize),
+		WindowSize:   int(stats.WindowSize),
+		Timeout:      stats.Timeout,
+		Options:      stats.Options,
+		Duration:     stats.Duration,
+	}
+
+	if _, ok := stats.Options["tsize"]; ok {
+		result.TransferSize = int64(stats.TransferSize)
+	}
+
+	return result
+}
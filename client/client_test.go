@@ -0,0 +1,153 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/moretiles/tftpcpd/internal"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// server on network listening on 127.0.0.1:69, shut down once the test finishes
+func newTestServer(t *testing.T, network *internal.MemoryNetwork) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/root", 0755); err != nil {
+		t.Fatalf("Unable to create root: %v\n", err)
+	}
+	root, err := os.OpenRoot(dir + "/root")
+	if err != nil {
+		t.Fatalf("Unable to open root: %v\n", err)
+	}
+
+	server, err := internal.NewServer(internal.Config{
+		Network:       network,
+		Retries:       5,
+		Backoff:       1,
+		LogOutput:     io.Discard,
+		Directory:     root,
+		Sqlite3DBPath: dir + "/tftpcpd.db",
+		Address:       "127.0.0.1:69",
+	})
+	if err != nil {
+		t.Fatalf("Unable to create server: %v\n", err)
+	}
+	go server.Serve(context.Background())
+	for deadline := time.Now().Add(time.Second); server.Addr() == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server never started listening\n")
+		}
+	}
+
+	t.Cleanup(func() {
+		// uploads dally after they complete, no need to wait for them
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		server.Shutdown(ctx)
+		root.Close()
+	})
+}
+
+func TestPutThenGet(t *testing.T) {
+	network := internal.NewMemoryNetwork()
+	newTestServer(t, network)
+	client := &Client{Address: "127.0.0.1:69", Network: network}
+
+	contents := make([]byte, 1024*10+100)
+	for i := range contents {
+		contents[i] = byte(i * 13)
+	}
+
+	cases := []struct {
+		name    string
+		options *Options
+	}{
+		{"defaults.bin", nil},
+		{"options.bin", &Options{BlockSize: 1024, Timeout: time.Second, WindowSize: 4, TransferSize: true}},
+	}
+
+	for _, c := range cases {
+		// hide Seek so blocks that are resent have to come from what the client kept
+		put, err := client.Put(context.Background(), c.name, io.MultiReader(bytes.NewReader(contents)), int64(len(contents)), c.options)
+		if err != nil {
+			t.Fatalf("%v: Put failed: %v\n", c.name, err)
+		}
+		if put.Bytes != int64(len(contents)) || put.TransferSize != int64(len(contents)) {
+			t.Fatalf("%v: Put sent %v bytes announced as %v instead of %v\n", c.name, put.Bytes, put.TransferSize, len(contents))
+		}
+
+		var received bytes.Buffer
+		get, err := client.Get(context.Background(), c.name, &received, c.options)
+		if err != nil {
+			t.Fatalf("%v: Get failed: %v\n", c.name, err)
+		}
+		if !bytes.Equal(received.Bytes(), contents) {
+			t.Fatalf("%v: Got %v bytes that differ from the %v put\n", c.name, received.Len(), len(contents))
+		}
+		if get.Bytes != int64(len(contents)) {
+			t.Fatalf("%v: Get counted %v bytes instead of %v\n", c.name, get.Bytes, len(contents))
+		}
+
+		if c.options == nil {
+			if get.BlockSize != 512 || get.WindowSize != 1 || get.TransferSize != -1 || len(get.Options) != 0 {
+				t.Fatalf("%v: Defaults not used: %+v\n", c.name, get)
+			}
+		} else {
+			if get.BlockSize != 1024 || get.WindowSize != 4 || get.Timeout != time.Second || get.TransferSize != int64(len(contents)) {
+				t.Fatalf("%v: Options not used: %+v\n", c.name, get)
+			}
+		}
+	}
+}
+
+func TestGetMissing(t *testing.T) {
+	network := internal.NewMemoryNetwork()
+	newTestServer(t, network)
+	client := &Client{Address: "127.0.0.1:69", Network: network}
+
+	_, err := client.Get(context.Background(), "missing.bin", io.Discard, nil)
+	if !errors.Is(err, ErrNotFound) || ErrorCode(err) != 1 {
+		t.Fatalf("Get returned %v instead of %v\n", err, ErrNotFound)
+	}
+}
+
+func TestOptionsOutOfRange(t *testing.T) {
+	client := &Client{Address: "127.0.0.1:69", Network: internal.NewMemoryNetwork()}
+
+	cases := map[string]Options{
+		"Timeout of an hour":          {Timeout: time.Hour},
+		"Block size of 4 bytes":       {BlockSize: 4},
+		"Block size of 65465 bytes":   {BlockSize: 65465},
+		"Window size of -1 blocks":    {WindowSize: -1},
+		"Window size of 65536 blocks": {WindowSize: 65536},
+	}
+	for name, options := range cases {
+		if _, err := client.Get(context.Background(), "any.bin", io.Discard, &options); err == nil {
+			t.Fatalf("%v accepted\n", name)
+		}
+		if _, err := client.Put(context.Background(), "any.bin", bytes.NewReader(nil), 0, &options); err == nil {
+			t.Fatalf("%v accepted for an upload\n", name)
+		}
+	}
+	client.Mode = "mail"
+	if _, err := client.Get(context.Background(), "any.bin", io.Discard, nil); err == nil {
+		t.Fatalf("Mail mode accepted\n")
+	}
+}
+
+// servers may be named instead of given by address
+func TestHostname(t *testing.T) {
+	network := internal.NewMemoryNetwork()
+	newTestServer(t, network)
+	client := &Client{Address: "localhost:69", Network: network}
+
+	if _, err := client.Put(context.Background(), "named.bin", bytes.NewReader([]byte("named")), -1, nil); err != nil {
+		t.Fatalf("Put to localhost failed: %v\n", err)
+	}
+	var received bytes.Buffer
+	if _, err := client.Get(context.Background(), "named.bin", &received, nil); err != nil || received.String() != "named" {
+		t.Fatalf("Get from localhost returned %q %v\n", received.String(), err)
+	}
+}
@@ -3,15 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strconv"
 	"strings"
 	//"path/filepath"
 	//"net"
 	"os"
 	"os/signal"
 	//"reflect"
-	"sync"
 	//"time"
-	//"errors"
 	//"strings"
 	"context"
 	"github.com/moretiles/tftpcpd/internal"
@@ -19,7 +18,9 @@ import (
 
 // setup configuration using commandline arguments
 // no error returned because we exit early if there is a problem
-func processFlags() {
+func processFlags() internal.Config {
+	var cfg internal.Config
+
 	// Set flag.Usage to change default help message
 	oldFlagUsageFunction := flag.Usage
 	flag.Usage = func() { helpMessage(oldFlagUsageFunction) }
@@ -27,9 +28,14 @@ func processFlags() {
 	// behavior
 	var debug *bool = flag.Bool("debug", false, "enable debug mode")
 	var help *bool = flag.Bool("help", false, "print usage information")
+	var retries *int = flag.Int("retries", 5, "number of times to resend a message when the other side does not respond")
+	var backoff *float64 = flag.Float64("backoff", 2, "multiply the time waited for a response by this after every resend")
 
 	// client
 	var write *string = flag.String("write", "", "tries to upload this file instead of downloading anything")
+	var mode *string = flag.String("mode", internal.ModeOctet, "transfer mode, either octet or netascii")
+	var windowSize *int = flag.Int("windowsize", 0, "number of blocks sent before waiting for an acknowledgement, 0 to not ask the server")
+	var multicast *bool = flag.Bool("multicast", false, "ask the server to send the download to a multicast group shared with other clients")
 
 	flag.Parse()
 
@@ -38,29 +44,41 @@ func processFlags() {
 		os.Exit(0)
 	}
 
-	internal.Cfg.Debug = *debug
-	internal.Cfg.Write = *write
+	cfg.Debug = *debug
+	cfg.Retries = *retries
+	cfg.Backoff = *backoff
+	cfg.Write = *write
+	cfg.Mode = strings.ToLower(*mode)
+	if cfg.Mode != internal.ModeOctet && cfg.Mode != internal.ModeNetascii {
+		flag.Usage()
+		os.Exit(1)
+	}
+	cfg.WindowSize = *windowSize
+	cfg.Multicast = *multicast
 
 	args := flag.Args()
 
 	if len(args) != 1 {
 		flag.Usage()
 		os.Exit(1)
-	} else if internal.Cfg.Write != "" {
+	} else if cfg.Write != "" {
 		// client is making a read request
-		internal.Cfg.Address = args[0]
-		internal.Cfg.Filename = internal.Cfg.Write
+		cfg.Address = args[0]
+		cfg.Filename = cfg.Write
 	} else {
 		// client is making a write request
-		splitArgs := strings.Split(args[0], "/")
-		if len(splitArgs) != 2 {
+		// everything after the first slash is the path of the file on the server
+		address, filename, found := strings.Cut(args[0], "/")
+		if !found || filename == "" {
 			flag.Usage()
 			os.Exit(1)
 		}
 
-		internal.Cfg.Address = splitArgs[0]
-		internal.Cfg.Filename = splitArgs[1]
+		cfg.Address = address
+		cfg.Filename = filename
 	}
+
+	return cfg
 }
 
 func helpMessage(body func()) {
@@ -79,82 +97,43 @@ func helpMessage(body func()) {
 	fmt.Println("")
 }
 
-func init() {
-	internal.Cfg.Testing = flag.Bool("testing", false, "Used to control special behavior required for running tests.")
-}
-
 func main() {
-	var (
-		loggerParentToChild  chan internal.Signal = make(chan internal.Signal, 2)
-		loggerChildToParent  chan internal.Signal = make(chan internal.Signal, 2)
-		clientContext        context.Context
-		clientCancelFunction context.CancelFunc
-		interruptHandler     chan os.Signal = make(chan os.Signal, 2)
-		wg                   sync.WaitGroup
-		exitCode             int
-	)
-
-	//locals
-	defer close(loggerParentToChild)
-	defer close(loggerChildToParent)
-	defer close(interruptHandler)
-
-	processFlags()
-	if internal.LoggerInit() != nil {
+	var exitCode int
+
+	cfg := processFlags()
+	client, err := internal.NewClient(cfg)
+	if err != nil {
 		os.Exit(2)
 	}
 
-	// inform user how to exit and start goroutines
-	{
-		// logger routine collects logs
-		wg.Go(func() {
-			internal.LoggerRoutine(loggerChildToParent, loggerParentToChild)
-		})
-
-		// client routine exits with 0 if it completes successfully
-		clientContext, clientCancelFunction = context.WithCancel(context.Background())
-		wg.Go(func() {
-			options := make(map[string]string)
-			var doingWrite bool = internal.Cfg.Write != ""
-			internal.ClientRoutine(doingWrite, internal.Cfg.Filename, options, clientContext)
-		})
+	options := make(map[string]string)
+	if cfg.WindowSize > 0 {
+		options["windowsize"] = strconv.Itoa(cfg.WindowSize)
+	}
+	if cfg.Multicast {
+		options["multicast"] = ""
 	}
 
-	// handle child goroutines terminating and signals
-	{
-		exitCode = 0
-		signal.Notify(interruptHandler, os.Interrupt)
-		select {
-		case <-interruptHandler:
-			clientCancelFunction()
-			close(internal.Log)
-			loggerParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-			<-loggerChildToParent
-
-			// do not modify exit code because this is the expected termination method
-		case sig := <-loggerChildToParent:
-			if sig.IsResponse() {
-				// impossible
-				panic("AHHHHHHHHHHHHHHHHHHH!")
-			}
-
-			if sig.Kind == internal.SignalRestart {
-				loggerParentToChild <- internal.NewSignal(internal.SignalRestart, internal.SignalAccept)
-			} else if sig.Kind == internal.SignalTerminate {
-				clientCancelFunction()
-				close(internal.Log)
-				loggerParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalAccept)
-			} else {
-				// impossible
-				panic("AHHHHHHHHHHHHHHHHHHH!")
-			}
-
-			exitCode = 11
+	// exit with 0 if the transfer completes successfully or is interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	if cfg.Write != "" {
+		err = client.Write(ctx, cfg.Filename, options)
+		if err != nil {
+			exitCode = 21
 		}
+	} else {
+		options["tsize"] = "0"
+		err = client.Read(ctx, cfg.Filename, options)
+		if err != nil {
+			exitCode = 22
+		}
+	}
+	if ctx.Err() != nil {
+		exitCode = 0
 	}
+	stop()
 
-	// wait for all goroutines to finished
-	wg.Wait()
+	client.Close()
 
 	// Exit using code we set
 	os.Exit(exitCode)
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moretiles/tftpcpd/internal"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+)
+
+// something done to the database at -sqlite3-db and the versions it keeps in -directory instead of serving them
+type command struct {
+	usage string
+	run   func(ctx context.Context, database *internal.Database, args []string, out io.Writer) error
+}
+
+// commands by the name given in place of the address, each safe to run while a server uses the same database and fsck -repair refusing to
+var commands map[string]command = map[string]command{
+	"files":    {filesUsage, filesCommand},
+	"fsck":     {fsckUsage, fsckCommand},
+	"promote":  {"promote filename@uploadStarted", promoteCommand},
+	"rollback": {"rollback filename", rollbackCommand},
+}
+
+// every command's usage line
+func commandUsages() []string {
+	var usages []string
+	for _, command := range commands {
+		usages = append(usages, command.usage)
+	}
+	slices.Sort(usages)
+
+	return usages
+}
+
+// run the command named by args[0] with the rest of args printing its output to out, returning the exit code
+func runCommand(cfg internal.Config, args []string, out io.Writer) int {
+	var command command = commands[args[0]]
+
+	// output of the command goes to out and nothing else does
+	cfg.LogOutput = os.Stderr
+	logger, err := internal.NewLogger(&cfg)
+	if err != nil {
+		return 3
+	}
+	defer logger.Close()
+
+	database, err := internal.AttachDatabase(&cfg, logger.Events)
+	if err != nil {
+		return 3
+	}
+	defer database.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = command.run(ctx, database, args[1:], out)
+	if err != nil {
+		logger.Events <- internal.NewErrorEvent("COMMAND", fmt.Sprintf("%v failed: %v", args[0], err))
+		return 1
+	}
+
+	return 0
+}
+
+// make a kept version the one that is served
+func promoteCommand(ctx context.Context, database *internal.Database, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("Usage: promote filename@uploadStarted")
+	}
+	filename, started, ok := internal.SplitVersion(args[0])
+	if !ok {
+		return fmt.Errorf("Not a version, expected filename@uploadStarted: %v", args[0])
+	}
+
+	version, err := database.Promote(ctx, filename, started)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Serving %v@%v\n", version.Filename, version.Started)
+
+	return nil
+}
+
+// make the version served before the current one the one that is served again
+func rollbackCommand(ctx context.Context, database *internal.Database, args []string, out io.Writer) error {
+	if len(args) != 1 || strings.Contains(args[0], "@") {
+		return errors.New("Usage: rollback filename")
+	}
+
+	version, err := database.Rollback(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Serving %v@%v\n", version.Filename, version.Started)
+
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/moretiles/tftpcpd/internal"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// configuration for commands on a root directory and database of their own
+func commandConfig(t *testing.T) internal.Config {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/root", 0755); err != nil {
+		t.Fatalf("Unable to create root: %v\n", err)
+	}
+	root, err := os.OpenRoot(dir + "/root")
+	if err != nil {
+		t.Fatalf("Unable to open root: %v\n", err)
+	}
+	t.Cleanup(func() { root.Close() })
+
+	return internal.Config{Directory: root, Sqlite3DBPath: dir + "/tftpcpd.db", LogOutput: io.Discard}
+}
+
+// open the database of cfg the way a server does, keeping every version
+func openAsServer(t *testing.T, cfg internal.Config) *internal.Database {
+	cfg.Retention = internal.RetentionPolicy{{Pattern: "*", Keep: 100}}
+	logger, err := internal.NewLogger(&cfg)
+	if err != nil {
+		t.Fatalf("Unable to create logger: %v\n", err)
+	}
+	t.Cleanup(func() { logger.Close() })
+
+	database, err := internal.OpenDatabase(&cfg, logger.Events)
+	if err != nil {
+		t.Fatalf("Unable to open database: %v\n", err)
+	}
+
+	return database
+}
+
+// upload each of contents in turn as a version of filename, returning the versions oldest first
+func uploadVersions(t *testing.T, cfg internal.Config, filename string, contents ...string) []internal.Version {
+	ctx := context.Background()
+	database := openAsServer(t, cfg)
+	defer database.Close()
+
+	for _, content := range contents {
+		upload, err := database.BeginUpload(ctx, filename)
+		if err != nil {
+			t.Fatalf("Unable to begin upload of %v: %v\n", filename, err)
+		}
+		if _, err = io.WriteString(upload, content); err != nil {
+			t.Fatalf("Unable to write %v: %v\n", filename, err)
+		}
+		if err = upload.Commit(); err != nil {
+			t.Fatalf("Unable to commit %v: %v\n", filename, err)
+		}
+	}
+
+	versions, err := database.Versions(ctx, filename)
+	if err != nil || len(versions) != len(contents) {
+		t.Fatalf("Uploaded %+v %v\n", versions, err)
+	}
+
+	return versions
+}
+
+// run a command the way tftpcpd would with args, returning what it printed and its exit code
+func runArgs(cfg internal.Config, args ...string) (string, int) {
+	var out bytes.Buffer
+	code := runCommand(cfg, args, &out)
+
+	return out.String(), code
+}
+
+// run a command printing JSON into output, failing unless it exits with code
+func runJSON(t *testing.T, cfg internal.Config, code int, output any, args ...string) {
+	printed, exited := runArgs(cfg, append(args, "-json")...)
+	if exited != code {
+		t.Fatalf("%v exited with %v instead of %v, printing %q\n", args, exited, code, printed)
+	}
+	if err := json.Unmarshal([]byte(printed), output); err != nil {
+		t.Fatalf("%v printed %q: %v\n", args, printed, err)
+	}
+}
+
+// the state of each version of filename by filename@uploadStarted
+func versionStates(t *testing.T, cfg internal.Config, filename string) map[string]string {
+	var rows []versionRow
+	var states map[string]string = make(map[string]string)
+
+	runJSON(t, cfg, 0, &rows, "files", "versions", filename)
+	for _, row := range rows {
+		states[row.Version] = row.State
+	}
+
+	return states
+}
+
+func TestFilesCommand(t *testing.T) {
+	cfg := commandConfig(t)
+	kernel := uploadVersions(t, cfg, "kernel", "first", "second", "third")
+	uploadVersions(t, cfg, "initrd", "only")
+
+	var files []fileRow
+	runJSON(t, cfg, 0, &files, "files", "ls")
+	if len(files) != 2 || files[0].Filename != "initrd" || files[1].Filename != "kernel" {
+		t.Fatalf("Listed %+v\n", files)
+	}
+	if files[1].Current != versionName(kernel[2]) || files[1].Versions != 3 || files[1].Size != 5 {
+		t.Fatalf("Listed kernel as %+v\n", files[1])
+	}
+
+	printed, code := runArgs(cfg, "files", "versions", "kernel")
+	lines := strings.Split(strings.TrimSpace(printed), "\n")
+	if code != 0 || len(lines) != 4 || !strings.HasPrefix(lines[0], "VERSION") || !strings.HasSuffix(lines[3], "current") || !strings.HasSuffix(lines[1], "kept") {
+		t.Fatalf("Printed versions %q with exit code %v\n", printed, code)
+	}
+
+	for _, args := range [][]string{{"files"}, {"files", "bogus"}, {"files", "versions"}, {"files", "versions", "missing"}, {"files", "ls", "-bogus"}} {
+		if printed, code = runArgs(cfg, args...); code != 1 || printed != "" {
+			t.Fatalf("%v exited with %v printing %q\n", args, code, printed)
+		}
+	}
+
+	// garbage collection deletes by the rules it is given and none are given here
+	if printed, code = runArgs(cfg, "files", "gc"); code != 1 || printed != "" {
+		t.Fatalf("files gc without -retain exited with %v printing %q\n", code, printed)
+	}
+	if states := versionStates(t, cfg, "kernel"); len(states) != 3 {
+		t.Fatalf("files gc without -retain left %v\n", states)
+	}
+	var deleted []versionRow
+	cfg.Retention = internal.RetentionPolicy{{Pattern: "*", Keep: 2}}
+	runJSON(t, cfg, 0, &deleted, "files", "gc")
+	if len(deleted) != 1 || deleted[0].Version != versionName(kernel[0]) {
+		t.Fatalf("files gc deleted %+v\n", deleted)
+	}
+
+	var removed []versionRow
+	runJSON(t, cfg, 0, &removed, "files", "rm", versionName(kernel[1]))
+	if len(removed) != 1 || removed[0].Version != versionName(kernel[1]) {
+		t.Fatalf("files rm removed %+v\n", removed)
+	}
+	if states := versionStates(t, cfg, "kernel"); len(states) != 1 || states[versionName(kernel[2])] != "current" {
+		t.Fatalf("files rm left %v\n", states)
+	}
+
+	var problems []problemRow
+	runJSON(t, cfg, 0, &problems, "files", "verify")
+	if len(problems) != 0 {
+		t.Fatalf("files verify found %+v\n", problems)
+	}
+}
+
+func TestPromoteAndRollback(t *testing.T) {
+	cfg := commandConfig(t)
+	kernel := uploadVersions(t, cfg, "kernel", "first", "second")
+
+	printed, code := runArgs(cfg, "promote", versionName(kernel[0]))
+	if code != 0 || printed != fmt.Sprintf("Serving %v\n", versionName(kernel[0])) {
+		t.Fatalf("promote exited with %v printing %q\n", code, printed)
+	}
+	if states := versionStates(t, cfg, "kernel"); states[versionName(kernel[0])] != "current" || states[versionName(kernel[1])] != "kept" {
+		t.Fatalf("promote left %v\n", states)
+	}
+	var rows []versionRow
+	runJSON(t, cfg, 0, &rows, "files", "versions", "kernel")
+	if len(rows) != 2 || rows[0].UploadCompleted != kernel[0].Completed || rows[0].Promoted == 0 || rows[1].Promoted != 0 {
+		t.Fatalf("promote changed the versions to %+v\n", rows)
+	}
+
+	// rolling back undoes the promotion
+	printed, code = runArgs(cfg, "rollback", "kernel")
+	if code != 0 || printed != fmt.Sprintf("Serving %v\n", versionName(kernel[1])) {
+		t.Fatalf("rollback exited with %v printing %q\n", code, printed)
+	}
+	if states := versionStates(t, cfg, "kernel"); states[versionName(kernel[1])] != "current" {
+		t.Fatalf("rollback left %v\n", states)
+	}
+
+	for _, args := range [][]string{{"promote"}, {"promote", "kernel"}, {"promote", "kernel@1"}, {"rollback", versionName(kernel[0])}, {"rollback", "missing"}} {
+		if printed, code = runArgs(cfg, args...); code != 1 || printed != "" {
+			t.Fatalf("%v exited with %v printing %q\n", args, code, printed)
+		}
+	}
+}
+
+// a database that can not be opened is told apart from a command that failed
+func TestCommandWithoutDatabase(t *testing.T) {
+	cfg := commandConfig(t)
+	cfg.Sqlite3DBPath = t.TempDir() + "/missing/tftpcpd.db"
+
+	if printed, code := runArgs(cfg, "files", "ls"); code != 3 || printed != "" {
+		t.Fatalf("files ls without a database exited with %v printing %q\n", code, printed)
+	}
+}
+
+func TestFsckCommand(t *testing.T) {
+	ctx := context.Background()
+	cfg := commandConfig(t)
+	root := cfg.Directory.Name()
+	kernel := uploadVersions(t, cfg, "kernel", "served")
+	initrd := uploadVersions(t, cfg, "initrd", "cut short")
+	lost := uploadVersions(t, cfg, "lost", "gone")
+
+	// a server that stopped without cleaning up left a reservation and an upload behind
+	database := openAsServer(t, cfg)
+	if _, err := database.DB.ExecContext(ctx, `UPDATE files SET consumers = 3 WHERE filename = 'kernel';`); err != nil {
+		t.Fatalf("Unable to leave a reservation behind: %v\n", err)
+	}
+	if _, err := database.DB.ExecContext(ctx, `INSERT INTO files(filename, uploadStarted, uploadCompleted, consumers) VALUES ('failed', 1700000000000003, 0, 0);`); err != nil {
+		t.Fatalf("Unable to leave an upload behind: %v\n", err)
+	}
+	database.Close()
+	if err := os.WriteFile(path.Join(root, initrd[0].Path()), []byte("cut"), 0644); err != nil {
+		t.Fatalf("Unable to truncate initrd: %v\n", err)
+	}
+	if err := os.Remove(path.Join(root, lost[0].Path())); err != nil {
+		t.Fatalf("Unable to remove lost: %v\n", err)
+	}
+	if err := os.WriteFile(path.Join(root, "ghost.1700000000000000"), nil, 0644); err != nil {
+		t.Fatalf("Unable to write ghost: %v\n", err)
+	}
+
+	expected := map[string]string{
+		versionName(lost[0]):      "deleted row",
+		versionName(initrd[0]):    "quarantined as .tftpcpd-quarantine/" + initrd[0].Path(),
+		"ghost.1700000000000000":  "quarantined as .tftpcpd-quarantine/ghost.1700000000000000",
+		versionName(kernel[0]):    "released",
+		"failed@1700000000000003": "deleted",
+	}
+
+	// checking reports without acting and fails
+	var problems []problemRow
+	runJSON(t, cfg, 1, &problems, "fsck")
+	if len(problems) != len(expected) {
+		t.Fatalf("fsck found %+v\n", problems)
+	}
+	for _, problem := range problems {
+		if _, ok := expected[problem.Name]; !ok || problem.Action != "" {
+			t.Fatalf("fsck found %+v\n", problem)
+		}
+	}
+
+	runJSON(t, cfg, 0, &problems, "fsck", "-repair")
+	if len(problems) != len(expected) {
+		t.Fatalf("fsck -repair found %+v\n", problems)
+	}
+	for _, problem := range problems {
+		if problem.Action != expected[problem.Name] {
+			t.Fatalf("fsck -repair did %q about %v instead of %q\n", problem.Action, problem.Name, expected[problem.Name])
+		}
+	}
+
+	printed, code := runArgs(cfg, "fsck")
+	if code != 0 || strings.TrimSpace(printed) != "PROBLEM  NAME  DETAIL  ACTION" {
+		t.Fatalf("fsck after repairing exited with %v printing %q\n", code, printed)
+	}
+	if printed, code = runArgs(cfg, "fsck", "extra"); code != 1 || printed != "" {
+		t.Fatalf("fsck with an operand exited with %v printing %q\n", code, printed)
+	}
+}
+
+// every kind of problem appears twice so that each action lands on the row of the problem it belongs to
+func TestFsckProblems(t *testing.T) {
+	version := func(filename string) internal.Version {
+		return internal.Version{Filename: filename, Started: 1700000000000000, Completed: 1700000000000001}
+	}
+	report := internal.FsckReport{
+		VerifyReport: internal.VerifyReport{
+			RowsWithoutFiles: []internal.Version{version("lost-a"), version("lost-b")},
+			Truncated:        []internal.Version{version("cut-a"), version("cut-b")},
+			FilesWithoutRows: []string{"ghost-a.1700000000000000", "ghost-b.1700000000000000"},
+			Unmanaged:        []string{"new-a", "new-b"},
+		},
+		StaleReservations: []internal.Version{version("read-a"), version("read-b")},
+		FailedUploads:     []internal.Version{version("failed-a"), version("failed-b")},
+		Quarantined: map[string]string{
+			version("cut-a").Path():    "q/cut-a",
+			version("cut-b").Path():    "q/cut-b",
+			"ghost-a.1700000000000000": "q/ghost-a",
+			"ghost-b.1700000000000000": "q/ghost-b",
+		},
+	}
+
+	if problems := fsckProblems(report); len(problems) != 12 || problems[0].Action != "" || problems[11].Action != "" {
+		t.Fatalf("Problems found while checking are %+v\n", problems)
+	}
+
+	report.Repaired = true
+	expected := []problemRow{
+		{"version without file", "lost-a@1700000000000000", "", "deleted row"},
+		{"version without file", "lost-b@1700000000000000", "", "deleted row"},
+		{"truncated", "cut-a@1700000000000000", "recorded 0 bytes", "quarantined as q/cut-a"},
+		{"truncated", "cut-b@1700000000000000", "recorded 0 bytes", "quarantined as q/cut-b"},
+		{"file without row", "ghost-a.1700000000000000", "", "quarantined as q/ghost-a"},
+		{"file without row", "ghost-b.1700000000000000", "", "quarantined as q/ghost-b"},
+		{"not yet imported", "new-a", "", ""},
+		{"not yet imported", "new-b", "", ""},
+		{"stale reservation", "read-a@1700000000000000", "0 readers", "released"},
+		{"stale reservation", "read-b@1700000000000000", "0 readers", "released"},
+		{"failed upload", "failed-a@1700000000000000", "", "deleted"},
+		{"failed upload", "failed-b@1700000000000000", "", "deleted"},
+	}
+	problems := fsckProblems(report)
+	if len(problems) != len(expected) {
+		t.Fatalf("Repairs are %+v\n", problems)
+	}
+	for i := range expected {
+		if problems[i] != expected[i] {
+			t.Fatalf("Repair %v is %+v instead of %+v\n", i, problems[i], expected[i])
+		}
+	}
+}
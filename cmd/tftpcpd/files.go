@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/moretiles/tftpcpd/internal"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+const filesUsage = "files {ls | versions filename | rm filename[@uploadStarted] | gc | verify} [-json]"
+
+// one version as printed by the files command
+type versionRow struct {
+	// filename@uploadStarted, what promote and rm take and clients may ask for
+	Version         string `json:"version"`
+	Filename        string `json:"filename"`
+	UploadStarted   int64  `json:"uploadStarted"`
+	UploadCompleted int64  `json:"uploadCompleted"`
+	// when promote or rollback last made it the current version, 0 when they never did
+	Promoted int64 `json:"promoted"`
+	// -1 when the file is missing
+	Size    int64 `json:"size"`
+	Readers int64 `json:"readers"`
+	// current, kept, or uploading
+	State string `json:"state"`
+}
+
+// one file as printed by files ls
+type fileRow struct {
+	Filename string `json:"filename"`
+	// the version that is served, empty while the first upload is in progress
+	Current   string `json:"current"`
+	Size      int64  `json:"size"`
+	Completed int64  `json:"uploadCompleted"`
+	Versions  int    `json:"versions"`
+	Readers   int64  `json:"readers"`
+	Uploading int    `json:"uploading"`
+}
+
+// one thing files verify or fsck found
+type problemRow struct {
+	Problem string `json:"problem"`
+	// filename@uploadStarted for versions, the path below the root directory for files
+	Name   string `json:"name"`
+	Detail string `json:"detail,omitempty"`
+	// what fsck -repair did about it, empty when nothing was done
+	Action string `json:"action,omitempty"`
+}
+
+// inspect and change the versions kept in the database
+func filesCommand(ctx context.Context, database *internal.Database, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("Usage: " + filesUsage)
+	}
+
+	flags := flag.NewFlagSet("files "+args[0], flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	operands, err := parseInterspersed(flags, args[1:])
+	if err != nil {
+		return err
+	}
+
+	var output any
+	switch {
+	case args[0] == "ls" && len(operands) == 0:
+		output, err = listFiles(ctx, database)
+	case args[0] == "versions" && len(operands) == 1:
+		output, err = listVersions(ctx, database, operands[0])
+	case args[0] == "rm" && len(operands) == 1:
+		output, err = removeVersions(ctx, database, operands[0])
+	case args[0] == "gc" && len(operands) == 0:
+		output, err = collectGarbage(ctx, database)
+	case args[0] == "verify" && len(operands) == 0:
+		output, err = verify(ctx, database)
+	default:
+		return errors.New("Usage: " + filesUsage)
+	}
+	// verify prints what it found even when that is a problem
+	if err == nil || args[0] == "verify" {
+		printOutput(out, output, *asJSON)
+	}
+
+	return err
+}
+
+// print what a command returned as indented JSON or a table
+func printOutput(out io.Writer, output any, asJSON bool) {
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(output)
+	} else {
+		printTable(out, output)
+	}
+}
+
+// parse flags wherever they appear among the operands, so that -json may come last
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var operands []string
+
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return operands, nil
+		}
+		operands = append(operands, args[0])
+		args = args[1:]
+	}
+}
+
+// every version of filename oldest first
+func versionRows(ctx context.Context, database *internal.Database, filename string) ([]versionRow, error) {
+	var rows []versionRow
+	var newest int64
+
+	versions, err := database.Versions(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		newest = max(newest, version.Served())
+	}
+
+	for _, version := range versions {
+		row := versionRow{
+			Version:         versionName(version),
+			Filename:        version.Filename,
+			UploadStarted:   version.Started,
+			UploadCompleted: version.Completed,
+			Promoted:        version.Promoted,
+			Size:            -1,
+			Readers:         version.Consumers,
+			State:           "kept",
+		}
+		if info, err := database.Stat(version); err == nil {
+			row.Size = info.Size()
+		}
+		if version.Completed == 0 {
+			row.State = "uploading"
+		} else if version.Served() == newest {
+			row.State = "current"
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// every file with the version that is served
+func listFiles(ctx context.Context, database *internal.Database) ([]fileRow, error) {
+	var files []fileRow = []fileRow{}
+
+	filenames, err := database.Filenames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range filenames {
+		versions, err := versionRows(ctx, database, filename)
+		if err != nil {
+			return nil, err
+		}
+
+		file := fileRow{Filename: filename, Size: -1}
+		for _, version := range versions {
+			switch version.State {
+			case "current":
+				file.Current, file.Size, file.Completed = version.Version, version.Size, version.UploadCompleted
+				file.Versions += 1
+			case "kept":
+				file.Versions += 1
+			case "uploading":
+				file.Uploading += 1
+			}
+			file.Readers += version.Readers
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+func listVersions(ctx context.Context, database *internal.Database, filename string) ([]versionRow, error) {
+	versions, err := versionRows(ctx, database, filename)
+	if err == nil && len(versions) == 0 {
+		return nil, fmt.Errorf("No versions of %v", filename)
+	}
+
+	return versions, err
+}
+
+// delete one version given as filename@uploadStarted or every version of filename
+func removeVersions(ctx context.Context, database *internal.Database, name string) ([]versionRow, error) {
+	filename, started, ok := internal.SplitVersion(name)
+	if !ok {
+		filename, started = name, 0
+	}
+
+	before, err := versionRows(ctx, database, filename)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := database.Remove(ctx, filename, started)
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(before, func(row versionRow) bool {
+		return !slices.ContainsFunc(removed, func(version internal.Version) bool { return version.Started == row.UploadStarted })
+	}), nil
+}
+
+// delete the versions the retention policy given with -retain does not keep, printing them
+// the server's rules are not recorded anywhere, so they have to be given again rather than falling back to the default
+func collectGarbage(ctx context.Context, database *internal.Database) ([]versionRow, error) {
+	var deleted []versionRow = []versionRow{}
+
+	if len(database.Retention()) == 0 {
+		return nil, errors.New("Collecting garbage deletes whatever the -retain rules do not keep, give the rules the server uses or -retain '*=2' when it uses none")
+	}
+
+	filenames, err := database.Filenames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var before []versionRow
+	for _, filename := range filenames {
+		versions, err := versionRows(ctx, database, filename)
+		if err != nil {
+			return nil, err
+		}
+		before = append(before, versions...)
+	}
+
+	err = database.GarbageCollect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range before {
+		versions, err := database.Versions(ctx, row.Filename)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(versions, func(version internal.Version) bool { return version.Started == row.UploadStarted }) {
+			deleted = append(deleted, row)
+		}
+	}
+
+	return deleted, nil
+}
+
+// check the database against the root directory, failing when something is wrong
+func verify(ctx context.Context, database *internal.Database) ([]problemRow, error) {
+	report, err := database.Verify(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := verifyProblems(report)
+	if report.Problems() != 0 {
+		return problems, fmt.Errorf("Found %v problems", report.Problems())
+	}
+
+	return problems, nil
+}
+
+// every problem in report followed by the files waiting to be imported
+func verifyProblems(report internal.VerifyReport) []problemRow {
+	var problems []problemRow = []problemRow{}
+
+	for _, version := range report.RowsWithoutFiles {
+		problems = append(problems, problemRow{Problem: "version without file", Name: versionName(version)})
+	}
+	for _, version := range report.Truncated {
+		problems = append(problems, problemRow{Problem: "truncated", Name: versionName(version), Detail: fmt.Sprintf("recorded %v bytes", version.Size)})
+	}
+	for _, name := range report.FilesWithoutRows {
+		problems = append(problems, problemRow{Problem: "file without row", Name: name})
+	}
+	for _, name := range report.Unmanaged {
+		problems = append(problems, problemRow{Problem: "not yet imported", Name: name})
+	}
+
+	return problems
+}
+
+// filename@uploadStarted
+func versionName(version internal.Version) string {
+	return fmt.Sprintf("%v@%v", version.Filename, version.Started)
+}
+
+// print what a files command returned as aligned columns
+func printTable(out io.Writer, output any) {
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer table.Flush()
+
+	switch output := output.(type) {
+	case []fileRow:
+		fmt.Fprintln(table, "FILENAME\tSIZE\tCOMPLETED\tVERSIONS\tREADERS\tUPLOADING\tCURRENT")
+		for _, file := range output {
+			fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", file.Filename, size(file.Size), timestamp(file.Completed), file.Versions, file.Readers, file.Uploading, file.Current)
+		}
+	case []versionRow:
+		fmt.Fprintln(table, "VERSION\tSIZE\tCOMPLETED\tPROMOTED\tREADERS\tSTATE")
+		for _, version := range output {
+			fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\n", version.Version, size(version.Size), timestamp(version.UploadCompleted), timestamp(version.Promoted), version.Readers, version.State)
+		}
+	case []problemRow:
+		fmt.Fprintln(table, "PROBLEM\tNAME\tDETAIL\tACTION")
+		for _, problem := range output {
+			fmt.Fprintf(table, "%v\t%v\t%v\t%v\n", problem.Problem, problem.Name, problem.Detail, problem.Action)
+		}
+	}
+}
+
+// size in bytes, - when the file is missing
+func size(bytes int64) string {
+	if bytes < 0 {
+		return "-"
+	}
+
+	return fmt.Sprint(bytes)
+}
+
+// local time of a unix microsecond timestamp, - for 0
+func timestamp(unixMicro int64) string {
+	if unixMicro == 0 {
+		return "-"
+	}
+
+	return time.UnixMicro(unixMicro).Format(time.DateTime)
+}
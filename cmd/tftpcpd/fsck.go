@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/moretiles/tftpcpd/internal"
+	"io"
+)
+
+const fsckUsage = "fsck [-repair] [-json]"
+
+// check the database against the root directory, and repair it with -repair, while no server uses them
+func fsckCommand(ctx context.Context, database *internal.Database, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix what was found instead of only reporting it, never while a server uses the database")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	operands, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(operands) != 0 {
+		return errors.New("Usage: " + fsckUsage)
+	}
+
+	report, err := database.Fsck(ctx, *repair)
+	if err != nil {
+		return err
+	}
+	printOutput(out, fsckProblems(report), *asJSON)
+
+	if report.Problems() != 0 && !report.Repaired {
+		return fmt.Errorf("Found %v problems, run with -repair to fix them", report.Problems())
+	}
+
+	return nil
+}
+
+// every problem in report with what was done about it
+func fsckProblems(report internal.FsckReport) []problemRow {
+	var problems []problemRow = verifyProblems(report.VerifyReport)
+
+	for _, version := range report.StaleReservations {
+		problems = append(problems, problemRow{Problem: "stale reservation", Name: versionName(version), Detail: fmt.Sprintf("%v readers", version.Consumers)})
+	}
+	for _, version := range report.FailedUploads {
+		problems = append(problems, problemRow{Problem: "failed upload", Name: versionName(version)})
+	}
+	if !report.Repaired {
+		return problems
+	}
+
+	// what each kind of problem was repaired with
+	actions := map[string]string{
+		"version without file": "deleted row",
+		"stale reservation":    "released",
+		"failed upload":        "deleted",
+	}
+	for i, problem := range problems {
+		problems[i].Action = actions[problem.Problem]
+	}
+	for i, version := range report.Truncated {
+		problems[len(report.RowsWithoutFiles)+i].Action = "quarantined as " + report.Quarantined[version.Path()]
+	}
+	for i, name := range report.FilesWithoutRows {
+		problems[len(report.RowsWithoutFiles)+len(report.Truncated)+i].Action = "quarantined as " + report.Quarantined[name]
+	}
+
+	return problems
+}
@@ -1,25 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"path/filepath"
-	//"net"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	//"reflect"
-	"sync"
 	//"time"
-	//"errors"
 	//"strings"
 	_ "database/sql"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/moretiles/tftpcpd/internal"
 )
 
-// setup configuration using commandline arguments
+// setup configuration using commandline arguments, also returning the command and its arguments when one is named
 // no error returned because we exit early if there is a problem
-func processFlags() {
+func processFlags() (internal.Config, []string) {
+	var cfg internal.Config
+
 	// Set flag.Usage to change default help message
 	oldFlagUsageFunction := flag.Usage
 	flag.Usage = func() { helpMessage(oldFlagUsageFunction) }
@@ -27,6 +29,8 @@ func processFlags() {
 	// behavior
 	var debug *bool = flag.Bool("debug", false, "enable debug mode")
 	var help *bool = flag.Bool("help", false, "print usage information")
+	var retries *int = flag.Int("retries", 5, "number of times to resend a message when the other side does not respond")
+	var backoff *float64 = flag.Float64("backoff", 2, "multiply the time waited for a response by this after every resend")
 
 	// files
 	var directory *string = flag.String("directory", ".", "root directory of server")
@@ -34,6 +38,21 @@ func processFlags() {
 	var normalLogFile *string = flag.String("normal-log", "", "log file")
 	var debugLogFile *string = flag.String("debug-log", "", "debug log file")
 	var errorLogFile *string = flag.String("error-log", "", "error log file")
+	var watch *bool = flag.Bool("watch", false, "serve files copied or renamed into the root directory while running, Linux only")
+	var importFiles *bool = flag.Bool("import", false, "serve files already in the root directory when starting by hard linking them in as versions")
+	flag.Func("retain", "keep out of date versions of files matching a pattern as pattern=count or pattern=duration or both like '*.img=3,72h', may be repeated and the first match applies", func(text string) error {
+		rule, err := internal.ParseRetentionRule(text)
+		if err == nil {
+			cfg.Retention = append(cfg.Retention, rule)
+		}
+		return err
+	})
+	var plainDirectory *bool = flag.Bool("plain-directory", false, "serve and write files under their real names in the root directory without a sqlite database, keeping only the newest version")
+	var createDirectories *bool = flag.Bool("create-directories", false, "create missing directories for uploads instead of refusing them")
+	var fsck *string = flag.String("fsck", "", "check the sqlite database against the root directory before serving and log what is wrong, repair to also fix it")
+
+	// multicast
+	var multicast *string = flag.String("multicast", "", "first group address:port used for RFC 2090 multicast transfers, empty to refuse multicast")
 
 	flag.Parse()
 
@@ -47,29 +66,63 @@ func processFlags() {
 		fmt.Fprintln(os.Stderr, internal.NewErrorEvent("CONFIG", fmt.Sprintf("Unable to open root directory as absolute path: %v ", *directory)))
 		os.Exit(1)
 	}
-	internal.Cfg.Directory, err = os.OpenRoot(absoluteDirectory)
+	cfg.Directory, err = os.OpenRoot(absoluteDirectory)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, internal.NewErrorEvent("CONFIG", fmt.Sprintf("Unable to open root directory: %v", absoluteDirectory)))
 		os.Exit(1)
 	}
-	internal.Log <- internal.NewNormalEvent("CONFIG", fmt.Sprintf("Ready to serve as root directory: %v", absoluteDirectory))
 
-	internal.Cfg.Debug = *debug
-	internal.Cfg.Sqlite3DBPath = *sqlite3DBPath
-	internal.Cfg.NormalLogFile = *normalLogFile
-	internal.Cfg.DebugLogFile = *debugLogFile
-	internal.Cfg.ErrorLogFile = *errorLogFile
+	cfg.Debug = *debug
+	cfg.Retries = *retries
+	cfg.Backoff = *backoff
+	cfg.Sqlite3DBPath = *sqlite3DBPath
+	cfg.NormalLogFile = *normalLogFile
+	cfg.DebugLogFile = *debugLogFile
+	cfg.ErrorLogFile = *errorLogFile
+	cfg.Watch = *watch
+	cfg.Import = *importFiles
+	cfg.PlainDirectory = *plainDirectory
+	cfg.CreateDirectories = *createDirectories
+	if cfg.PlainDirectory && cfg.Watch {
+		fmt.Fprintln(os.Stderr, internal.NewErrorEvent("CONFIG", "Files in a plain directory are served as they are, there is nothing to watch"))
+		os.Exit(1)
+	}
+	if cfg.PlainDirectory && cfg.Import {
+		fmt.Fprintln(os.Stderr, internal.NewErrorEvent("CONFIG", "Files in a plain directory are served as they are, there is nothing to import"))
+		os.Exit(1)
+	}
+	if *fsck != "" && *fsck != internal.FsckCheck && *fsck != internal.FsckRepair {
+		fmt.Fprintln(os.Stderr, internal.NewErrorEvent("CONFIG", fmt.Sprintf("-fsck is neither %v nor %v: %v", internal.FsckCheck, internal.FsckRepair, *fsck)))
+		os.Exit(1)
+	}
+	cfg.Fsck = *fsck
+	if *multicast != "" {
+		group, err := net.ResolveUDPAddr("udp", *multicast)
+		if err != nil || !group.IP.IsMulticast() {
+			fmt.Fprintln(os.Stderr, internal.NewErrorEvent("CONFIG", fmt.Sprintf("Not a multicast group address: %v", *multicast)))
+			os.Exit(1)
+		}
+	}
+	cfg.MulticastAddress = *multicast
 
 	args := flag.Args()
 
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			return cfg, args
+		}
+	}
+
 	if len(args) == 0 {
-		internal.Cfg.Address = "127.0.0.1:8173"
+		cfg.Address = "127.0.0.1:8173"
 	} else if len(args) == 1 {
-		internal.Cfg.Address = args[0]
+		cfg.Address = args[0]
 	} else {
 		flag.Usage()
 		os.Exit(1)
 	}
+
+	return cfg, nil
 }
 
 func helpMessage(body func()) {
@@ -81,6 +134,9 @@ func helpMessage(body func()) {
 	fmt.Printf("v%v.%v.%v\n", major, minor, patch)
 	fmt.Println("Usage:")
 	fmt.Println("tftpcpd [options] hostname[:port]")
+	for _, usage := range commandUsages() {
+		fmt.Printf("tftpcpd [options] %v\n", usage)
+	}
 	fmt.Println("")
 	body()
 	fmt.Println("")
@@ -88,158 +144,41 @@ func helpMessage(body func()) {
 	fmt.Println("")
 }
 
-func init() {
-	internal.Cfg.Testing = flag.Bool("testing", false, "Used to control special behavior required for running tests.")
-}
-
 func main() {
-	var (
-		loggerParentToChild   chan internal.Signal = make(chan internal.Signal, 2)
-		loggerChildToParent   chan internal.Signal = make(chan internal.Signal, 2)
-		serverParentToChild   chan internal.Signal = make(chan internal.Signal, 2)
-		serverChildToParent   chan internal.Signal = make(chan internal.Signal, 2)
-		databaseParentToChild chan internal.Signal = make(chan internal.Signal, 2)
-		databaseChildToParent chan internal.Signal = make(chan internal.Signal, 2)
-		interruptHandler      chan os.Signal       = make(chan os.Signal, 2)
-		wg                    sync.WaitGroup
-		exitCode              int
-	)
-
-	//locals
-	defer close(loggerParentToChild)
-	defer close(loggerChildToParent)
-	defer close(serverParentToChild)
-	defer close(serverChildToParent)
-	defer close(databaseParentToChild)
-	defer close(databaseChildToParent)
-	defer close(interruptHandler)
-
-	processFlags()
-	if internal.LoggerInit() != nil {
-		os.Exit(2)
+	var exitCode int
+
+	cfg, command := processFlags()
+	if command != nil {
+		exitCode = runCommand(cfg, command, os.Stdout)
+		cfg.Directory.Close()
+		os.Exit(exitCode)
 	}
-	if internal.DatabaseInit() != nil {
+
+	server, err := internal.NewServer(cfg)
+	if err != nil {
 		os.Exit(3)
 	}
-	if internal.ServerInit() != nil {
-		os.Exit(4)
-	}
-	// inform user how to exit and start goroutines
-	{
-		// It is a near-certainty this messagw will appear before any logs
-		// good enough!
-		fmt.Println("Press Control-C (^C) to exit!")
-
-		// server routine handles actual tftp connections made by clients
-		wg.Go(func() {
-			internal.ServerRoutine(serverChildToParent, serverParentToChild)
-		})
-
-		// logger routine collects logs
-		wg.Go(func() {
-			internal.LoggerRoutine(loggerChildToParent, loggerParentToChild)
-		})
-
-		// database routine cleans up database and files periodically
-		wg.Go(func() {
-			internal.DatabaseRoutine(databaseChildToParent, databaseParentToChild)
-		})
-	}
+	server.Log <- internal.NewNormalEvent("CONFIG", fmt.Sprintf("Ready to serve as root directory: %v", cfg.Directory.Name()))
 
-	// handle child goroutines terminating and signals
-	{
-		exitCode = 0
-		signal.Notify(interruptHandler, os.Interrupt)
-		select {
-		case <-interruptHandler:
-			serverParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-			<-serverChildToParent
-			databaseParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-			<-databaseChildToParent
-			close(internal.Log)
-			loggerParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-			<-loggerChildToParent
-
-			// do not modify exit code because this is the expected termination method
-		case sig := <-loggerChildToParent:
-			if sig.IsResponse() {
-				// impossible
-				panic("AHHHHHHHHHHHHHHHHHHH!")
-			}
-
-			if sig.Kind == internal.SignalRestart {
-				loggerParentToChild <- internal.NewSignal(internal.SignalRestart, internal.SignalAccept)
-			} else if sig.Kind == internal.SignalTerminate {
-				serverParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-				<-serverChildToParent
-				databaseParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-				<-databaseChildToParent
-				close(internal.Log)
-				loggerParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalAccept)
-			} else {
-				// impossible
-				panic("AHHHHHHHHHHHHHHHHHHH!")
-			}
-
-			exitCode = 11
-
-		case sig := <-serverChildToParent:
-			if sig.IsResponse() {
-				// impossible
-				panic("AHHHHHHHHHHHHHHHHHHH!")
-			}
-
-			if sig.Kind == internal.SignalTerminate {
-				serverParentToChild <- internal.NewSignal(sig.Kind, internal.SignalAccept)
-				databaseParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-				<-databaseChildToParent
-				close(internal.Log)
-				loggerParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-				<-loggerChildToParent
-			} else {
-				// impossible
-				panic("AHHHHHHHHHHHHHHHHHHH!")
-			}
-
-			exitCode = 12
-
-		case sig := <-databaseChildToParent:
-			if sig.IsResponse() {
-				// impossible
-				panic("AHHHHHHHHHHHHHHHHHHH!")
-			}
-
-			if sig.Kind == internal.SignalTerminate {
-				serverParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-				<-serverChildToParent
-				databaseParentToChild <- internal.NewSignal(sig.Kind, internal.SignalAccept)
-				close(internal.Log)
-				loggerParentToChild <- internal.NewSignal(internal.SignalTerminate, internal.SignalRequest)
-				<-loggerChildToParent
-			} else {
-				// impossible
-				panic("AHHHHHHHHHHHHHHHHHHH!")
-			}
-
-			// Make sure we respond to demands to termiante correctly
-			//case <- time.After(1 * time.Second):
-			//fmt.Println("Time to exit server")
-			//serverParentToChild <- NewSignal(SignalTerminate, SignalRequest)
-			//<- serverChildToParent
-			//fmt.Println("Time to exit logger")
-			//loggerParentToChild <- NewSignal(SignalTerminate, SignalRequest)
-			//<- loggerChildToParent
-			//fmt.Println("All exited")
-		}
+	// inform user how to exit and serve until interrupted
+	fmt.Println("Press Control-C (^C) to exit!")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err = server.Serve(ctx)
+	stop()
+
+	// do not modify exit code when interrupted because this is the expected termination method
+	if err != nil && !errors.Is(err, context.Canceled) {
+		exitCode = 12
 	}
 
-	// wait for all goroutines to finished
-	wg.Wait()
+	// sessions were already cancelled, this only closes the database and logger
+	server.Shutdown(context.Background())
 
 	//Using defer with os.Root.Close() causes panic
 	//Possible bug considering os.Root is still very new?!?
 	//Either way, no panic this way.
-	internal.Cfg.Directory.Close()
+	cfg.Directory.Close()
 
 	// Exit using code we set
 	os.Exit(exitCode)
@@ -1,17 +1,21 @@
 package internal
 
 import (
+	"bytes"
 	"errors"
-	"io"
-	"path/filepath"
-	"slices"
+	"fmt"
 	"strings"
 )
 
 var ErrUnknownOpcode = errors.New("Unknown opcode found when decoding message")
-var ErrUnknownMessage = errors.New("Unknown message type used to encode message")
+var ErrNullInString = errors.New("Null byte found inside string being encoded")
+var ErrEmptyString = errors.New("Required string is empty")
 var ErrShortMessage = errors.New("Impossibly short message received")
 var ErrUnterminatedNullString = errors.New("Null byte not found")
+var ErrMissingOptionValue = errors.New("Option name not followed by a value")
+var ErrDuplicateOption = errors.New("Option given more than once")
+var ErrNoOptions = errors.New("Option acknowledgement without options")
+var ErrTrailingBytes = errors.New("Unexpected bytes after end of message")
 
 const (
 	OpcodeInvalid = iota
@@ -23,6 +27,19 @@ const (
 	OpcodeOptionAcknowledgeByte
 )
 
+/*
+ * Every TFTP message knows its opcode and how to convert itself to and from bytes.
+ * AppendBinary writes the whole message, opcode included, to the end of buf.
+ * It only allocates when buf lacks the capacity to hold the message.
+ * UnmarshalBinary expects the whole message, opcode included.
+ */
+type Message interface {
+	Opcode() uint16
+	AppendBinary(buf []byte) ([]byte, error)
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(buf []byte) error
+}
+
 const (
 	ErrorCodeUndefined = iota
 	ErrorCodeNoSuchFile
@@ -49,7 +66,6 @@ type ReadMessage struct {
 }
 
 func NewReadMessage(filename string, mode string, options map[string]string) ReadMessage {
-	_, filename = filepath.Split(filename)
 	return ReadMessage{filename, mode, options}
 }
 
@@ -67,7 +83,6 @@ type WriteMessage struct {
 }
 
 func NewWriteMessage(filename string, mode string, options map[string]string) WriteMessage {
-	_, filename = filepath.Split(filename)
 	return WriteMessage{filename, mode, options}
 }
 
@@ -127,354 +142,520 @@ func NewOptionAcknowledgeMessage(options map[string]string) OptionAcknowledgeMes
 	return OptionAcknowledgeMessage{options}
 }
 
-func MessageAsBytes(message any, buf *[]byte) error {
-	switch message.(type) {
-	case ReadMessage:
-		readMessageAsBytes(message.(ReadMessage), buf)
-	case WriteMessage:
-		writeMessageAsBytes(message.(WriteMessage), buf)
-	case DataMessage:
-		dataMessageAsBytes(message.(DataMessage), buf)
-	case AcknowledgeMessage:
-		acknowledgeMessageAsBytes(message.(AcknowledgeMessage), buf)
-	case ErrorMessage:
-		errorMessageAsBytes(message.(ErrorMessage), buf)
-	case OptionAcknowledgeMessage:
-		optionAcknowledgeMessageAsBytes(message.(OptionAcknowledgeMessage), buf)
-	default:
-		return ErrUnknownMessage
-	}
+func (message ReadMessage) Opcode() uint16 {
+	return OpcodeReadByte
+}
 
-	return nil
+func (message ReadMessage) AppendBinary(buf []byte) ([]byte, error) {
+	return appendRequest(buf, OpcodeReadByte, message.Filename, message.Mode, message.Options)
 }
 
-func popNullString(buf *[]byte) (string, error) {
-	nullBytePos := slices.Index(*buf, 0)
-	if nullBytePos < 0 || nullBytePos >= len(*buf) {
-		return "", ErrUnterminatedNullString
-	}
-	nullString := string((*buf)[:nullBytePos])
-	if nullBytePos+1 >= len(*buf) {
-		*buf = (*buf)[:0]
-		return nullString, io.EOF
+func (message ReadMessage) MarshalBinary() ([]byte, error) {
+	return message.AppendBinary(nil)
+}
+
+func (message *ReadMessage) UnmarshalBinary(buf []byte) error {
+	body, err := popOpcode(buf, OpcodeReadByte)
+	if err != nil {
+		return err
 	}
-	*buf = (*buf)[nullBytePos+1:]
 
-	return nullString, nil
+	*message, err = bytesAsReadMessage(body)
+	return err
 }
 
-func readMessageAsBytes(message ReadMessage, buf *[]byte) error {
-	// zero out length, keep capacity
-	*buf = (*buf)[:0]
-
-	// append opcode
-	*buf = append(*buf, 0, OpcodeReadByte)
+func (message WriteMessage) Opcode() uint16 {
+	return OpcodeWriteByte
+}
 
-	// append filename
-	*buf = append(*buf, []byte(message.Filename+"\x00")...)
+func (message WriteMessage) AppendBinary(buf []byte) ([]byte, error) {
+	return appendRequest(buf, OpcodeWriteByte, message.Filename, message.Mode, message.Options)
+}
 
-	// append mode
-	*buf = append(*buf, []byte(message.Mode+"\x00")...)
+func (message WriteMessage) MarshalBinary() ([]byte, error) {
+	return message.AppendBinary(nil)
+}
 
-	// append options (if any)
-	for k, v := range message.Options {
-		*buf = append(*buf, []byte(strings.ToLower(k)+"\x00"+v+"\x00")...)
+func (message *WriteMessage) UnmarshalBinary(buf []byte) error {
+	body, err := popOpcode(buf, OpcodeWriteByte)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	*message, err = bytesAsWriteMessage(body)
+	return err
 }
 
-func writeMessageAsBytes(message WriteMessage, buf *[]byte) error {
-	// zero out length, keep capacity
-	*buf = (*buf)[:0]
+func (message DataMessage) Opcode() uint16 {
+	return OpcodeDataByte
+}
 
+func (message DataMessage) AppendBinary(buf []byte) ([]byte, error) {
 	// append opcode
-	*buf = append(*buf, 0, OpcodeWriteByte)
+	buf = append(buf, 0, OpcodeDataByte)
 
-	// append filename
-	*buf = append(*buf, []byte(message.Filename+"\x00")...)
+	// append block number as big endian uint16
+	buf = append(buf, byte(message.BlockNumber>>8), byte(message.BlockNumber))
 
-	// append mode
-	*buf = append(*buf, []byte(message.Mode+"\x00")...)
+	// append data itself
+	buf = append(buf, message.Body...)
 
-	// append options (if any)
-	for k, v := range message.Options {
-		*buf = append(*buf, []byte(strings.ToLower(k)+"\x00"+v+"\x00")...)
+	return buf, nil
+}
+
+func (message DataMessage) MarshalBinary() ([]byte, error) {
+	return message.AppendBinary(make([]byte, 0, DataPreambleLength+len(message.Body)))
+}
+
+func (message *DataMessage) UnmarshalBinary(buf []byte) error {
+	body, err := popOpcode(buf, OpcodeDataByte)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	*message, err = bytesAsDataMessage(body)
+	return err
 }
 
-func dataMessageAsBytes(message DataMessage, buf *[]byte) error {
-	// zero out length, keep capacity
-	*buf = (*buf)[:0]
+func (message AcknowledgeMessage) Opcode() uint16 {
+	return OpcodeAcknowledgeByte
+}
 
+func (message AcknowledgeMessage) AppendBinary(buf []byte) ([]byte, error) {
 	// append opcode
-	*buf = append(*buf, 0, OpcodeDataByte)
+	buf = append(buf, 0, OpcodeAcknowledgeByte)
 
 	// append block number as big endian uint16
-	*buf = append(*buf, byte(message.BlockNumber>>8), byte(message.BlockNumber))
-
-	// append data itself
-	*buf = append(*buf, message.Body...)
+	buf = append(buf, byte(message.BlockNumber>>8), byte(message.BlockNumber))
 
-	return nil
+	return buf, nil
 }
 
-func acknowledgeMessageAsBytes(message AcknowledgeMessage, buf *[]byte) error {
-	// zero out length, keep capacity
-	*buf = (*buf)[:0]
-
-	// append opcode
-	*buf = append(*buf, 0, OpcodeAcknowledgeByte)
+func (message AcknowledgeMessage) MarshalBinary() ([]byte, error) {
+	return message.AppendBinary(make([]byte, 0, 4))
+}
 
-	// append block number as big endian uint16
-	*buf = append(*buf, byte(message.BlockNumber>>8), byte(message.BlockNumber))
+func (message *AcknowledgeMessage) UnmarshalBinary(buf []byte) error {
+	body, err := popOpcode(buf, OpcodeAcknowledgeByte)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	*message, err = bytesAsAcknowledgeMessage(body)
+	return err
 }
 
-func errorMessageAsBytes(message ErrorMessage, buf *[]byte) error {
-	// zero out length, keep capacity
-	*buf = (*buf)[:0]
+func (message ErrorMessage) Opcode() uint16 {
+	return OpcodeErrorByte
+}
 
+func (message ErrorMessage) AppendBinary(buf []byte) ([]byte, error) {
 	// append opcode
-	*buf = append(*buf, 0, OpcodeErrorByte)
+	buf = append(buf, 0, OpcodeErrorByte)
 
 	// append error code as big endian uint16
-	*buf = append(*buf, byte(message.ErrorCode>>8), byte(message.ErrorCode))
+	buf = append(buf, byte(message.ErrorCode>>8), byte(message.ErrorCode))
 
 	// append human readable explanation
-	*buf = append(*buf, message.Explanation...)
-	*buf = append(*buf, '\x00')
+	return appendNullString(buf, message.Explanation)
+}
 
-	return nil
+func (message ErrorMessage) MarshalBinary() ([]byte, error) {
+	return message.AppendBinary(nil)
+}
+
+func (message *ErrorMessage) UnmarshalBinary(buf []byte) error {
+	body, err := popOpcode(buf, OpcodeErrorByte)
+	if err != nil {
+		return err
+	}
+
+	*message, err = bytesAsErrorMessage(body)
+	return err
 }
 
-func optionAcknowledgeMessageAsBytes(message OptionAcknowledgeMessage, buf *[]byte) error {
-	// zero out length, keep capacity
-	*buf = (*buf)[:0]
+func (message OptionAcknowledgeMessage) Opcode() uint16 {
+	return OpcodeOptionAcknowledgeByte
+}
 
-	//append opcode
-	*buf = append(*buf, 0, OpcodeOptionAcknowledgeByte)
+func (message OptionAcknowledgeMessage) AppendBinary(buf []byte) ([]byte, error) {
+	// append opcode
+	buf = append(buf, 0, OpcodeOptionAcknowledgeByte)
 
 	// append options (if any)
-	for k, v := range message.Options {
-		*buf = append(*buf, []byte(strings.ToLower(k)+"\x00"+v+"\x00")...)
+	return appendOptions(buf, message.Options)
+}
+
+func (message OptionAcknowledgeMessage) MarshalBinary() ([]byte, error) {
+	return message.AppendBinary(nil)
+}
+
+func (message *OptionAcknowledgeMessage) UnmarshalBinary(buf []byte) error {
+	body, err := popOpcode(buf, OpcodeOptionAcknowledgeByte)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	*message, err = bytesAsOptionAcknowledgeMessage(body)
+	return err
 }
 
-func BytesAsMessage(buf []byte) (any, error) {
-	var message any
-	var opcode byte
+// read and write messages only differ by opcode
+func appendRequest(buf []byte, opcode byte, filename string, mode string, options map[string]string) ([]byte, error) {
 	var err error
 
-	if len(buf) < 2 {
-		return nil, ErrShortMessage
+	if filename == "" || mode == "" {
+		return buf, ErrEmptyString
 	}
 
-	// leading byte of opcode is always 0x00
-	if buf[0] != 0 {
-		return nil, ErrUnknownOpcode
+	// append opcode
+	buf = append(buf, 0, opcode)
+
+	// append filename
+	if buf, err = appendNullString(buf, filename); err != nil {
+		return buf, err
 	}
 
-	// 2nd byte of opcode is what determines message types
-	opcode = buf[1]
-	buf = buf[2:]
+	// append mode
+	if buf, err = appendNullString(buf, mode); err != nil {
+		return buf, err
+	}
+
+	// append options (if any)
+	return appendOptions(buf, options)
+}
+
+func appendNullString(buf []byte, value string) ([]byte, error) {
+	if strings.IndexByte(value, 0) >= 0 {
+		return buf, ErrNullInString
+	}
+
+	buf = append(buf, value...)
+	return append(buf, 0), nil
+}
+
+// options are appended sorted by key so the same options always produce the same bytes
+// sorting is done by repeatedly finding the next key rather than by allocating a slice of keys
+func appendOptions(buf []byte, options map[string]string) ([]byte, error) {
+	var previous string
+	var err error
+
+	for i := 0; i < len(options); i++ {
+		var key string
+		var found bool = false
+
+		for candidate := range options {
+			if (i == 0 || candidate > previous) && (!found || candidate < key) {
+				key, found = candidate, true
+			}
+		}
+
+		if key == "" {
+			return buf, ErrEmptyString
+		}
+		if buf, err = appendNullString(buf, strings.ToLower(key)); err != nil {
+			return buf, err
+		}
+		if buf, err = appendNullString(buf, options[key]); err != nil {
+			return buf, err
+		}
+		previous = key
+	}
+
+	return buf, nil
+}
+
+/*
+ * Returned when bytes received do not form a valid message.
+ * Err is one of the decoding errors above, compare against it with errors.Is.
+ * Offset counts bytes from the start of the message, opcode included, to where the problem was found.
+ * Malformed messages are illegal TFTP operations so they are reported with that error code.
+ */
+type DecodeError struct {
+	Opcode uint16
+	Offset int
+	Err    error
+}
+
+func (err *DecodeError) Error() string {
+	return fmt.Sprintf("Malformed %v at byte %v: %v", opcodeName(err.Opcode), err.Offset, err.Err)
+}
+
+func (err *DecodeError) Unwrap() []error {
+	return []error{err.Err, ErrIllegalOperation}
+}
+
+func opcodeName(opcode uint16) string {
 	switch opcode {
 	case OpcodeReadByte:
-		message, err = bytesAsReadMessage(buf)
-		if err != nil {
-			return nil, err
-		}
+		return "read request"
 	case OpcodeWriteByte:
-		message, err = bytesAsWriteMessage(buf)
-		if err != nil {
-			return nil, err
-		}
+		return "write request"
 	case OpcodeDataByte:
-		message, err = bytesAsDataMessage(buf)
-		if err != nil {
-			return nil, err
-		}
+		return "data message"
 	case OpcodeAcknowledgeByte:
-		message, err = bytesAsAcknowledgeMessage(buf)
-		if err != nil {
-			return nil, err
-		}
+		return "acknowledgement"
 	case OpcodeErrorByte:
-		message, err = bytesAsErrorMessage(buf)
+		return "error message"
+	case OpcodeOptionAcknowledgeByte:
+		return "option acknowledgement"
+	default:
+		return fmt.Sprintf("message with opcode %v", opcode)
+	}
+}
+
+// reads the body of a message front to back, remembering how far it got so errors can say where they happened
+type decoder struct {
+	opcode uint16
+	buf    []byte
+	offset int
+}
+
+// decoder for the body of a message, the opcode has already been read
+func newDecoder(opcode uint16, body []byte) decoder {
+	return decoder{opcode, body, 2}
+}
+
+func (d *decoder) fail(offset int, err error) error {
+	return &DecodeError{d.opcode, offset, err}
+}
+
+// read a big endian uint16
+func (d *decoder) uint16() (uint16, error) {
+	if len(d.buf) < 2 {
+		return 0, d.fail(d.offset, ErrShortMessage)
+	}
+
+	value := uint16(d.buf[0])<<8 | uint16(d.buf[1])
+	d.buf = d.buf[2:]
+	d.offset += 2
+
+	return value, nil
+}
+
+// read a null terminated string, the null byte is consumed but not returned
+func (d *decoder) nullString() (string, error) {
+	nullBytePos := bytes.IndexByte(d.buf, 0)
+	if nullBytePos < 0 {
+		return "", d.fail(d.offset+len(d.buf), ErrUnterminatedNullString)
+	}
+
+	value := string(d.buf[:nullBytePos])
+	d.buf = d.buf[nullBytePos+1:]
+	d.offset += nullBytePos + 1
+
+	return value, nil
+}
+
+// read a null terminated string that must contain at least one byte
+func (d *decoder) requiredString() (string, error) {
+	start := d.offset
+
+	value, err := d.nullString()
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", d.fail(start, ErrEmptyString)
+	}
+
+	return value, nil
+}
+
+// read key value pairs until the end of the message as described by RFC 2347
+// option names are case insensitive so they are lowercased, the same name given twice is an error
+// values may be empty, RFC 2090 requests multicast with an empty value
+func (d *decoder) options() (map[string]string, error) {
+	var options map[string]string = make(map[string]string)
+
+	for len(d.buf) > 0 {
+		start := d.offset
+
+		key, err := d.requiredString()
 		if err != nil {
 			return nil, err
 		}
-	case OpcodeOptionAcknowledgeByte:
-		message, err = bytesAsOptionAcknowledgeMessage(buf)
+		key = strings.ToLower(key)
+
+		if len(d.buf) == 0 {
+			return nil, d.fail(d.offset, ErrMissingOptionValue)
+		}
+		val, err := d.nullString()
 		if err != nil {
 			return nil, err
 		}
-	default:
-		return nil, ErrUnknownOpcode
+
+		if _, exists := options[key]; exists {
+			return nil, d.fail(start, ErrDuplicateOption)
+		}
+		options[key] = val
 	}
 
-	return message, nil
+	return options, nil
 }
 
-func bytesAsReadMessage(buf []byte) (ReadMessage, error) {
-	var filename string
-	var mode string
-	var options map[string]string
+// everything in the message must have been read
+func (d *decoder) end() error {
+	if len(d.buf) > 0 {
+		return d.fail(d.offset, ErrTrailingBytes)
+	}
 
-	minPossibleLen := 1 + 1 + 5 + 1
+	return nil
+}
 
-	if len(buf) < minPossibleLen {
-		return ReadMessage{}, ErrShortMessage
+// check that buf begins with opcode and return what follows it
+func popOpcode(buf []byte, opcode byte) ([]byte, error) {
+	if len(buf) < 2 {
+		return nil, &DecodeError{OpcodeInvalid, 0, ErrShortMessage}
+	}
+	if buf[0] != 0 || buf[1] != opcode {
+		return nil, &DecodeError{uint16(buf[0])<<8 | uint16(buf[1]), 0, ErrUnknownOpcode}
 	}
 
-	filename, err := popNullString(&buf)
-	if err != nil {
-		return ReadMessage{}, errors.Join(err, ErrUnterminatedNullString)
+	return buf[2:], nil
+}
+
+func BytesAsMessage(buf []byte) (Message, error) {
+	var message Message
+
+	if len(buf) < 2 {
+		return nil, &DecodeError{OpcodeInvalid, 0, ErrShortMessage}
 	}
 
-	mode, err = popNullString(&buf)
-	mode = strings.ToLower(mode)
-	// Only process options if they exist
-	if errors.Is(err, io.EOF) {
-		return NewReadMessage(filename, mode, options), nil
-	} else if err != nil {
-		return ReadMessage{}, errors.Join(err, ErrUnterminatedNullString)
+	// leading byte of opcode is always 0x00
+	if buf[0] != 0 {
+		return nil, &DecodeError{uint16(buf[0])<<8 | uint16(buf[1]), 0, ErrUnknownOpcode}
 	}
 
-	options, err = bytesAsOptionMap(buf)
-	if err != nil {
-		return ReadMessage{}, err
+	// 2nd byte of opcode is what determines message types
+	switch buf[1] {
+	case OpcodeReadByte:
+		message = &ReadMessage{}
+	case OpcodeWriteByte:
+		message = &WriteMessage{}
+	case OpcodeDataByte:
+		message = &DataMessage{}
+	case OpcodeAcknowledgeByte:
+		message = &AcknowledgeMessage{}
+	case OpcodeErrorByte:
+		message = &ErrorMessage{}
+	case OpcodeOptionAcknowledgeByte:
+		message = &OptionAcknowledgeMessage{}
+	default:
+		return nil, &DecodeError{uint16(buf[1]), 0, ErrUnknownOpcode}
 	}
-	return NewReadMessage(filename, mode, options), nil
+
+	if err := message.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+
+	return message, nil
 }
 
-func bytesAsWriteMessage(buf []byte) (WriteMessage, error) {
-	var filename string
-	var mode string
+// read and write requests share a layout, filename and mode are both required
+func bytesAsRequest(opcode uint16, buf []byte) (string, string, map[string]string, error) {
 	var options map[string]string
+	d := newDecoder(opcode, buf)
 
-	minPossibleLen := 1 + 1 + 5 + 1
-
-	if len(buf) < minPossibleLen {
-		return WriteMessage{}, ErrShortMessage
+	// servers decide which filenames they accept, see cleanFilename
+	filename, err := d.requiredString()
+	if err != nil {
+		return "", "", nil, err
 	}
 
-	filename, err := popNullString(&buf)
+	mode, err := d.requiredString()
 	if err != nil {
-		return WriteMessage{}, errors.Join(err, ErrUnterminatedNullString)
+		return "", "", nil, err
 	}
-
-	mode, err = popNullString(&buf)
 	mode = strings.ToLower(mode)
-	if errors.Is(err, io.EOF) {
-		return NewWriteMessage(filename, mode, options), nil
-	} else if err != nil {
-		return WriteMessage{}, errors.Join(err, ErrUnterminatedNullString)
+
+	// only process options if they exist
+	if len(d.buf) > 0 {
+		options, err = d.options()
+		if err != nil {
+			return "", "", nil, err
+		}
 	}
 
-	options, err = bytesAsOptionMap(buf)
+	return filename, mode, options, nil
+}
+
+func bytesAsReadMessage(buf []byte) (ReadMessage, error) {
+	filename, mode, options, err := bytesAsRequest(OpcodeReadByte, buf)
+	if err != nil {
+		return ReadMessage{}, err
+	}
+
+	return NewReadMessage(filename, mode, options), nil
+}
+
+func bytesAsWriteMessage(buf []byte) (WriteMessage, error) {
+	filename, mode, options, err := bytesAsRequest(OpcodeWriteByte, buf)
 	if err != nil {
 		return WriteMessage{}, err
 	}
+
 	return NewWriteMessage(filename, mode, options), nil
 }
 
 func bytesAsDataMessage(buf []byte) (DataMessage, error) {
-	var blockNumber uint16
-	var data []byte
-
-	minPossibleLen := 2
+	d := newDecoder(OpcodeDataByte, buf)
 
-	if len(buf) < minPossibleLen {
-		return DataMessage{}, ErrShortMessage
-	}
-
-	blockNumber += uint16(buf[0]) << 8
-	blockNumber += uint16(buf[1])
-
-	if len(buf) >= 2 {
-		data = buf[2:]
+	blockNumber, err := d.uint16()
+	if err != nil {
+		return DataMessage{}, err
 	}
 
-	return NewDataMessage(blockNumber, data), nil
+	// the rest of the message is the data itself, possibly nothing at all
+	return NewDataMessage(blockNumber, d.buf), nil
 }
 
 func bytesAsAcknowledgeMessage(buf []byte) (AcknowledgeMessage, error) {
-	var blockNumber uint16
-
-	minPossibleLen := 2
+	d := newDecoder(OpcodeAcknowledgeByte, buf)
 
-	if len(buf) < minPossibleLen {
-		return AcknowledgeMessage{}, ErrShortMessage
+	blockNumber, err := d.uint16()
+	if err != nil {
+		return AcknowledgeMessage{}, err
+	}
+	if err = d.end(); err != nil {
+		return AcknowledgeMessage{}, err
 	}
-
-	blockNumber += uint16(buf[0]) << 8
-	blockNumber += uint16(buf[1])
 
 	return NewAcknowledgeMessage(blockNumber), nil
 }
 
 func bytesAsErrorMessage(buf []byte) (ErrorMessage, error) {
-	var errorCode uint16
-	var explanation string
+	d := newDecoder(OpcodeErrorByte, buf)
 
-	minPossibleLen := 1 + 1 + 5 + 1
-
-	if len(buf) < minPossibleLen {
-		return ErrorMessage{}, ErrShortMessage
+	errorCode, err := d.uint16()
+	if err != nil {
+		return ErrorMessage{}, err
 	}
 
-	errorCode += uint16(buf[0]) << 8
-	errorCode += uint16(buf[1])
-
-	buf = buf[2:]
-	explanation, err := popNullString(&buf)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return ErrorMessage{}, ErrUnterminatedNullString
+	// the explanation may be empty but must still be terminated
+	explanation, err := d.nullString()
+	if err != nil {
+		return ErrorMessage{}, err
+	}
+	if err = d.end(); err != nil {
+		return ErrorMessage{}, err
 	}
 
 	return NewErrorMessage(errorCode, explanation), nil
 }
 
 func bytesAsOptionAcknowledgeMessage(buf []byte) (OptionAcknowledgeMessage, error) {
-	var options map[string]string
-
-	minPossibleLen := 1 + 1 + 1 + 1
+	d := newDecoder(OpcodeOptionAcknowledgeByte, buf)
 
-	if len(buf) < minPossibleLen {
-		return OptionAcknowledgeMessage{}, ErrShortMessage
+	// servers that accept no options answer with data or an acknowledgement instead
+	if len(d.buf) == 0 {
+		return OptionAcknowledgeMessage{}, d.fail(d.offset, ErrNoOptions)
 	}
 
-	options, err := bytesAsOptionMap(buf)
+	options, err := d.options()
 	if err != nil {
 		return OptionAcknowledgeMessage{}, err
 	}
 
 	return NewOptionAcknowledgeMessage(options), nil
 }
-
-func bytesAsOptionMap(buf []byte) (map[string]string, error) {
-	var options map[string]string = make(map[string]string)
-
-	for len(buf) > 0 {
-		key, err := popNullString(&buf)
-		if err != nil {
-			return nil, errors.Join(err, ErrUnterminatedNullString)
-		}
-		key = strings.ToLower(key)
-
-		val, err := popNullString(&buf)
-		if err != nil && !errors.Is(err, io.EOF) {
-			return nil, errors.Join(err, ErrUnterminatedNullString)
-		}
-
-		options[key] = val
-	}
-
-	return options, nil
-}
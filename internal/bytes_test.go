@@ -2,11 +2,14 @@ package internal
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 )
 
-func TestReadMessageAsBytes(t *testing.T) {
+func TestReadMessageAppendBinary(t *testing.T) {
 	filename := "file"
 	mode := "octal"
 	options := make(map[string]string)
@@ -18,7 +21,7 @@ func TestReadMessageAsBytes(t *testing.T) {
 	buf := make([]byte, 0, 0xffff)
 	output := []byte{0, OpcodeReadByte, 'f', 'i', 'l', 'e', 0, 'o', 'c', 't', 'a', 'l', 0, 's', 'y', 'n', 't', 'a', 'x', 0, 'o', 'n', 0}
 
-	err := readMessageAsBytes(message, &buf)
+	buf, err := message.AppendBinary(buf)
 	if err != nil {
 		t.Fatalf("Some argument passed to tftpReadRequest is nil")
 	}
@@ -27,7 +30,7 @@ func TestReadMessageAsBytes(t *testing.T) {
 	}
 }
 
-func TestWriteMessageAsBytes(t *testing.T) {
+func TestWriteMessageAppendBinary(t *testing.T) {
 	filename := "file"
 	mode := "netascii"
 	options := make(map[string]string)
@@ -38,7 +41,7 @@ func TestWriteMessageAsBytes(t *testing.T) {
 
 	buf := make([]byte, 0, 0xffff)
 	output := []byte{0, OpcodeWriteByte, 'f', 'i', 'l', 'e', 0, 'n', 'e', 't', 'a', 's', 'c', 'i', 'i', 0, 's', 'y', 'n', 't', 'a', 'x', 0, 'o', 'n', 0}
-	err := writeMessageAsBytes(message, &buf)
+	buf, err := message.AppendBinary(buf)
 	if err != nil {
 		t.Fatalf("Some argument passed to tftpWriteRequest is nil")
 	}
@@ -47,7 +50,7 @@ func TestWriteMessageAsBytes(t *testing.T) {
 	}
 }
 
-func TestDataMessageAsBytes(t *testing.T) {
+func TestDataMessageAppendBinary(t *testing.T) {
 	var blockNumber uint16 = 0xabcd
 	data := []byte{5, 4, 3, 2, 1}
 	message := NewDataMessage(blockNumber, data)
@@ -55,7 +58,7 @@ func TestDataMessageAsBytes(t *testing.T) {
 	buf := make([]byte, 0, 0xffff)
 	output := []byte{0, OpcodeDataByte, byte(blockNumber >> 8), byte(blockNumber % 0x100)}
 	output = append(output, data...)
-	err := dataMessageAsBytes(message, &buf)
+	buf, err := message.AppendBinary(buf)
 	if err != nil {
 		t.Fatalf("Some argument passed to tftpDta is nil")
 	}
@@ -64,13 +67,13 @@ func TestDataMessageAsBytes(t *testing.T) {
 	}
 }
 
-func TestAcknowledgeMessageAsBytes(t *testing.T) {
+func TestAcknowledgeMessageAppendBinary(t *testing.T) {
 	var blockNumber uint16 = 0xabcd
 	message := NewAcknowledgeMessage(blockNumber)
 
 	buf := make([]byte, 0, 0xffff)
 	output := []byte{0, OpcodeAcknowledgeByte, byte(blockNumber >> 8), byte(blockNumber % 0x100)}
-	err := acknowledgeMessageAsBytes(message, &buf)
+	buf, err := message.AppendBinary(buf)
 	if err != nil {
 		t.Fatalf("Some argument passed to tftpAcknowledge is nil")
 	}
@@ -79,7 +82,7 @@ func TestAcknowledgeMessageAsBytes(t *testing.T) {
 	}
 }
 
-func TestErrorMessageAsBytes(t *testing.T) {
+func TestErrorMessageAppendBinary(t *testing.T) {
 	var errorCode uint16 = ErrorCodeUndefined
 	explanation := "among us"
 	message := NewErrorMessage(errorCode, explanation)
@@ -88,7 +91,7 @@ func TestErrorMessageAsBytes(t *testing.T) {
 	output := []byte{0, OpcodeErrorByte, 0, byte(errorCode)}
 	output = append(output, explanation...)
 	output = append(output, '\x00')
-	err := errorMessageAsBytes(message, &buf)
+	buf, err := message.AppendBinary(buf)
 	if err != nil {
 		t.Fatalf("Some argument passed to tftpAcknowledge is nil")
 	}
@@ -97,7 +100,7 @@ func TestErrorMessageAsBytes(t *testing.T) {
 	}
 }
 
-func TestOptionAcknowledgeMessageAsBytes(t *testing.T) {
+func TestOptionAcknowledgeMessageAppendBinary(t *testing.T) {
 	options := make(map[string]string)
 	key1 := "syntax"
 	val1 := "on"
@@ -108,7 +111,7 @@ func TestOptionAcknowledgeMessageAsBytes(t *testing.T) {
 	output := []byte{0, OpcodeOptionAcknowledgeByte}
 	output = append(output, []byte(key1+"\x00")...)
 	output = append(output, []byte(val1+"\x00")...)
-	err := optionAcknowledgeMessageAsBytes(message, &buf)
+	buf, err := message.AppendBinary(buf)
 	if err != nil {
 		t.Fatalf("Some argument passed to tftpAcknowledge is nil")
 	}
@@ -247,3 +250,288 @@ func TestBytesAsOptionAcknowledgeMessage(t *testing.T) {
 		t.Fatalf("expected optionAcknowledgeMessage{%v} != message optionAcknowlegeMessage{%v}\n", expected.Options, message.Options)
 	}
 }
+
+func TestAppendOptionsSorted(t *testing.T) {
+	options := map[string]string{"windowsize": "4", "blksize": "1024", "tsize": "0", "timeout": "3"}
+	output := []byte{0, OpcodeOptionAcknowledgeByte}
+	output = append(output, "blksize\x001024\x00timeout\x003\x00tsize\x000\x00windowsize\x004\x00"...)
+
+	for i := 0; i < 10; i++ {
+		buf, err := NewOptionAcknowledgeMessage(options).MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v\n", err)
+		}
+		if !bytes.Equal(output, buf) {
+			t.Fatalf("%q != %q\n", output, buf)
+		}
+	}
+}
+
+func TestAppendBinaryRejectsNull(t *testing.T) {
+	if _, err := NewErrorMessage(ErrorCodeUndefined, "bad\x00explanation").MarshalBinary(); !errors.Is(err, ErrNullInString) {
+		t.Fatalf("%v != %v\n", err, ErrNullInString)
+	}
+	if _, err := NewReadMessage("file", ModeOctet, map[string]string{"key\x00": "value"}).MarshalBinary(); !errors.Is(err, ErrNullInString) {
+		t.Fatalf("%v != %v\n", err, ErrNullInString)
+	}
+}
+
+func TestDataMessageAppendBinaryDoesNotAllocate(t *testing.T) {
+	body := make([]byte, 512)
+	buf := make([]byte, 0, DataPreambleLength+len(body))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = NewDataMessage(1, body).AppendBinary(buf[:0])
+	})
+	if allocs != 0 {
+		t.Fatalf("AppendBinary allocated %v times\n", allocs)
+	}
+}
+
+func TestBytesAsMessageRoundTrip(t *testing.T) {
+	messages := []Message{
+		&ReadMessage{"file", ModeOctet, map[string]string{"blksize": "1024"}},
+		&WriteMessage{"file", ModeNetascii, nil},
+		&DataMessage{7, []byte{1, 2, 3}},
+		&AcknowledgeMessage{7},
+		&ErrorMessage{ErrorCodeNoSuchFile, "File not found"},
+		&OptionAcknowledgeMessage{map[string]string{"tsize": "42"}},
+	}
+
+	for _, expected := range messages {
+		buf, err := expected.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v\n", err)
+		}
+		if binary.BigEndian.Uint16(buf) != expected.Opcode() {
+			t.Fatalf("%v does not start with opcode %v\n", buf, expected.Opcode())
+		}
+
+		message, err := BytesAsMessage(buf)
+		if err != nil {
+			t.Fatalf("BytesAsMessage failed: %v\n", err)
+		}
+		if !reflect.DeepEqual(expected, message) {
+			t.Fatalf("%v != %v\n", expected, message)
+		}
+	}
+}
+
+func TestBytesAsMessageRejectsMalformed(t *testing.T) {
+	cases := []struct {
+		buf      []byte
+		expected error
+		offset   int
+	}{
+		{[]byte{0}, ErrShortMessage, 0},
+		{[]byte{0, 9}, ErrUnknownOpcode, 0},
+		{[]byte{1, OpcodeReadByte}, ErrUnknownOpcode, 0},
+		{[]byte("\x00\x01file\x00octet"), ErrUnterminatedNullString, 12},
+		{[]byte("\x00\x01\x00octet\x00"), ErrEmptyString, 2},
+		{[]byte("\x00\x02file\x00\x00"), ErrEmptyString, 7},
+		{[]byte("\x00\x01file\x00octet\x00blksize\x00"), ErrMissingOptionValue, 21},
+		{[]byte("\x00\x01file\x00octet\x00blksize\x00512"), ErrUnterminatedNullString, 24},
+		{[]byte("\x00\x01file\x00octet\x00\x00512\x00"), ErrEmptyString, 13},
+		{[]byte("\x00\x01file\x00octet\x00blksize\x00512\x00BLKSIZE\x001024\x00"), ErrDuplicateOption, 25},
+		{[]byte{0, OpcodeDataByte, 0}, ErrShortMessage, 2},
+		{[]byte{0, OpcodeAcknowledgeByte, 0, 1, 0}, ErrTrailingBytes, 4},
+		{[]byte{0, OpcodeAcknowledgeByte, 0}, ErrShortMessage, 2},
+		{[]byte{0, OpcodeErrorByte, 0, 1}, ErrUnterminatedNullString, 4},
+		{[]byte("\x00\x05\x00\x01oops\x00more"), ErrTrailingBytes, 9},
+		{[]byte{0, OpcodeOptionAcknowledgeByte}, ErrNoOptions, 2},
+		{[]byte("\x00\x06tsize\x00"), ErrMissingOptionValue, 8},
+	}
+
+	for _, c := range cases {
+		_, err := BytesAsMessage(c.buf)
+		if !errors.Is(err, c.expected) {
+			t.Fatalf("%q: %v != %v\n", c.buf, err, c.expected)
+		}
+
+		var decodeError *DecodeError
+		if !errors.As(err, &decodeError) || decodeError.Offset != c.offset {
+			t.Fatalf("%q: %v not at offset %v\n", c.buf, err, c.offset)
+		}
+		if ErrorCode(err) != ErrorCodeIllegalOperation {
+			t.Fatalf("%q: error code %v != %v\n", c.buf, ErrorCode(err), ErrorCodeIllegalOperation)
+		}
+	}
+}
+
+func TestBytesAsMessageAcceptsShortest(t *testing.T) {
+	cases := []struct {
+		buf      []byte
+		expected Message
+	}{
+		{[]byte("\x00\x01a\x00octet\x00"), &ReadMessage{"a", ModeOctet, nil}},
+		{[]byte("\x00\x02a\x00OCTET\x00multicast\x00\x00"), &WriteMessage{"a", ModeOctet, map[string]string{"multicast": ""}}},
+		{[]byte{0, OpcodeDataByte, 0, 1}, &DataMessage{1, []byte{}}},
+		{[]byte{0, OpcodeErrorByte, 0, 1, 0}, &ErrorMessage{ErrorCodeNoSuchFile, ""}},
+		{[]byte("\x00\x05\x00\x02nope\x00"), &ErrorMessage{ErrorCodeAccessViolation, "nope"}},
+		{[]byte("\x00\x06a\x00\x00"), &OptionAcknowledgeMessage{map[string]string{"a": ""}}},
+	}
+
+	for _, c := range cases {
+		message, err := BytesAsMessage(c.buf)
+		if err != nil {
+			t.Fatalf("%q: %v\n", c.buf, err)
+		}
+		if !reflect.DeepEqual(c.expected, message) {
+			t.Fatalf("%q: %v != %v\n", c.buf, c.expected, message)
+		}
+	}
+}
+
+// bytes from the tests above used to seed every fuzz target
+func fuzzSeeds() [][]byte {
+	return [][]byte{
+		[]byte("\x00\x01file\x00octal\x00syntax\x00on\x00"),
+		[]byte("\x00\x02file\x00netascii\x00syntax\x00on\x00"),
+		[]byte("\x00\x01vals.zip\x00octal\x00backup\x00true\x00"),
+		[]byte("\x00\x02vals.zip\x00octal\x00backup\x00true\x00"),
+		{0, OpcodeDataByte, 0xab, 0xcd, 5, 4, 3, 2, 1},
+		{0, OpcodeDataByte, 0x56, 0x78, 9, 8, 7, 6, 5, 15, 14, 13, 12, 11},
+		{0, OpcodeAcknowledgeByte, 0xab, 0xcd},
+		{0, OpcodeAcknowledgeByte, 0x56, 0x78},
+		[]byte("\x00\x05\x00\x00among us\x00"),
+		[]byte("\x00\x05\x00\x03You asked for too much data\x00"),
+		[]byte("\x00\x06syntax\x00on\x00"),
+		[]byte("\x00\x06backup\x00true\x00"),
+		[]byte("\x00\x06blksize\x001024\x00timeout\x003\x00tsize\x000\x00windowsize\x004\x00"),
+	}
+}
+
+// decoding anything that decodes must survive being encoded and decoded again unchanged
+func fuzzRoundTrip(t *testing.T, message Message) {
+	buf, err := message.MarshalBinary()
+	if err != nil {
+		t.Fatalf("%v decoded but failed to encode: %v\n", message, err)
+	}
+
+	again, err := BytesAsMessage(buf)
+	if err != nil {
+		t.Fatalf("%q encoded from %v failed to decode: %v\n", buf, message, err)
+	}
+	if !reflect.DeepEqual(message, again) {
+		t.Fatalf("%v != %v\n", message, again)
+	}
+}
+
+func FuzzBytesAsMessage(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		message, err := BytesAsMessage(buf)
+		if err != nil {
+			var decodeError *DecodeError
+			if !errors.As(err, &decodeError) {
+				t.Fatalf("%q: %v is not a DecodeError\n", buf, err)
+			}
+			return
+		}
+		fuzzRoundTrip(t, message)
+	})
+}
+
+// seed each body decoder with the bodies of its own messages
+func fuzzBody(f *testing.F, opcode byte, decode func([]byte) (Message, error)) {
+	for _, seed := range fuzzSeeds() {
+		if seed[1] == opcode {
+			f.Add(seed[2:])
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		message, err := decode(buf)
+		if err == nil {
+			fuzzRoundTrip(t, message)
+		}
+	})
+}
+
+func FuzzBytesAsReadMessage(f *testing.F) {
+	fuzzBody(f, OpcodeReadByte, func(buf []byte) (Message, error) {
+		message, err := bytesAsReadMessage(buf)
+		return &message, err
+	})
+}
+
+func FuzzBytesAsWriteMessage(f *testing.F) {
+	fuzzBody(f, OpcodeWriteByte, func(buf []byte) (Message, error) {
+		message, err := bytesAsWriteMessage(buf)
+		return &message, err
+	})
+}
+
+func FuzzBytesAsDataMessage(f *testing.F) {
+	fuzzBody(f, OpcodeDataByte, func(buf []byte) (Message, error) {
+		message, err := bytesAsDataMessage(buf)
+		return &message, err
+	})
+}
+
+func FuzzBytesAsAcknowledgeMessage(f *testing.F) {
+	fuzzBody(f, OpcodeAcknowledgeByte, func(buf []byte) (Message, error) {
+		message, err := bytesAsAcknowledgeMessage(buf)
+		return &message, err
+	})
+}
+
+func FuzzBytesAsErrorMessage(f *testing.F) {
+	fuzzBody(f, OpcodeErrorByte, func(buf []byte) (Message, error) {
+		message, err := bytesAsErrorMessage(buf)
+		return &message, err
+	})
+}
+
+func FuzzBytesAsOptionAcknowledgeMessage(f *testing.F) {
+	fuzzBody(f, OpcodeOptionAcknowledgeByte, func(buf []byte) (Message, error) {
+		message, err := bytesAsOptionAcknowledgeMessage(buf)
+		return &message, err
+	})
+}
+
+// encoding any message that encodes must decode back to the same message
+func FuzzMessageRoundTrip(f *testing.F) {
+	f.Add("file", "octal", "syntax", "on", uint16(0xabcd), []byte{5, 4, 3, 2, 1})
+	f.Add("vals.zip", "netascii", "backup", "true", uint16(0x5678), []byte{9, 8, 7, 6, 5})
+	f.Add("among us", "octet", "blksize", "1024", uint16(0), []byte{})
+
+	f.Fuzz(func(t *testing.T, filename string, mode string, key string, value string, blockNumber uint16, body []byte) {
+		options := map[string]string{strings.ToLower(key): value}
+		readMessage := NewReadMessage(filename, strings.ToLower(mode), options)
+		writeMessage := NewWriteMessage(filename, strings.ToLower(mode), options)
+		messages := []Message{
+			&readMessage,
+			&writeMessage,
+			&DataMessage{blockNumber, body},
+			&AcknowledgeMessage{blockNumber},
+			&ErrorMessage{blockNumber, value},
+			&OptionAcknowledgeMessage{options},
+		}
+
+		for _, message := range messages {
+			buf, err := message.MarshalBinary()
+			if err != nil {
+				if !errors.Is(err, ErrNullInString) && !errors.Is(err, ErrEmptyString) {
+					t.Fatalf("%v failed to encode: %v\n", message, err)
+				}
+				continue
+			}
+
+			decoded, err := BytesAsMessage(buf)
+			if err != nil {
+				t.Fatalf("%q encoded from %v failed to decode: %v\n", buf, message, err)
+			}
+
+			if data, isData := message.(*DataMessage); isData && data.Body == nil {
+				data.Body = []byte{}
+			}
+			if !reflect.DeepEqual(message, decoded) {
+				t.Fatalf("%v != %v\n", message, decoded)
+			}
+		}
+	})
+}
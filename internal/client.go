@@ -5,242 +5,369 @@ import (
 	"errors"
 	"fmt"
 	"github.com/jackpal/gateway"
+	"io"
 	"net"
-	"net/netip"
 	"os"
+	"path/filepath"
+	"time"
 )
 
-func ClientRoutine(doingWrite bool, filename string, options map[string]string, ctx context.Context) {
+/*
+ * A TFTP client downloading from and uploading to the server at Cfg.Address.
+ * Every client owns its config and logger so that many can run in one process.
+ */
+type Client struct {
+	Cfg Config
+	Log chan<- logEvent
+
+	logger *Logger
+}
+
+// start the logger, nothing is sent until Read or Write is called
+func NewClient(cfg Config) (*Client, error) {
+	var client Client = Client{Cfg: cfg}
 	var err error
-	var returnCode int
 
-	if doingWrite {
-		err = DoWriteAsClient(Cfg.Filename, options, ctx)
-	} else {
-		options["tsize"] = "0"
-		err = DoReadAsClient(Cfg.Filename, options, ctx)
+	client.logger, err = NewLogger(&client.Cfg)
+	if err != nil {
+		return nil, err
 	}
+	client.Log = client.logger.Events
+
+	return &client, nil
+}
+
+// stop the logger once everything logged has been written, the client can not be used again afterwards
+func (client *Client) Close() error {
+	return client.logger.Close()
+}
 
-	if doingWrite && err != nil {
-		returnCode = 21
-	} else if !doingWrite && err != nil {
-		returnCode = 22
+/*
+ * What a client learned from a finished transfer.
+ */
+type TransferStats struct {
+	// bytes of the file sent or received
+	Bytes uint64
+	// options the server acknowledged and the values they took, empty when it acknowledged none
+	Options    map[string]string
+	BlockSize  uint16
+	WindowSize uint16
+	Timeout    time.Duration
+	// size the server reported for a download or the client announced for an upload, 0 when unknown
+	TransferSize uint64
+	Duration     time.Duration
+}
+
+func (session *TftpSession) transferStats(started time.Time) TransferStats {
+	return TransferStats{
+		Bytes:        session.TotalBytesTransferred,
+		Options:      session.Options,
+		BlockSize:    session.BlockSize,
+		WindowSize:   session.WindowSize,
+		Timeout:      session.Timeout,
+		TransferSize: session.TransferSize,
+		Duration:     time.Since(started),
 	}
+}
 
-	if *(Cfg.Testing) {
-		return
+// download filename from the server into a file with the same last element in the working directory
+func (client *Client) Read(ctx context.Context, filename string, options map[string]string) error {
+	var file *os.File
+
+	_, err := client.Get(ctx, filename, func() (io.Writer, error) {
+		var err error
+		file, err = os.Create(filepath.Base(filename))
+		return file, err
+	}, options)
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
 	}
 
-	os.Exit(returnCode)
+	return err
 }
 
-func DoReadAsClient(filename string, options map[string]string, ctx context.Context) error {
+/*
+ * Download filename from the server into the writer returned by open.
+ * open is only called once the server accepts the request so that nothing is created for a file that does not exist.
+ * Multicast downloads into a writer that is not also an io.WriterAt keep blocks that arrive early in memory.
+ */
+func (client *Client) Get(ctx context.Context, filename string, open func() (io.Writer, error), options map[string]string) (TransferStats, error) {
 	var err error
 	var alreadyHoldingMessage bool = false
+	var started time.Time = time.Now()
 
-	bestAddressToListenOn, err := FindEnclosingAddress(Cfg.Address)
+	temporaryConnection, err := client.listen()
 	if err != nil {
-		return err
-	}
-	pickRandomPort := "0"
-	localAddressString := bestAddressToListenOn + ":" + pickRandomPort
-
-	laddr, err := net.ResolveUDPAddr("udp", localAddressString)
-	if err != nil {
-		fmt.Printf("Unable to resolve %v to address", Cfg.Address)
-		return err
-	}
-	temporaryConnection, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		fmt.Println("Unable to listen on:", laddr.String())
-		return err
+		client.Log <- NewErrorEvent("CLIENT", fmt.Sprintf("%v", err))
+		return TransferStats{}, err
 	}
 	defer temporaryConnection.Close()
-	session, err := NewTftpSession(ctx, temporaryConnection)
+	session, err := NewTftpSession(ctx, &client.Cfg, client.Log, temporaryConnection)
 	if err != nil {
-		fmt.Printf("Unable to create session for address: %v", Cfg.Address)
-		return err
+		return TransferStats{}, fmt.Errorf("Unable to create session for %v: %w", client.Cfg.Address, err)
 	}
 
 	session.Operation = ReadAsClient
+	session.Mode = client.Cfg.Mode
 	if err = session.ReadMessage(filename, options); err != nil {
-		session.ErrorMessage(ErrorCodeUndefined, fmt.Sprintf("%v", err))
-		Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("Failed to send Read Message: %v", err))
-		return err
+		session.ReportError(err)
+		client.Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("Failed to send Read Message: %v", err))
+		return TransferStats{}, err
 	}
 
+	// the server answers from a new port, from here on only messages from that port belong to the transfer
 	raddr, err := session.Receive()
 	if err != nil {
-		return err
-	}
-
-	laddr, err = net.ResolveUDPAddr("udp", temporaryConnection.LocalAddr().String())
-	session.Destination.Close()
-	session.Destination, err = net.DialUDP("udp", laddr, raddr)
-	if err != nil {
-		return err
+		return TransferStats{}, err
 	}
-	defer session.Destination.Close()
+	session.TransferId = raddr
 
 	switch session.MostRecentMessage.(type) {
-	case OptionAcknowledgeMessage:
-		err = session.UpdateOptions(session.MostRecentMessage.(OptionAcknowledgeMessage).Options)
+	case *OptionAcknowledgeMessage:
+		err = session.UpdateOptions(session.MostRecentMessage.(*OptionAcknowledgeMessage).Options)
 		if err != nil {
-			session.ErrorMessage(ErrorCodeUndefined, "One or more options contain invalid values")
-			return errors.New("One or more options contain invalid values")
+			session.ReportError(err)
+			return TransferStats{}, err
 		}
 
-		if err = session.AcknowledgeMessage(); err != nil {
-			fmt.Println("Failed to send ack to: ", session.Destination.RemoteAddr())
-			fmt.Println("Error sending acknowledgement: ", err)
-			return errors.New("Unable to send acknowledge message!")
+		// multicast clients only acknowledge once they are the master client
+		if session.MulticastGroup != nil {
+			break
 		}
-	case DataMessage:
+		if err = session.AcknowledgeMessage(0); err != nil {
+			err = fmt.Errorf("Unable to acknowledge options sent by %v: %w", session.TransferId, err)
+			client.Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("%v", err))
+			return TransferStats{}, err
+		}
+	case *DataMessage:
+		// the server ignored every option
+		session.Options = make(map[string]string)
 		alreadyHoldingMessage = true
+	case *ErrorMessage:
+		return TransferStats{}, errorFromMessage(session.MostRecentMessage.(*ErrorMessage))
 	default:
-		session.ErrorMessage(ErrorCodeUndefined, fmt.Sprintf("%v", err))
-		Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("Server provided invalid response when opening connection: %v", err))
-		return err
+		err = newError(ErrIllegalOperation, "Server provided invalid response when opening connection")
+		session.ReportError(err)
+		client.Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("%v", err))
+		return TransferStats{}, err
 	}
 	session.LastValidMessage = session.MostRecentMessage
 
-	if session.File, err = os.Create(session.Filename); err != nil {
-		session.ErrorMessage(ErrorCodeUndefined, fmt.Sprintf("Unable to download to: %v", session.Filename))
-		Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("Unable to write download to: %v", session.Filename))
-		return err
+	if session.Writer, err = open(); err != nil {
+		err = fileError(err, session.Filename)
+		session.ReportError(err)
+		client.Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("Unable to write download to: %v", err))
+		return TransferStats{}, err
 	}
-	defer session.File.Close()
 
 	session.BlockNumber = 1
 
-	err = session.ReceiveDataLoop(alreadyHoldingMessage)
+	if session.MulticastGroup != nil {
+		err = session.MulticastAsClient()
+	} else {
+		err = session.ReceiveDataLoop(alreadyHoldingMessage, nil)
+	}
 	if err != nil {
-		return err
+		session.ReportError(err)
+		return TransferStats{}, err
 	}
 
-	return nil
+	return session.transferStats(started), nil
 }
 
-func DoWriteAsClient(filename string, options map[string]string, ctx context.Context) error {
-	var err error
-
-	bestAddressToListenOn, err := FindEnclosingAddress(Cfg.Address)
+// upload the file at filename to the server under its last element
+func (client *Client) Write(ctx context.Context, filename string, options map[string]string) error {
+	file, err := os.Open(filename)
 	if err != nil {
-		return err
+		return fileError(err, filename)
 	}
-	pickRandomPort := "0"
-	localAddressString := bestAddressToListenOn + ":" + pickRandomPort
+	defer file.Close()
 
-	laddr, err := net.ResolveUDPAddr("udp", localAddressString)
-	if err != nil {
-		fmt.Printf("Unable to resolve %v to address", Cfg.Address)
-		return err
-	}
-	temporaryConnection, err := net.ListenUDP("udp", laddr)
+	_, err = client.Put(ctx, filepath.Base(filename), file, options)
+
+	return err
+}
+
+/*
+ * Upload everything read from reader to the server as filename.
+ * Readers that can not seek have the blocks that might need to be sent again kept in memory.
+ */
+func (client *Client) Put(ctx context.Context, filename string, reader io.Reader, options map[string]string) (TransferStats, error) {
+	var err error
+	var started time.Time = time.Now()
+
+	temporaryConnection, err := client.listen()
 	if err != nil {
-		fmt.Println("Unable to listen on:", laddr.String())
-		return err
+		client.Log <- NewErrorEvent("CLIENT", fmt.Sprintf("%v", err))
+		return TransferStats{}, err
 	}
 	defer temporaryConnection.Close()
-	session, err := NewTftpSession(ctx, temporaryConnection)
+	session, err := NewTftpSession(ctx, &client.Cfg, client.Log, temporaryConnection)
 	if err != nil {
-		fmt.Printf("Unable to create session for address: %v", Cfg.Address)
-		return err
+		return TransferStats{}, fmt.Errorf("Unable to create session for %v: %w", client.Cfg.Address, err)
 	}
 
 	session.Operation = WriteAsClient
+	session.Mode = client.Cfg.Mode
 	if err = session.WriteMessage(filename, options); err != nil {
-		session.ErrorMessage(ErrorCodeUndefined, fmt.Sprintf("%v", err))
-		Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("Failed to send Write Message: %v", err))
-		return err
+		session.ReportError(err)
+		client.Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("Failed to send Write Message: %v", err))
+		return TransferStats{}, err
 	}
 
+	// the server answers from a new port, from here on only messages from that port belong to the transfer
 	raddr, err := session.Receive()
 	if err != nil {
-		return err
+		return TransferStats{}, err
 	}
-
-	laddr, err = net.ResolveUDPAddr("udp", temporaryConnection.LocalAddr().String())
-	session.Destination.Close()
-	session.Destination, err = net.DialUDP("udp", laddr, raddr)
-	if err != nil {
-		return err
-	}
-	defer session.Destination.Close()
+	session.TransferId = raddr
 
 	switch session.MostRecentMessage.(type) {
-	case OptionAcknowledgeMessage:
-		err = session.UpdateOptions(session.MostRecentMessage.(OptionAcknowledgeMessage).Options)
+	case *OptionAcknowledgeMessage:
+		err = session.UpdateOptions(session.MostRecentMessage.(*OptionAcknowledgeMessage).Options)
 		if err != nil {
-			session.ErrorMessage(ErrorCodeUndefined, "One or more options contain invalid values")
-			return errors.New("One or more options contain invalid values")
+			session.ReportError(err)
+			return TransferStats{}, err
 		}
-	case AcknowledgeMessage:
-		if session.MostRecentMessage.(AcknowledgeMessage).BlockNumber != 0 {
-			session.ErrorMessage(ErrorCodeUndefined, "Server did not properly acknowledge client write request")
+	case *AcknowledgeMessage:
+		if session.MostRecentMessage.(*AcknowledgeMessage).BlockNumber != 0 {
+			err = newError(ErrIllegalOperation, "Server did not properly acknowledge client write request")
+			session.ReportError(err)
+			return TransferStats{}, err
 		}
+		// the server ignored every option
+		session.Options = make(map[string]string)
+	case *ErrorMessage:
+		return TransferStats{}, errorFromMessage(session.MostRecentMessage.(*ErrorMessage))
 	default:
-		session.ErrorMessage(ErrorCodeUndefined, fmt.Sprintf("%v", err))
-		Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("Server provided invalid response when opening connection: %v", err))
-		return err
+		err = newError(ErrIllegalOperation, "Server provided invalid response when opening connection")
+		session.ReportError(err)
+		client.Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("%v", err))
+		return TransferStats{}, err
 	}
 	session.LastValidMessage = session.MostRecentMessage
 
-	if session.File, err = os.Open(session.Filename); err != nil {
-		session.ErrorMessage(ErrorCodeUndefined, fmt.Sprintf("Unable to download to: %v", session.Filename))
-		Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("Unable to write download to: %v", session.Filename))
-		return err
+	// blocks are read again when they are resent so whatever the window might need again is kept
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		session.Reader = seeker
+	} else {
+		session.Reader = newReplayReader(reader, (int(session.WindowSize)+1)*int(session.BlockSize))
 	}
-	defer session.File.Close()
 
 	session.BlockNumber = 1
 
 	err = session.SendDataLoop(false)
 
 	if err != nil {
-		return err
+		session.ReportError(err)
+		return TransferStats{}, err
 	}
-	return nil
+
+	return session.transferStats(started), nil
 }
 
-// Find the first address belonging to a network containing destinationString
-// Returns the default gateway if no attached network contains destinationString
-func FindEnclosingAddress(destinationString string) (string, error) {
-	var err error
-	var gatewayIP net.IP
-	var destinationAddrPort netip.AddrPort
-	var destinationNetIP netip.Addr
-	var interfaces []net.Addr
-	var addr net.Addr
-	var network netip.Prefix
-
-	gatewayIP, err = gateway.DiscoverGateway()
-	if err != nil {
-		return "", err
+/*
+ * Lets a reader that can not seek move back over the last limit bytes read from it.
+ * Enough for a session to resend its window, seeking any further back fails.
+ */
+type replayReader struct {
+	reader io.Reader
+	limit  int
+	// the most recent bytes read from reader, kept so they can be read again
+	kept []byte
+	// offset of kept[0] from the start of reader
+	keptOffset int64
+	// offset the next read starts from
+	offset int64
+}
+
+func newReplayReader(reader io.Reader, limit int) *replayReader {
+	return &replayReader{reader: reader, limit: limit}
+}
+
+func (replay *replayReader) Read(buf []byte) (int, error) {
+	keptEnd := replay.keptOffset + int64(len(replay.kept))
+
+	// read again what was already read
+	if replay.offset < keptEnd {
+		n := copy(buf, replay.kept[replay.offset-replay.keptOffset:])
+		replay.offset += int64(n)
+		return n, nil
 	}
-	destinationAddrPort, err = netip.ParseAddrPort(destinationString)
-	if err != nil {
-		return "", err
+
+	n, err := replay.reader.Read(buf)
+	replay.kept = append(replay.kept, buf[:n]...)
+	replay.offset += int64(n)
+
+	// forget whatever is too old to be needed
+	if extra := len(replay.kept) - replay.limit; extra > 0 {
+		replay.kept = append(replay.kept[:0], replay.kept[extra:]...)
+		replay.keptOffset += int64(extra)
 	}
-	destinationNetIP, err = netip.ParseAddr(destinationAddrPort.Addr().String())
-	if err != nil {
-		return "", err
+
+	return n, err
+}
+
+func (replay *replayReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		// pass
+	case io.SeekCurrent:
+		offset += replay.offset
+	default:
+		return replay.offset, errors.New("Unable to seek relative to the end of a reader")
 	}
 
-	interfaces, err = net.InterfaceAddrs()
-	if err != nil {
-		return "", err
+	if offset < replay.keptOffset || offset > replay.keptOffset+int64(len(replay.kept)) {
+		return replay.offset, errors.New("Unable to seek to bytes no longer kept")
 	}
+	replay.offset = offset
 
-	for _, addr = range interfaces {
-		network, err = netip.ParsePrefix(addr.String())
+	return offset, nil
+}
+
+// a conn for one transfer, bound to the address facing the server when there is one
+func (client *Client) listen() (net.PacketConn, error) {
+	var laddr *net.UDPAddr = &net.UDPAddr{}
+
+	// networks other than UDP have no interfaces to choose from
+	if client.Cfg.Network == nil {
+		server, err := net.ResolveUDPAddr("udp", client.Cfg.Address)
 		if err != nil {
-			return "", err
+			return nil, fmt.Errorf("Unable to resolve %v: %w", client.Cfg.Address, err)
 		}
-		if network.Contains(destinationNetIP) {
-			return network.Addr().String(), nil
+		laddr.IP = FindEnclosingAddress(server.IP)
+	}
+
+	conn, err := client.Cfg.listenPacket(laddr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %v: %w", laddr, err)
+	}
+
+	return conn, nil
+}
+
+/*
+ * Find the address on the first attached network containing destination, or else of the interface the default route leaves through.
+ * Returns nil when neither is known so that listening on the unspecified address leaves the choice to the operating system.
+ */
+func FindEnclosingAddress(destination net.IP) net.IP {
+	interfaces, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range interfaces {
+			if network, ok := addr.(*net.IPNet); ok && network.Contains(destination) {
+				return network.IP
+			}
 		}
 	}
 
-	return gatewayIP.String(), nil
+	// hosts without a default route still reach servers through whatever route they have
+	local, err := gateway.DiscoverInterface()
+	if err != nil || (local.To4() == nil) != (destination.To4() == nil) {
+		return nil
+	}
+
+	return local
 }
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReplayReader(t *testing.T) {
+	source := []byte("0123456789abcdef")
+	// hide Seek so nothing but the replay reader can move back
+	replay := newReplayReader(io.MultiReader(bytes.NewReader(source)), 6)
+	buf := make([]byte, 4)
+
+	read := func(expected string) {
+		n, err := replay.Read(buf)
+		if err != nil || string(buf[:n]) != expected {
+			t.Fatalf("Read %q %v instead of %q\n", buf[:n], err, expected)
+		}
+	}
+
+	read("0123")
+	read("4567")
+
+	// the last 6 bytes read are kept
+	if _, err := replay.Seek(2, io.SeekStart); err != nil {
+		t.Fatalf("Seek to kept byte failed: %v\n", err)
+	}
+	read("2345")
+	read("67")
+	read("89ab")
+
+	if _, err := replay.Seek(-3, io.SeekCurrent); err != nil {
+		t.Fatalf("Seek back within kept bytes failed: %v\n", err)
+	}
+	read("9ab")
+
+	// anything older has been forgotten and nothing past what was read can be reached
+	if _, err := replay.Seek(1, io.SeekStart); err == nil {
+		t.Fatalf("Seek to forgotten byte succeeded\n")
+	}
+	if _, err := replay.Seek(13, io.SeekStart); err == nil {
+		t.Fatalf("Seek past what was read succeeded\n")
+	}
+	if offset, _ := replay.Seek(0, io.SeekCurrent); offset != 12 {
+		t.Fatalf("Failed seeks moved offset to %v\n", offset)
+	}
+	read("cdef")
+}
+
+func TestFindEnclosingAddress(t *testing.T) {
+	if local := FindEnclosingAddress(net.IPv4(127, 0, 0, 1)); !local.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("Loopback is reached from %v\n", local)
+	}
+	// an address no interface is on is reached through the default route or whatever the operating system picks
+	if local := FindEnclosingAddress(net.ParseIP("2001:db8::1")); local != nil && local.To4() != nil {
+		t.Fatalf("IPv6 address is reached from %v\n", local)
+	}
+}
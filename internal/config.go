@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"io"
+	"os"
+)
+
+/*
+ * Settings for one server or client.
+ * Each Server and Client keeps a copy of its own so that many with different settings can run in one process.
+ */
+type Config struct {
+	// behavior
+	MemoryLimit int
+	Debug       bool
+	Retries     int
+	Backoff     float64
+	// where packets are sent and received, nil for real UDP sockets
+	Network Network
+	// where events are logged unless a log file is named for them, nil for stdout and stderr
+	LogOutput io.Writer
+
+	// server options
+	Directory     *os.Root
+	Sqlite3DBPath string
+	NormalLogFile string
+	DebugLogFile  string
+	ErrorLogFile  string
+	// first group address and port offered to clients asking for multicast, empty to refuse
+	MulticastAddress string
+	// where versions of files are kept, nil for the sqlite database at Sqlite3DBPath keeping them in Directory
+	Store Store
+	// which out of date versions the sqlite database keeps, nil to keep only the newest version of each file and the one before it
+	Retention RetentionPolicy
+	// FsckCheck or FsckRepair to check the sqlite database against Directory before serving, empty to skip
+	Fsck string
+	// when Store is nil serve the files in Directory under their real names instead, without a sqlite database
+	PlainDirectory bool
+	// adopt files put in Directory while serving as new versions, only for the sqlite database on Linux
+	Watch bool
+	// serve files found in Directory when the sqlite database is opened by linking them in as versions, leaving them where they are
+	Import bool
+	// create missing directories for uploads to paths below Directory instead of refusing them
+	CreateDirectories bool
+	// answer requests some other way than with the versions kept in Store, nil for the default
+	ReadHandler  ReadHandler
+	WriteHandler WriteHandler
+
+	// client options
+	Write      string
+	Mode       string
+	WindowSize int
+	Multicast  bool
+
+	// args
+	Address  string
+	Filename string
+}
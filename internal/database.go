@@ -7,7 +7,9 @@ import (
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,21 +18,29 @@ type fileModel struct {
 	timeStarted   int64
 	timeCompleted int64
 	consumers     int64
+	// recorded once the upload completes, -1 until then and for versions completed before sizes were recorded
+	size int64
+	// when the version was last promoted, 0 when it never was
+	timePromoted int64
 }
 
 func newFileModel() fileModel {
-	return fileModel{}
+	return fileModel{size: -1}
 }
 
 func newFileModelWith(filename string, timeStarted, timeCompleted, consumers int64) fileModel {
-	return fileModel{filename, timeStarted, timeCompleted, consumers}
+	return fileModel{filename, timeStarted, timeCompleted, consumers, -1, 0}
+}
+
+func (model fileModel) version() Version {
+	return Version{model.filename, model.timeStarted, model.timeCompleted, model.consumers, model.size, model.timePromoted}
 }
 
 func (model fileModel) Path() string {
 	return model.filename + "." + strconv.FormatInt(model.timeStarted, 10)
 }
 
-func (model *fileModel) deleteFiles(ctx context.Context, rows *sql.Rows) error {
+func (model *fileModel) deleteFiles(ctx context.Context, directory *os.Root, rows *sql.Rows) error {
 	for rows.Next() {
 		select {
 		case <-ctx.Done():
@@ -41,7 +51,7 @@ func (model *fileModel) deleteFiles(ctx context.Context, rows *sql.Rows) error {
 				return err
 			}
 
-			err = Cfg.Directory.Remove(model.Path())
+			err = directory.Remove(model.Path())
 			if err != nil && !errors.Is(err, os.ErrNotExist) {
 				return err
 			}
@@ -52,49 +62,95 @@ func (model *fileModel) deleteFiles(ctx context.Context, rows *sql.Rows) error {
 }
 
 func (model *fileModel) scanRows(rows *sql.Rows) error {
-	return rows.Scan(&(model.filename), &(model.timeStarted), &(model.timeCompleted), &(model.consumers))
+	return rows.Scan(&(model.filename), &(model.timeStarted), &(model.timeCompleted), &(model.consumers), &(model.size), &(model.timePromoted))
 }
 
 func (model *fileModel) scanRow(row *sql.Row) error {
-	return row.Scan(&(model.filename), &(model.timeStarted), &(model.timeCompleted), &(model.consumers))
+	return row.Scan(&(model.filename), &(model.timeStarted), &(model.timeCompleted), &(model.consumers), &(model.size), &(model.timePromoted))
 }
 
-func deleteOutOfDateGlobally() error {
-	var model fileModel = newFileModel()
-	var err error
+/*
+ * The Store keeping every version of every file in the root directory as filename.<uploadStarted>,
+ * tracked by a sqlite database that also holds the statements used to reserve, release, prepare, and overwrite versions.
+ * Every server opens a database of its own.
+ */
+type Database struct {
+	DB *sql.DB
+	// where the versions are kept
+	Directory *os.Root
+
+	// where the database was opened from, as given to sql.Open
+	path string
+	log  chan<- logEvent
+	// create missing parent directories of uploads
+	createDirectories bool
+	// which out of date versions are kept
+	retention RetentionPolicy
+	// register files found in the root directory as versions when opened
+	importFiles bool
+	// log files that may be inside the root directory, never imported
+	logFiles []string
+	// opened by AttachDatabase, deleting versions is left to the server
+	attached bool
+	// held by servers so nothing that would pull rows out from under them runs alongside
+	lock *databaseLock
+
+	ReserveStatementSelect    *sql.Stmt
+	ReserveStatementUpdate    *sql.Stmt
+	ReleaseStatementSelect    *sql.Stmt
+	ReleaseStatementUpdate    *sql.Stmt
+	ReleaseStatementDelete    *sql.Stmt
+	PrepareStatement          *sql.Stmt
+	OverwriteSuccessSelect    *sql.Stmt
+	OverwriteSuccessUpdate    *sql.Stmt
+	OverwriteSuccessDelete    *sql.Stmt
+	OverwriteFailureStatement *sql.Stmt
+}
 
-	ctx, _ := context.WithDeadline(context.Background(), time.Now().Add(3*time.Minute))
+// the rules given as cfg.Retention, empty when every file keeps only the newest version and the one before it
+func (database *Database) Retention() RetentionPolicy {
+	return database.retention
+}
+
+// delete every version of every file that is out of date, not being read, and not kept by the retention policy
+func (database *Database) GarbageCollect(ctx context.Context) error {
+	var filenames []string
+	var err error
 
 	// start new transaction
-	tx, err := DB.BeginTx(ctx, nil)
+	tx, err := database.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	// select all files for which a more recent version already exists and are not being uploaded or consumed, returning the deleted rows
-	rows, err := tx.QueryContext(ctx, `SELECT * FROM files WHERE
-            uploadCompleted != 0 AND
-            consumers = 0 AND
-            (rowid, filename, uploadCompleted) NOT IN ( SELECT rowid, filename, MAX(uploadCompleted) FROM files GROUP BY filename );`)
+	// every file with a completed version
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT filename FROM files WHERE uploadCompleted != 0;`)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
 	}
-
-	defer rows.Close()
-	err = model.deleteFiles(ctx, rows)
-	if err != nil {
+	for rows.Next() {
+		var filename string
+		err = rows.Scan(&filename)
+		if err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return err
+		}
+		filenames = append(filenames, filename)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
-	// delete all files for which a more recent version already exists and are not being uploaded or consumed, returning the deleted rows
-	_, err = tx.ExecContext(ctx, `DELETE FROM files WHERE
-            uploadCompleted != 0 AND
-            consumers = 0 AND
-            (rowid, filename, uploadCompleted) NOT IN ( SELECT rowid, filename, MAX(uploadCompleted) FROM files GROUP BY filename )`)
-	if err != nil {
-		_ = tx.Rollback()
-		// die
+	for _, filename := range filenames {
+		err = database.deleteExpired(ctx, tx, database.ReleaseStatementSelect, database.ReleaseStatementDelete, filename)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
 	}
 
 	// commit new transaction
@@ -106,68 +162,201 @@ func deleteOutOfDateGlobally() error {
 	return nil
 }
 
-func DatabaseInit() error {
-	var err error
-	var errPtr *error = &err
-	var parentCtx context.Context = context.Background()
+/*
+ * Delete the completed versions of filename that are out of date, not being read, and not kept by the retention policy.
+ * selectStatement finds every completed version of filename newest first and deleteStatement deletes one of them by uploadStarted.
+ */
+func (database *Database) deleteExpired(ctx context.Context, tx *sql.Tx, selectStatement *sql.Stmt, deleteStatement *sql.Stmt, filename string) error {
+	var model fileModel = newFileModel()
+	var expired []fileModel
+	var now time.Time = time.Now()
 
-	// only run first time databaseRoutine itself starts
-	DB, err = sql.Open("sqlite3", Cfg.Sqlite3DBPath)
+	rows, err := tx.StmtContext(ctx, selectStatement).QueryContext(ctx, filename)
 	if err != nil {
-		Log <- NewErrorEvent("DATABASE", fmt.Sprintf("Unable to open database file at: %v", Cfg.Sqlite3DBPath))
 		return err
 	}
-	defer func() {
-		if *errPtr != nil {
-			Log <- NewErrorEvent("DATABASE", fmt.Sprintf("Encountered error opening database: %v", err))
-			DB.Close()
-		}
-	}()
-
-	// Prepare DB if not already open
-	{
-		var tx *sql.Tx
-
-		// make sure database is working
-		ctx, _ := context.WithDeadline(parentCtx, time.Now().Add(time.Second*3))
-		err = DB.PingContext(ctx)
+	for newer := 0; rows.Next(); newer++ {
+		err = model.scanRows(rows)
 		if err != nil {
+			rows.Close()
 			return err
 		}
+		if model.consumers == 0 && !database.retention.retains(filename, newer, model.timeCompleted, now) {
+			expired = append(expired, model)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
 
-		ctx, _ = context.WithDeadline(parentCtx, time.Now().Add(time.Second*15))
-		tx, err = DB.BeginTx(ctx, nil)
-		if err != nil {
+	// rows must be closed before anything else is done in the same transaction
+	for _, model := range expired {
+		err = database.Directory.Remove(model.Path())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
 			return err
 		}
 
-		// create files table
-		_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS files(filename STRING, uploadStarted INT UNIQUE, uploadCompleted INT, consumers INT);`)
+		_, err = tx.StmtContext(ctx, deleteStatement).ExecContext(ctx, model.filename, model.timeStarted)
 		if err != nil {
-			_ = tx.Rollback()
 			return err
 		}
+	}
 
-		// create files_name index
-		_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS files_filename ON files(filename);`)
+	return nil
+}
+
+// every version of filename oldest first, including uploads in progress
+func (database *Database) Versions(ctx context.Context, filename string) ([]Version, error) {
+	var versions []Version
+	var model fileModel = newFileModel()
+
+	rows, err := database.DB.QueryContext(ctx, `SELECT * FROM files WHERE filename = ? ORDER BY uploadStarted;`, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = model.scanRows(rows)
 		if err != nil {
-			_ = tx.Rollback()
-			return err
+			return nil, err
 		}
+		versions = append(versions, model.version())
+	}
 
-		err = tx.Commit()
-		if err != nil {
-			return err
+	return versions, rows.Err()
+}
+
+// open the database at cfg.Sqlite3DBPath, creating it when needed, and clear out anything left behind by failed uploads
+func OpenDatabase(cfg *Config, log chan<- logEvent) (*Database, error) {
+	lock, err := acquireDatabaseLock(cfg.Sqlite3DBPath)
+	if err != nil {
+		log <- NewErrorEvent("DATABASE", fmt.Sprintf("Unable to lock database: %v", err))
+		return nil, err
+	}
+	database, err := openDatabase(cfg, log)
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	database.lock = lock
+
+	// reported before cleaning up hides what a crash left behind
+	if cfg.Fsck != "" {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(3*time.Minute))
+		err = database.logFsck(ctx, cfg.Fsck == FsckRepair)
+		cancel()
+	}
+	if err == nil {
+		err = database.cleanUp(context.Background())
+	}
+	if err != nil {
+		log <- NewErrorEvent("DATABASE", fmt.Sprintf("Encountered error opening database: %v", err))
+		database.DB.Close()
+		lock.release()
+		return nil, err
+	}
+
+	log <- NewNormalEvent("DATABASE", fmt.Sprintf("Database ready for access: %v", cfg.Sqlite3DBPath))
+
+	return database, nil
+}
+
+/*
+ * Open the database at cfg.Sqlite3DBPath for administration while a server may be using it.
+ * Nothing a server cleans up when it starts is touched, so uploads and reservations in progress are left alone,
+ * and closing it deletes no versions since the server's retention policy may keep them.
+ */
+func AttachDatabase(cfg *Config, log chan<- logEvent) (*Database, error) {
+	database, err := openDatabase(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	database.attached = true
+
+	return database, nil
+}
+
+// open the database at cfg.Sqlite3DBPath, migrate its schema when needed, and prepare statements
+func openDatabase(cfg *Config, log chan<- logEvent) (*Database, error) {
+	var database Database = Database{Directory: cfg.Directory, path: cfg.Sqlite3DBPath, log: log, createDirectories: cfg.CreateDirectories, retention: cfg.Retention, importFiles: cfg.Import}
+	var err error
+
+	for _, logFile := range []string{cfg.NormalLogFile, cfg.DebugLogFile, cfg.ErrorLogFile} {
+		if logFile != "" {
+			database.logFiles = append(database.logFiles, logFile)
 		}
 	}
 
+	err = cfg.Retention.validate()
+	if err != nil {
+		log <- NewErrorEvent("DATABASE", fmt.Sprintf("Unable to use retention policy: %v", err))
+		return nil, err
+	}
+
+	// transactions take the write lock as soon as they begin
+	// otherwise two sessions that both read before writing can each hold a lock the other needs and fail at once instead of waiting
+	dataSourceName := cfg.Sqlite3DBPath + "?_txlock=immediate"
+	if strings.Contains(cfg.Sqlite3DBPath, "?") {
+		dataSourceName = cfg.Sqlite3DBPath + "&_txlock=immediate"
+	}
+	database.DB, err = sql.Open("sqlite3", dataSourceName)
+	if err != nil {
+		log <- NewErrorEvent("DATABASE", fmt.Sprintf("Unable to open database file at: %v", cfg.Sqlite3DBPath))
+		return nil, err
+	}
+
+	err = database.init(context.Background())
+	if err != nil {
+		log <- NewErrorEvent("DATABASE", fmt.Sprintf("Encountered error opening database: %v", err))
+		database.DB.Close()
+		return nil, err
+	}
+
+	return &database, nil
+}
+
+// bring the schema up to date and prepare statements
+func (database *Database) init(parentCtx context.Context) error {
+	var err error
+
+	// make sure database is working
+	ctx, cancel := context.WithDeadline(parentCtx, time.Now().Add(time.Second*3))
+	defer cancel()
+	err = database.DB.PingContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = context.WithDeadline(parentCtx, time.Now().Add(time.Second*15))
+	defer cancel()
+	err = database.migrate(ctx)
+	if err != nil {
+		return err
+	}
+
+	// statements need the table to exist
+	err = database.prepareStatements()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// clear failed uploads, zero out consumers, index the root directory, and collect garbage, all of which only a server starting up may do
+func (database *Database) cleanUp(parentCtx context.Context) error {
+	var err error
+
 	// clear failed uploads and zero out consumers
 	{
 		var tx *sql.Tx
 		var rows *sql.Rows
 
-		ctx, _ := context.WithDeadline(parentCtx, time.Now().Add(3*time.Minute))
-		tx, err = DB.BeginTx(ctx, nil)
+		ctx, cancel := context.WithDeadline(parentCtx, time.Now().Add(3*time.Minute))
+		defer cancel()
+		tx, err = database.DB.BeginTx(ctx, nil)
 		if err != nil {
 			return err
 		}
@@ -180,7 +369,7 @@ func DatabaseInit() error {
 		}
 		defer rows.Close()
 		var model = newFileModel()
-		err = model.deleteFiles(ctx, rows)
+		err = model.deleteFiles(ctx, database.Directory, rows)
 		if err != nil {
 			_ = tx.Rollback()
 			return err
@@ -205,7 +394,15 @@ func DatabaseInit() error {
 		}
 	}
 
-	err = deleteOutOfDateGlobally()
+	// serve files that were put in the root directory some other way than by an upload
+	ctx, cancel := context.WithDeadline(parentCtx, time.Now().Add(3*time.Minute))
+	defer cancel()
+	err = database.logIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = database.GarbageCollect(ctx)
 	if err != nil {
 		return err
 	}
@@ -213,31 +410,562 @@ func DatabaseInit() error {
 	return nil
 }
 
-// listen for requests to terminate from parent and clear out-of-date files not being requested
-func DatabaseRoutine(childToParent chan<- Signal, parentToChild <-chan Signal) {
-	//var err error
+// prepare the statements sessions use
+func (database *Database) prepareStatements() error {
+	var err error
 
-	Log <- NewNormalEvent("DATABASE", fmt.Sprintf("Database ready for access: %v", Cfg.Sqlite3DBPath))
+	// Find the completed row with a matching filename that was served last, whether by completing or being promoted, returning that row. The only parameter is filename.
+	database.ReserveStatementSelect, err = database.DB.Prepare(`SELECT * FROM files WHERE
+        filename = ? AND
+        uploadCompleted != 0
+        ORDER BY MAX(uploadCompleted, promoted) DESC
+        LIMIT 1;`)
+	if err != nil {
+		return err
+	}
 
-	for true {
-		select {
-		case sig := <-parentToChild:
-			childToParent <- NewSignal(sig.Kind, SignalAccept)
+	// Increment the number of consumers attached to the row that was found. The only parameters are filename and uploadStarted.
+	database.ReserveStatementUpdate, err = database.DB.Prepare(`UPDATE files SET consumers = consumers + 1 WHERE
+        filename = ? AND
+        uploadStarted = ?;`)
+	if err != nil {
+		return err
+	}
+
+	// Find all completed rows with this filename last served first, the retention policy decides which out of date ones are deleted. The only parameter is filename.
+	database.ReleaseStatementSelect, err = database.DB.Prepare(`SELECT * FROM files WHERE
+            filename = ? AND
+            uploadCompleted != 0
+            ORDER BY MAX(uploadCompleted, promoted) DESC;`)
+	if err != nil {
+		return err
+	}
+
+	// Decrement if greater than 0 the number of consumers attached to the row with a matching filename and the associated uploadStarted value. The only parameters are filename and uploadStarted time.
+	database.ReleaseStatementUpdate, err = database.DB.Prepare(`UPDATE files SET consumers = consumers - 1 WHERE
+        consumers != 0 AND
+        filename = ? AND
+        uploadStarted = ?;`)
+	if err != nil {
+		return err
+	}
+
+	// Clear a version the retention policy no longer keeps unless someone started reading it. Parameters are filename and uploadStarted.
+	database.ReleaseStatementDelete, err = database.DB.Prepare(`DELETE FROM files WHERE
+        consumers == 0 AND
+        uploadCompleted != 0 AND
+        filename = ? AND
+        uploadStarted = ?;`)
+	if err != nil {
+		return err
+	}
+
+	// Create entry for filename at uploadedStarted where those are the parameters. uploadCompleted and consumers are 0 by default.
+	database.PrepareStatement, err = database.DB.Prepare(`INSERT INTO files(filename, uploadStarted, uploadCompleted, consumers) VALUES (?, ?, 0, 0);`)
+	if err != nil {
+		return err
+	}
+
+	// Delete row created at the beginning of the upload because it failed. Parameters are filename and uploadStarted.
+	database.OverwriteFailureStatement, err = database.DB.Prepare(`DELETE FROM files WHERE filename = ? AND uploadStarted = ?;`)
+	if err != nil {
+		return err
+	}
+
+	// Find all completed rows with this filename last served first, the retention policy decides which out of date ones are deleted. The only parameter is filename.
+	database.OverwriteSuccessSelect, err = database.DB.Prepare(`SELECT * FROM files WHERE
+            filename = ? AND
+            uploadCompleted != 0
+            ORDER BY MAX(uploadCompleted, promoted) DESC;`)
+	if err != nil {
+		return err
+	}
+
+	// Update row created at the beginning of the upload to reflect its success. Parameters are uploadCompleted, size, filename, and uploadStarted.
+	database.OverwriteSuccessUpdate, err = database.DB.Prepare(`UPDATE files SET uploadCompleted = ?, size = ? WHERE filename = ? AND uploadStarted = ?;`)
+	if err != nil {
+		return err
+	}
+
+	// Clear a version the retention policy no longer keeps unless someone started reading it. Parameters are filename and uploadStarted.
+	database.OverwriteSuccessDelete, err = database.DB.Prepare(`DELETE FROM files WHERE
+        consumers == 0 AND
+        uploadCompleted != 0 AND
+        filename = ? AND
+        uploadStarted = ?;`)
+	if err != nil {
+		return err
+	}
 
-			// try to clear before exiting
-			_ = deleteOutOfDateGlobally()
-			return
-			// If reads and writes by sessions themselves delete out of date files then we do not need this routine to lock and scan the entire files tables
+	return nil
+}
+
+// clear out-of-date files nobody is reading then close the database
+func (database *Database) Close() error {
+	if database.attached {
+		return database.DB.Close()
+	}
+
+	// try to clear before exiting
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(3*time.Minute))
+	defer cancel()
+	_ = database.GarbageCollect(ctx)
+
+	err := database.DB.Close()
+	database.lock.release()
+
+	return err
+}
+
+// a version of a file reserved for reading, closing it releases the reservation
+type storedVersion struct {
+	*os.File
+	ctx      context.Context
+	database *Database
+	model    fileModel
+}
+
+// a version of a file being uploaded, committing it makes it the version that is served
+type storedUpload struct {
+	*os.File
+	ctx      context.Context
+	database *Database
+	model    fileModel
+}
+
+// open the newest version of the file and increment consumers attached to it
+func (database *Database) OpenLatest(ctx context.Context, filename string) (StoredReader, error) {
+	var version storedVersion = storedVersion{ctx: ctx, database: database, model: newFileModel()}
+
+	// Acquire write lock on global map
+	tx, err := database.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := tx.Stmt(database.ReserveStatementSelect)
+	row := stmt.QueryRow(filename)
+	err = version.model.scanRow(row)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, fileError(err, filename)
+	}
+
+	stmt = tx.Stmt(database.ReserveStatementUpdate)
+	_, err = stmt.Exec(filename, version.model.timeStarted)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return version.open()
+}
+
+// open the completed version of the file started at started and increment consumers attached to it
+func (database *Database) OpenVersion(ctx context.Context, filename string, started int64) (StoredReader, error) {
+	var version storedVersion = storedVersion{ctx: ctx, database: database, model: newFileModel()}
+
+	tx, err := database.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return nil, err
+	}
+
+	row := tx.QueryRowContext(ctx, `SELECT * FROM files WHERE filename = ? AND uploadStarted = ? AND uploadCompleted != 0;`, filename, started)
+	err = version.model.scanRow(row)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, fileError(err, filename)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE files SET consumers = consumers + 1 WHERE filename = ? AND uploadStarted = ?;`, filename, started)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return version.open()
+}
+
+// open the file of a version that was just reserved, releasing the reservation on failure
+func (version *storedVersion) open() (StoredReader, error) {
+	var err error
 
-			/*
-				case <-time.After(15 * time.Minute):
-					err = deleteOutOfDateGlobally()
-					if err != nil {
-						childToParent <- NewSignal(SignalTerminate, SignalRequest)
-						<-parentToChild
-						return
-					}
-			*/
+	version.File, err = version.database.Directory.Open(version.model.Path())
+	if err != nil {
+		version.release()
+		return nil, fileError(err, version.model.filename)
+	}
+
+	return version, nil
+}
+
+func (version *storedVersion) Version() Version {
+	return version.model.version()
+}
+
+// close file and decrement consumers attached to that file
+func (version *storedVersion) Close() error {
+	version.File.Close()
+
+	return version.release()
+}
+
+// decrement consumers and clear out-of-date versions of the file nobody is reading that are not retained
+func (version *storedVersion) release() error {
+	var database *Database = version.database
+	var stmt *sql.Stmt
+
+	tx, err := database.DB.BeginTx(version.ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return err
+	}
+
+	stmt = tx.Stmt(database.ReleaseStatementUpdate)
+	_, err = stmt.Exec(version.model.filename, version.model.timeStarted)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = database.deleteExpired(version.ctx, tx, database.ReleaseStatementSelect, database.ReleaseStatementDelete, version.model.filename)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// inform database we want to begin writing a version of the file and get a time attached to it
+func (database *Database) BeginUpload(ctx context.Context, filename string) (Upload, error) {
+	upload, err := database.prepare(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	upload.File, err = database.Directory.Create(upload.model.Path())
+	if errors.Is(err, os.ErrNotExist) && database.createDirectories {
+		err = database.Directory.MkdirAll(path.Dir(upload.model.Path()), 0755)
+		if err == nil {
+			upload.File, err = database.Directory.Create(upload.model.Path())
+		}
+	}
+	if err != nil {
+		upload.forget()
+		return nil, fileError(err, filename)
+	}
+
+	return upload, nil
+}
+
+// add the row for a new version of filename that is not yet completed
+func (database *Database) prepare(ctx context.Context, filename string) (*storedUpload, error) {
+	var upload storedUpload = storedUpload{ctx: ctx, database: database}
+
+	tx, err := database.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return nil, err
+	}
+	unixMicro := time.Now().UnixMicro()
+	stmt := tx.Stmt(database.PrepareStatement)
+	_, err = stmt.Exec(filename, unixMicro)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	upload.model = newFileModelWith(filename, unixMicro, 0, 0)
+	return &upload, nil
+}
+
+// inform database client succesfully uploaded entire file, mark it as available
+func (upload *storedUpload) Commit() error {
+	err := upload.File.Close()
+	if err != nil {
+		upload.forget()
+		return err
+	}
+
+	return upload.complete()
+}
+
+// mark the version as the newest and delete the out-of-date versions of the file nobody is reading that are not retained
+func (upload *storedUpload) complete() error {
+	var database *Database = upload.database
+	var err error
+
+	// recorded so that a file truncated after a crash can be told apart from a short upload
+	info, err := database.Directory.Stat(upload.model.Path())
+	if err != nil {
+		return fileError(err, upload.model.filename)
+	}
+
+	tx, err := database.DB.BeginTx(upload.ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return err
+	}
+
+	// a version promoted within the last moment must not outlast the upload replacing it
+	var newest int64
+	err = tx.QueryRowContext(upload.ctx, `SELECT COALESCE(MAX(MAX(uploadCompleted, promoted)), 0) FROM files WHERE filename = ?;`, upload.model.filename).Scan(&newest)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	stmt := tx.Stmt(database.OverwriteSuccessUpdate)
+	uploadCompleted := max(time.Now().UnixMicro(), newest+1)
+	result, err := stmt.Exec(uploadCompleted, info.Size(), upload.model.filename, upload.model.timeStarted)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	// the row is gone when something deleted the upload as failed, the file it points at is no longer ours to serve
+	if updated, err := result.RowsAffected(); err != nil || updated != 1 {
+		_ = tx.Rollback()
+		_ = database.Directory.Remove(upload.model.Path())
+		return fmt.Errorf("Upload of %v was deleted before it completed", upload.model.filename)
+	}
+
+	err = database.deleteExpired(upload.ctx, tx, database.OverwriteSuccessSelect, database.OverwriteSuccessDelete, upload.model.filename)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// inform database the upload failed so the partial file is never served
+func (upload *storedUpload) Abort() error {
+	if upload.File != nil {
+		upload.File.Close()
+	}
+
+	return upload.forget()
+}
+
+// delete the row and file created at the beginning of the upload
+func (upload *storedUpload) forget() error {
+	var database *Database = upload.database
+
+	tx, err := database.DB.BeginTx(upload.ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return err
+	}
+	stmt := tx.Stmt(database.OverwriteFailureStatement)
+	_, err = stmt.Exec(upload.model.filename, upload.model.timeStarted)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = database.Directory.Remove(upload.model.Path())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * Register the file name put in the root directory some other way than by an upload as the newest version of itself.
+ * The file is moved into place and completed just like an upload, so readers of older versions keep their reservations.
+ */
+func (database *Database) Adopt(ctx context.Context, name string) (Version, error) {
+	upload, err := database.prepare(ctx, name)
+	if err != nil {
+		return Version{}, err
+	}
+
+	err = database.Directory.Rename(name, upload.model.Path())
+	if err != nil {
+		upload.forget()
+		return Version{}, fileError(err, name)
+	}
+
+	err = upload.complete()
+	if err != nil {
+		// leave the file where it was found rather than lose it along with the row
+		_ = database.Directory.Rename(upload.model.Path(), name)
+		upload.forget()
+		return Version{}, err
+	}
+
+	return Version{Filename: name, Started: upload.model.timeStarted}, nil
+}
+
+/*
+ * Make the completed version of filename started at started the one that is served by recording when it was promoted.
+ * Readers of the version it replaces keep their reservations and that version is kept as the previous one,
+ * so promoting it in turn undoes this. When each version completed is left as it was.
+ */
+func (database *Database) Promote(ctx context.Context, filename string, started int64) (Version, error) {
+	return database.promote(ctx, filename, `SELECT * FROM files WHERE filename = ? AND uploadStarted = ? AND uploadCompleted != 0;`, filename, started)
+}
+
+// promote the version of filename that was served before the current one
+func (database *Database) Rollback(ctx context.Context, filename string) (Version, error) {
+	return database.promote(ctx, filename, `SELECT * FROM files WHERE filename = ? AND uploadCompleted != 0 ORDER BY MAX(uploadCompleted, promoted) DESC LIMIT 1 OFFSET 1;`, filename)
+}
+
+// promote the version of filename selected by query in one transaction
+func (database *Database) promote(ctx context.Context, filename string, query string, args ...any) (Version, error) {
+	var model fileModel = newFileModel()
+	var newest int64
+
+	tx, err := database.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return Version{}, err
+	}
+
+	err = model.scanRow(tx.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		_ = tx.Rollback()
+		return Version{}, fileError(err, filename)
+	}
+	err = tx.QueryRowContext(ctx, `SELECT MAX(MAX(uploadCompleted, promoted)) FROM files WHERE filename = ?;`, filename).Scan(&newest)
+	if err != nil {
+		_ = tx.Rollback()
+		return Version{}, err
+	}
+
+	// the version becomes the last one served without changing which version it is
+	// versions that are now out of date are left for the server to delete, only it knows the retention policy
+	if model.version().Served() != newest {
+		model.timePromoted = max(time.Now().UnixMicro(), newest+1)
+		_, err = tx.ExecContext(ctx, `UPDATE files SET promoted = ? WHERE filename = ? AND uploadStarted = ?;`, model.timePromoted, model.filename, model.timeStarted)
+		if err != nil {
+			_ = tx.Rollback()
+			return Version{}, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Version{}, err
+	}
+
+	return model.version(), nil
+}
+
+// every file with a version, including ones only being uploaded, sorted by name
+func (database *Database) Filenames(ctx context.Context) ([]string, error) {
+	var filenames []string
+
+	rows, err := database.DB.QueryContext(ctx, `SELECT DISTINCT filename FROM files ORDER BY filename;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var filename string
+		err = rows.Scan(&filename)
+		if err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+	}
+
+	return filenames, rows.Err()
+}
+
+// the file the version is kept in
+func (database *Database) Stat(version Version) (os.FileInfo, error) {
+	return database.Directory.Stat(version.Path())
+}
+
+/*
+ * Delete the completed version of filename started at started, or every completed version of it when started is 0.
+ * Nothing is deleted when one of them is being read, uploads in progress are left alone.
+ * When the newest version is deleted the one before it is served again.
+ */
+func (database *Database) Remove(ctx context.Context, filename string, started int64) ([]Version, error) {
+	var model fileModel = newFileModel()
+	var removed []Version
+
+	tx, err := database.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT * FROM files WHERE filename = ? AND uploadCompleted != 0 AND (? = 0 OR uploadStarted = ?) ORDER BY uploadStarted;`, filename, started, started)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	for rows.Next() {
+		err = model.scanRows(rows)
+		if err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return nil, err
 		}
+		removed = append(removed, model.version())
 	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if len(removed) == 0 {
+		_ = tx.Rollback()
+		return nil, newError(ErrNotFound, filename)
+	}
+
+	for _, version := range removed {
+		if version.Consumers != 0 {
+			_ = tx.Rollback()
+			return nil, fmt.Errorf("Version %v is being read", version.Path())
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM files WHERE filename = ? AND uploadStarted = ?;`, version.Filename, version.Started)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	// files go only once nobody can reserve them again
+	for _, version := range removed {
+		err = database.Directory.Remove(version.Path())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+	}
+
+	return removed, nil
 }
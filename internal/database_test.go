@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestPromote(t *testing.T) {
+	ctx := context.Background()
+	database := testStores(t, nil)["database"].(*Database)
+
+	for _, contents := range []string{"first", "second", "bad"} {
+		upload(t, database, "kernel", contents)
+	}
+	versions, _ := database.Versions(ctx, "kernel")
+	if len(versions) != 2 {
+		t.Fatalf("Versions %+v instead of the newest and the one before it\n", versions)
+	}
+	reader, err := database.OpenLatest(ctx, "kernel")
+	if err != nil {
+		t.Fatalf("Unable to open kernel: %v\n", err)
+	}
+
+	// rolling back serves the previous version while the reader keeps the bad one
+	version, err := database.Rollback(ctx, "kernel")
+	if err != nil || version.Started != versions[0].Started {
+		t.Fatalf("Rolled back to %+v %v instead of %+v\n", version, err, versions[0])
+	}
+	latest, err := database.OpenLatest(ctx, "kernel")
+	if err != nil {
+		t.Fatalf("Unable to open kernel: %v\n", err)
+	}
+	if contents := readAllStored(t, latest); contents != "second" {
+		t.Fatalf("Serving %q after rolling back\n", contents)
+	}
+	latest.Close()
+	if contents := readAllStored(t, reader); contents != "bad" {
+		t.Fatalf("Reserved version became %q\n", contents)
+	}
+
+	// rolling back again undoes it and promoting the current version changes nothing
+	if version, err = database.Rollback(ctx, "kernel"); err != nil || version.Started != versions[1].Started {
+		t.Fatalf("Rolled back to %+v %v instead of %+v\n", version, err, versions[1])
+	}
+	if again, err := database.Promote(ctx, "kernel", versions[1].Started); err != nil || again != version {
+		t.Fatalf("Promoting the current version returned %+v %v instead of %+v\n", again, err, version)
+	}
+	if _, err = database.Promote(ctx, "kernel", 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Promoting a missing version returned %v instead of %v\n", err, ErrNotFound)
+	}
+
+	// promoting records when it happened and leaves when each version completed alone
+	promoted, _ := database.Versions(ctx, "kernel")
+	for i, version := range promoted {
+		if version.Completed != versions[i].Completed || version.Promoted == 0 {
+			t.Fatalf("Versions after promoting %+v, before %+v\n", promoted, versions)
+		}
+	}
+
+	// an upload is served over a promoted version, which is kept as the one before it
+	reader.Close()
+	upload(t, database, "kernel", "fixed")
+	if err = database.GarbageCollect(ctx); err != nil {
+		t.Fatalf("Unable to collect garbage: %v\n", err)
+	}
+	latest, err = database.OpenLatest(ctx, "kernel")
+	if err != nil {
+		t.Fatalf("Unable to open kernel: %v\n", err)
+	}
+	if contents := readAllStored(t, latest); contents != "fixed" {
+		t.Fatalf("Serving %q after uploading over a promoted version\n", contents)
+	}
+	latest.Close()
+	if kept, _ := database.Versions(ctx, "kernel"); len(kept) != 2 || kept[0].Started != versions[1].Started {
+		t.Fatalf("Versions after uploading over a promoted version %+v\n", kept)
+	}
+
+	upload(t, database, "initrd", "only")
+	if _, err = database.Rollback(ctx, "initrd"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Rolling back the only version returned %v instead of %v\n", err, ErrNotFound)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	ctx := context.Background()
+	database := testStores(t, nil)["database"].(*Database)
+
+	for _, contents := range []string{"first", "second"} {
+		upload(t, database, "kernel", contents)
+	}
+	upload(t, database, "initrd", "only")
+	if filenames, err := database.Filenames(ctx); err != nil || !slices.Equal(filenames, []string{"initrd", "kernel"}) {
+		t.Fatalf("Filenames %v %v\n", filenames, err)
+	}
+	versions, _ := database.Versions(ctx, "kernel")
+
+	// deleting the newest version serves the one before it again
+	removed, err := database.Remove(ctx, "kernel", versions[1].Started)
+	if err != nil || len(removed) != 1 || removed[0].Started != versions[1].Started {
+		t.Fatalf("Removed %+v %v instead of %+v\n", removed, err, versions[1])
+	}
+	if _, err = database.Stat(versions[1]); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("File of removed version left behind: %v\n", err)
+	}
+	latest, err := database.OpenLatest(ctx, "kernel")
+	if err != nil {
+		t.Fatalf("Unable to open kernel: %v\n", err)
+	}
+	if contents := readAllStored(t, latest); contents != "first" {
+		t.Fatalf("Serving %q after removing the newest version\n", contents)
+	}
+
+	// versions being read are never deleted
+	if _, err = database.Remove(ctx, "kernel", 0); err == nil {
+		t.Fatalf("Removed a version being read\n")
+	}
+	latest.Close()
+	if removed, err = database.Remove(ctx, "kernel", 0); err != nil || len(removed) != 1 {
+		t.Fatalf("Removed %+v %v instead of every version\n", removed, err)
+	}
+	if _, err = database.OpenLatest(ctx, "kernel"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Opening a removed file returned %v instead of %v\n", err, ErrNotFound)
+	}
+	if _, err = database.Remove(ctx, "kernel", 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Removing a removed file returned %v instead of %v\n", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// marks the files uploads are written to until they are committed, .filename.tftpcpd-upload-<unixMicro>
+const uploadMarker = ".tftpcpd-upload-"
+
+// whether name is where an upload to a DirectoryStore is written before being committed
+func isUploadName(name string) bool {
+	name = path.Base(name)
+
+	return strings.HasPrefix(name, ".") && strings.Contains(name, uploadMarker)
+}
+
+/*
+ * A Store serving the files in the root directory under their real names, the way tftp-hpa lays them out,
+ * so that other tools reading the root directory keep working. No sqlite database is opened.
+ * Uploads are written next to the file they replace and renamed over it once committed,
+ * so readers get either the old or the new file but never part of one.
+ * Only the newest version is kept, readers that opened the old one keep reading it until they close it.
+ * Create with OpenDirectoryStore.
+ */
+type DirectoryStore struct {
+	Directory *os.Root
+
+	log chan<- logEvent
+	// create missing parent directories of uploads
+	createDirectories bool
+
+	// guards everything below
+	lock sync.Mutex
+	// names of the uploads in progress
+	uploads map[string]bool
+	// last time handed out to an upload so that every upload has its own
+	lastStarted int64
+}
+
+// serve the files in cfg.Directory as they are, removing uploads left behind by a server that stopped while receiving them
+func OpenDirectoryStore(cfg *Config, log chan<- logEvent) (*DirectoryStore, error) {
+	var store DirectoryStore = DirectoryStore{Directory: cfg.Directory, log: log, createDirectories: cfg.CreateDirectories, uploads: make(map[string]bool)}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(3*time.Minute))
+	defer cancel()
+	err := store.GarbageCollect(ctx)
+	if err != nil {
+		log <- NewErrorEvent("DIRECTORY", fmt.Sprintf("Unable to clear failed uploads: %v", err))
+		return nil, err
+	}
+
+	log <- NewNormalEvent("DIRECTORY", fmt.Sprintf("Serving files as they are in: %v", cfg.Directory.Name()))
+
+	return &store, nil
+}
+
+// open filename as it is right now, it is the only version there is
+func (store *DirectoryStore) OpenLatest(ctx context.Context, filename string) (StoredReader, error) {
+	if isUploadName(filename) {
+		return nil, newError(ErrNotFound, filename)
+	}
+
+	file, err := store.Directory.Open(filename)
+	if err != nil {
+		return nil, fileError(err, filename)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, newError(ErrNotFound, filename)
+	}
+
+	return &directoryReader{File: file, version: directoryVersion(filename, info)}, nil
+}
+
+// open filename only if it has not changed since started, its modification time
+func (store *DirectoryStore) OpenVersion(ctx context.Context, filename string, started int64) (StoredReader, error) {
+	reader, err := store.OpenLatest(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Version().Started != started {
+		reader.Close()
+		return nil, newError(ErrNotFound, filename)
+	}
+
+	return reader, nil
+}
+
+// write a new file next to filename that replaces it once committed
+func (store *DirectoryStore) BeginUpload(ctx context.Context, filename string) (Upload, error) {
+	if isUploadName(filename) {
+		return nil, newError(ErrAccessViolation, filename)
+	}
+
+	store.lock.Lock()
+	started := max(time.Now().UnixMicro(), store.lastStarted+1)
+	store.lastStarted = started
+	name := path.Join(path.Dir(filename), "."+path.Base(filename)+uploadMarker+strconv.FormatInt(started, 10))
+	store.uploads[name] = true
+	store.lock.Unlock()
+
+	file, err := store.Directory.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrNotExist) && store.createDirectories {
+		err = store.Directory.MkdirAll(path.Dir(name), 0755)
+		if err == nil {
+			file, err = store.Directory.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		}
+	}
+	if err != nil {
+		store.forget(name)
+		return nil, fileError(err, filename)
+	}
+
+	return &directoryUpload{File: file, store: store, filename: filename, name: name}, nil
+}
+
+// the file as it is right now followed by the uploads in progress that will replace it
+func (store *DirectoryStore) Versions(ctx context.Context, filename string) ([]Version, error) {
+	var versions []Version
+
+	info, err := store.Directory.Stat(filename)
+	if err == nil && info.Mode().IsRegular() {
+		versions = append(versions, directoryVersion(filename, info))
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	prefix := path.Join(path.Dir(filename), "."+path.Base(filename)+uploadMarker)
+	for name := range store.uploads {
+		started, err := strconv.ParseInt(strings.TrimPrefix(name, prefix), 10, 64)
+		if strings.HasPrefix(name, prefix) && err == nil {
+			versions = append(versions, Version{Filename: filename, Started: started, Size: -1})
+		}
+	}
+	slices.SortFunc(versions, func(a, b Version) int { return cmp.Compare(a.Started, b.Started) })
+
+	return versions, nil
+}
+
+// remove uploads that are not in progress, anything else is only ever replaced
+func (store *DirectoryStore) GarbageCollect(ctx context.Context) error {
+	return fs.WalkDir(store.Directory.FS(), ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if !entry.Type().IsRegular() || !isUploadName(name) {
+			return nil
+		}
+
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		if store.uploads[name] {
+			return nil
+		}
+		err = store.Directory.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		store.log <- NewNormalEvent("DIRECTORY", fmt.Sprintf("Removed failed upload: %v", name))
+
+		return nil
+	})
+}
+
+// nothing to clean up, the files are the store
+func (store *DirectoryStore) Close() error {
+	return nil
+}
+
+// stop tracking the upload written to name
+func (store *DirectoryStore) forget(name string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.uploads, name)
+}
+
+// files have no history, the modification time stands in for when the upload started and completed
+func directoryVersion(filename string, info fs.FileInfo) Version {
+	return Version{Filename: filename, Started: info.ModTime().UnixMicro(), Completed: info.ModTime().UnixMicro(), Size: info.Size()}
+}
+
+type directoryReader struct {
+	*os.File
+	version Version
+}
+
+func (reader *directoryReader) Version() Version {
+	return reader.version
+}
+
+type directoryUpload struct {
+	*os.File
+	store *DirectoryStore
+	// what the upload replaces once committed
+	filename string
+	// where the upload is written until then
+	name string
+	done bool
+}
+
+// replace the file with the upload in one rename
+func (upload *directoryUpload) Commit() error {
+	if upload.done {
+		return errors.New("Upload already finished")
+	}
+	upload.done = true
+	defer upload.store.forget(upload.name)
+
+	// make sure the contents are on disk before the rename can be
+	err := upload.File.Sync()
+	if err == nil {
+		err = upload.File.Close()
+	} else {
+		upload.File.Close()
+	}
+	if err == nil {
+		err = upload.store.Directory.Rename(upload.name, upload.filename)
+	}
+	if err != nil {
+		_ = upload.store.Directory.Remove(upload.name)
+		return fileError(err, upload.filename)
+	}
+
+	return nil
+}
+
+func (upload *directoryUpload) Abort() error {
+	if upload.done {
+		return errors.New("Upload already finished")
+	}
+	upload.done = true
+	defer upload.store.forget(upload.name)
+
+	upload.File.Close()
+	err := upload.store.Directory.Remove(upload.name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestDirectoryStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"kernel": "as it was", ".kernel" + uploadMarker + "1700000000000000": "left behind"} {
+		if err := os.WriteFile(dir+"/"+name, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write %v: %v\n", name, err)
+		}
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatalf("Unable to open root: %v\n", err)
+	}
+	t.Cleanup(func() { root.Close() })
+
+	store, err := OpenDirectoryStore(&Config{Directory: root}, discardLog(t))
+	if err != nil {
+		t.Fatalf("Unable to open store: %v\n", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	// files are served as they are and failed uploads are removed
+	kernel, err := store.OpenLatest(ctx, "kernel")
+	if err != nil {
+		t.Fatalf("Unable to open kernel: %v\n", err)
+	}
+	if contents := readAllStored(t, kernel); contents != "as it was" {
+		t.Fatalf("kernel is %q\n", contents)
+	}
+	kernel.Close()
+
+	upload(t, store, "config", "first")
+	old, err := store.OpenLatest(ctx, "config")
+	if err != nil {
+		t.Fatalf("Unable to open first version: %v\n", err)
+	}
+	defer old.Close()
+
+	// uploads are written somewhere nobody can read them from until committed
+	pending, err := store.BeginUpload(ctx, "config")
+	if err != nil {
+		t.Fatalf("Unable to begin upload: %v\n", err)
+	}
+	io.WriteString(pending, "second")
+	versions, _ := store.Versions(ctx, "config")
+	if len(versions) != 2 || versions[0].Started != old.Version().Started || versions[1].Completed != 0 {
+		t.Fatalf("Versions during upload %+v\n", versions)
+	}
+	pendingName := ".config" + uploadMarker + strconv.FormatInt(versions[1].Started, 10)
+	if _, err = store.OpenLatest(ctx, pendingName); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Opening upload in progress returned %v instead of %v\n", err, ErrNotFound)
+	}
+	if _, err = store.BeginUpload(ctx, pendingName); !errors.Is(err, ErrAccessViolation) {
+		t.Fatalf("Uploading to an upload in progress returned %v instead of %v\n", err, ErrAccessViolation)
+	}
+	if err = store.GarbageCollect(ctx); err != nil {
+		t.Fatalf("Unable to collect garbage: %v\n", err)
+	}
+	if err = pending.Commit(); err != nil {
+		t.Fatalf("Unable to commit: %v\n", err)
+	}
+
+	// a reader keeps the file it opened after it is replaced
+	if contents := readAllStored(t, old); contents != "first" {
+		t.Fatalf("Replaced file became %q\n", contents)
+	}
+	latest, err := store.OpenLatest(ctx, "config")
+	if err != nil {
+		t.Fatalf("Unable to open second version: %v\n", err)
+	}
+	defer latest.Close()
+	if contents := readAllStored(t, latest); contents != "second" {
+		t.Fatalf("Latest version is %q\n", contents)
+	}
+	if again, err := store.OpenVersion(ctx, "config", latest.Version().Started); err != nil {
+		t.Fatalf("Unable to open latest version again: %v\n", err)
+	} else {
+		again.Close()
+	}
+
+	// nothing but the files themselves is left in the root directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Unable to list root: %v\n", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !slices.Equal(names, []string{"config", "kernel"}) {
+		t.Fatalf("Root directory holds %v\n", names)
+	}
+	if contents, _ := os.ReadFile(dir + "/config"); string(contents) != "second" {
+		t.Fatalf("config on disk is %q\n", contents)
+	}
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+/*
+ * Failures that RFC 1350 and RFC 2347 give an error code of their own.
+ * Wrap one with newError to add details while keeping the code:
+ * errors.Is(newError(ErrNotFound, "kernel.bin"), ErrNotFound) == true
+ * Anything not wrapping one of these is reported as ErrorCodeUndefined.
+ */
+var ErrNotFound = &TftpError{ErrorCodeNoSuchFile, "File not found", false}
+var ErrAccessViolation = &TftpError{ErrorCodeAccessViolation, "Access violation", false}
+var ErrDiskFull = &TftpError{ErrorCodeTooMuchData, "Disk full or allocation exceeded", false}
+var ErrIllegalOperation = &TftpError{ErrorCodeIllegalOperation, "Illegal TFTP operation", false}
+var ErrUnknownTransferId = &TftpError{ErrorCodeUnknownTransferId, "Unknown transfer ID", false}
+var ErrFileExists = &TftpError{ErrorCodeFileAlreadyExists, "File already exists", false}
+var ErrOptionRefused = &TftpError{ErrorCodeOptionAcknowledgeSurprise, "Option negotiation refused", false}
+
+type TftpError struct {
+	Code    uint16
+	Message string
+
+	// set when the error was sent by the other side rather than found here
+	Remote bool
+}
+
+func (err *TftpError) Error() string {
+	return err.Message
+}
+
+// errors with the same code belong to the same category no matter where they came from
+func (err *TftpError) Is(target error) bool {
+	other, ok := target.(*TftpError)
+	return ok && other.Code == err.Code && err.Code != ErrorCodeUndefined
+}
+
+// wrap category with a more detailed description, the result reads "category: details"
+func newError(category *TftpError, details string) error {
+	return fmt.Errorf("%w: %v", category, details)
+}
+
+// the error sent by the other side in message
+func errorFromMessage(message *ErrorMessage) error {
+	return &TftpError{message.ErrorCode, message.Explanation, true}
+}
+
+// TFTP error code describing err, ErrorCodeUndefined if err does not belong to a category
+func ErrorCode(err error) uint16 {
+	var tftpError *TftpError
+	if errors.As(err, &tftpError) {
+		return tftpError.Code
+	}
+
+	return ErrorCodeUndefined
+}
+
+// whether err was sent by the other side, errors are never answered with errors
+func isRemoteError(err error) bool {
+	var tftpError *TftpError
+	return errors.As(err, &tftpError) && tftpError.Remote
+}
+
+// put a failure to find, open, create or write filename into the category it belongs to
+func fileError(err error, filename string) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, sql.ErrNoRows):
+		return newError(ErrNotFound, filename)
+	case errors.Is(err, fs.ErrPermission):
+		return newError(ErrAccessViolation, filename)
+	case errors.Is(err, fs.ErrExist):
+		return newError(ErrFileExists, filename)
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, syscall.EFBIG):
+		return newError(ErrDiskFull, filename)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"syscall"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		code uint16
+	}{
+		{newError(ErrNotFound, "kernel.bin"), ErrorCodeNoSuchFile},
+		{newError(ErrOptionRefused, "Invalid blksize value 7"), ErrorCodeOptionAcknowledgeSurprise},
+		{fileError(fs.ErrNotExist, "kernel.bin"), ErrorCodeNoSuchFile},
+		{fileError(sql.ErrNoRows, "kernel.bin"), ErrorCodeNoSuchFile},
+		{fileError(fs.ErrPermission, "kernel.bin"), ErrorCodeAccessViolation},
+		{fileError(fs.ErrExist, "kernel.bin"), ErrorCodeFileAlreadyExists},
+		{fileError(syscall.ENOSPC, "kernel.bin"), ErrorCodeTooMuchData},
+		{fileError(errors.New("Something else"), "kernel.bin"), ErrorCodeUndefined},
+		{errors.New("Client connection (likely) dead"), ErrorCodeUndefined},
+	}
+
+	for _, c := range cases {
+		if code := ErrorCode(c.err); code != c.code {
+			t.Fatalf("ErrorCode(%v) = %v != %v\n", c.err, code, c.code)
+		}
+	}
+}
+
+func TestErrorCategories(t *testing.T) {
+	err := newError(ErrNotFound, "kernel.bin")
+	if err.Error() != "File not found: kernel.bin" {
+		t.Fatalf("%q != %q\n", err.Error(), "File not found: kernel.bin")
+	}
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrAccessViolation) {
+		t.Fatalf("%v placed in the wrong category\n", err)
+	}
+	if isRemoteError(err) {
+		t.Fatalf("%v mistaken for an error sent by the other side\n", err)
+	}
+
+	// errors sent by the other side belong to the category of their code
+	remote := errorFromMessage(&ErrorMessage{ErrorCodeNoSuchFile, "No such file"})
+	if !errors.Is(remote, ErrNotFound) || !isRemoteError(remote) {
+		t.Fatalf("%v placed in the wrong category\n", remote)
+	}
+
+	undefined := errorFromMessage(&ErrorMessage{ErrorCodeUndefined, "Something else"})
+	if errors.Is(undefined, &TftpError{ErrorCodeUndefined, "Other", false}) {
+		t.Fatalf("Undefined errors must not match each other\n")
+	}
+}
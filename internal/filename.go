@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * The path inside the root directory a client asked for with filename.
+ * Paths keep their directories and use forward slashes, backslashes sent by Windows clients are turned into them.
+ * Absolute paths and paths escaping the root directory are access violations.
+ */
+func cleanFilename(filename string) (string, error) {
+	slashed := strings.ReplaceAll(filename, `\`, "/")
+
+	// a drive letter makes a path absolute on Windows
+	if len(slashed) >= 2 && slashed[1] == ':' {
+		return "", newError(ErrAccessViolation, filename)
+	}
+	if path.IsAbs(slashed) {
+		return "", newError(ErrAccessViolation, filename)
+	}
+
+	cleaned := path.Clean(slashed)
+	if cleaned == "." || !filepath.IsLocal(filepath.FromSlash(cleaned)) {
+		return "", newError(ErrAccessViolation, filename)
+	}
+
+	return cleaned, nil
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCleanFilename(t *testing.T) {
+	cases := map[string]string{
+		"default":               `default`,
+		"pxelinux.cfg/default":  `pxelinux.cfg/default`,
+		`pxelinux.cfg\default`:  `pxelinux.cfg/default`,
+		"./boot//grub/grub.cfg": `boot/grub/grub.cfg`,
+		"boot/../pxelinux.0":    `pxelinux.0`,
+		"/etc/passwd":           "",
+		`\windows\win.ini`:      "",
+		`C:\boot.ini`:           "",
+		"../outside":            "",
+		`boot\..\..\outside`:    "",
+		".":                     "",
+		"boot/..":               "",
+	}
+
+	for filename, expected := range cases {
+		cleaned, err := cleanFilename(filename)
+		if expected == "" {
+			if !errors.Is(err, ErrAccessViolation) {
+				t.Fatalf("%q cleaned to %q %v instead of being an access violation\n", filename, cleaned, err)
+			}
+			continue
+		}
+		if err != nil || cleaned != expected {
+			t.Fatalf("%q cleaned to %q %v instead of %q\n", filename, cleaned, err, expected)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// where fsck moves files it can not account for, inside the root directory so that moving them is only a rename
+const quarantineDirectory = ".tftpcpd-quarantine"
+
+// what Config.Fsck asks a server to do to its database before serving
+const (
+	FsckCheck  = "check"
+	FsckRepair = "repair"
+)
+
+/*
+ * What checking the store found and whether it was repaired.
+ * Besides what Verify finds, rows left behind by a server that stopped without cleaning up are reported,
+ * which is only right while no server uses the database.
+ */
+type FsckReport struct {
+	VerifyReport
+	// completed versions still recorded as being read
+	StaleReservations []Version
+	// uploads that never completed
+	FailedUploads []Version
+	// where each file moved to the quarantine directory is now, keyed by where it was below the root directory
+	Quarantined map[string]string
+	// false when problems were only reported
+	Repaired bool
+}
+
+// how many things are wrong, unmanaged files are only waiting to be imported
+func (report FsckReport) Problems() int {
+	return report.VerifyReport.Problems() + len(report.StaleReservations) + len(report.FailedUploads)
+}
+
+/*
+ * Check every row against the root directory and, when repair is set, fix what was found.
+ * Stale reservations are released, failed uploads and rows without files are deleted,
+ * and truncated versions and files named like versions without a row are moved to .tftpcpd-quarantine in the root directory.
+ * Repairing refuses to start with ErrDatabaseInUse while a server uses the database, since its reservations and uploads in progress would look stale.
+ */
+func (database *Database) Fsck(ctx context.Context, repair bool) (FsckReport, error) {
+	var report FsckReport = FsckReport{Quarantined: make(map[string]string)}
+	var err error
+
+	// servers hold the lock while they use the database, their uploads and readers would be taken for stale ones
+	if repair && database.attached {
+		lock, err := acquireDatabaseLock(database.path)
+		if err != nil {
+			return report, fmt.Errorf("Unable to repair: %w", err)
+		}
+		defer lock.release()
+	}
+
+	report.VerifyReport, err = database.Verify(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	rows, err := database.rowsByPath(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, model := range rows {
+		if model.timeCompleted == 0 {
+			report.FailedUploads = append(report.FailedUploads, model.version())
+		} else if model.consumers != 0 {
+			report.StaleReservations = append(report.StaleReservations, model.version())
+		}
+	}
+	sortVersions(report.StaleReservations)
+	sortVersions(report.FailedUploads)
+
+	if !repair || report.Problems() == 0 {
+		return report, nil
+	}
+
+	tx, err := database.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return report, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE files SET consumers = 0 WHERE consumers != 0;`)
+	if err != nil {
+		_ = tx.Rollback()
+		return report, err
+	}
+	for _, versions := range [][]Version{report.FailedUploads, report.RowsWithoutFiles, report.Truncated} {
+		for _, version := range versions {
+			_, err = tx.ExecContext(ctx, `DELETE FROM files WHERE filename = ? AND uploadStarted = ?;`, version.Filename, version.Started)
+			if err != nil {
+				_ = tx.Rollback()
+				return report, err
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return report, err
+	}
+
+	// files are only touched once no row points at them
+	for _, version := range report.FailedUploads {
+		err = database.Directory.Remove(version.Path())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, err
+		}
+	}
+	var suspicious []string
+	for _, version := range report.Truncated {
+		suspicious = append(suspicious, version.Path())
+	}
+	for _, name := range append(suspicious, report.FilesWithoutRows...) {
+		quarantined, err := database.quarantine(name)
+		if err != nil {
+			return report, fmt.Errorf("Unable to quarantine %v: %w", name, err)
+		}
+		report.Quarantined[name] = quarantined
+	}
+	report.Repaired = true
+
+	return report, nil
+}
+
+// move name below the root directory into the quarantine directory, keeping the directories it was in
+func (database *Database) quarantine(name string) (string, error) {
+	destination := path.Join(quarantineDirectory, name)
+
+	err := database.Directory.MkdirAll(path.Dir(destination), 0755)
+	if err != nil {
+		return "", err
+	}
+	// never replace something quarantined before
+	if _, err = database.Directory.Lstat(destination); err == nil {
+		destination += "." + strconv.FormatInt(time.Now().UnixMicro(), 10)
+	}
+
+	return destination, database.Directory.Rename(name, destination)
+}
+
+// check or repair the database as a server starts and log what was found
+func (database *Database) logFsck(ctx context.Context, repair bool) error {
+	report, err := database.Fsck(ctx, repair)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range report.RowsWithoutFiles {
+		database.log <- NewErrorEvent("FSCK", fmt.Sprintf("Version %v has no file", version.Path()))
+	}
+	for _, version := range report.Truncated {
+		database.log <- NewErrorEvent("FSCK", fmt.Sprintf("Version %v is not the %v bytes recorded", version.Path(), version.Size))
+	}
+	for _, name := range report.FilesWithoutRows {
+		database.log <- NewErrorEvent("FSCK", fmt.Sprintf("File %v looks like a version but has no row", name))
+	}
+	for _, version := range report.StaleReservations {
+		database.log <- NewErrorEvent("FSCK", fmt.Sprintf("Version %v is still recorded as read by %v readers", version.Path(), version.Consumers))
+	}
+	for _, version := range report.FailedUploads {
+		database.log <- NewErrorEvent("FSCK", fmt.Sprintf("Upload %v never completed", version.Path()))
+	}
+	for name, quarantined := range report.Quarantined {
+		database.log <- NewNormalEvent("FSCK", fmt.Sprintf("Quarantined %v as %v", name, quarantined))
+	}
+
+	if report.Repaired {
+		database.log <- NewNormalEvent("FSCK", fmt.Sprintf("Repaired %v problems", report.Problems()))
+	} else {
+		database.log <- NewNormalEvent("FSCK", fmt.Sprintf("Found %v problems, nothing was changed", report.Problems()))
+	}
+
+	return nil
+}
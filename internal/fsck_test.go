@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	database := testStores(t, nil)["database"].(*Database)
+	root := database.Directory.Name()
+
+	upload(t, database, "kernel", "served")
+	upload(t, database, "initrd", "cut short")
+	upload(t, database, "lost", "gone")
+	if _, err := database.DB.ExecContext(ctx, `UPDATE files SET consumers = 3 WHERE filename = 'kernel';`); err != nil {
+		t.Fatalf("Unable to leave a reservation behind: %v\n", err)
+	}
+	if _, err := database.BeginUpload(ctx, "failed"); err != nil {
+		t.Fatalf("Unable to begin upload: %v\n", err)
+	}
+	initrd, _ := database.Versions(ctx, "initrd")
+	lost, _ := database.Versions(ctx, "lost")
+	if err := os.WriteFile(path.Join(root, initrd[0].Path()), []byte("cut"), 0644); err != nil {
+		t.Fatalf("Unable to truncate initrd: %v\n", err)
+	}
+	if err := os.Remove(path.Join(root, lost[0].Path())); err != nil {
+		t.Fatalf("Unable to remove lost: %v\n", err)
+	}
+	if err := os.WriteFile(path.Join(root, "ghost.1700000000000000"), nil, 0644); err != nil {
+		t.Fatalf("Unable to write ghost: %v\n", err)
+	}
+
+	// checking changes nothing
+	report, err := database.Fsck(ctx, false)
+	if err != nil {
+		t.Fatalf("Unable to check: %v\n", err)
+	}
+	if report.Problems() != 5 || report.Repaired || len(report.StaleReservations) != 1 || len(report.FailedUploads) != 1 ||
+		len(report.Truncated) != 1 || len(report.RowsWithoutFiles) != 1 || !slices.Equal(report.FilesWithoutRows, []string{"ghost.1700000000000000"}) {
+		t.Fatalf("Checking reported %+v\n", report)
+	}
+	if again, err := database.Fsck(ctx, false); err != nil || again.Problems() != 5 {
+		t.Fatalf("Checking twice reported %+v %v\n", again, err)
+	}
+
+	report, err = database.Fsck(ctx, true)
+	if err != nil || !report.Repaired {
+		t.Fatalf("Unable to repair: %+v %v\n", report, err)
+	}
+	for name, quarantined := range map[string]string{initrd[0].Path(): ".tftpcpd-quarantine/" + initrd[0].Path(), "ghost.1700000000000000": ".tftpcpd-quarantine/ghost.1700000000000000"} {
+		if report.Quarantined[name] != quarantined {
+			t.Fatalf("Quarantined %v as %v\n", name, report.Quarantined[name])
+		}
+		if _, err = os.Stat(path.Join(root, quarantined)); err != nil {
+			t.Fatalf("Nothing quarantined at %v: %v\n", quarantined, err)
+		}
+	}
+
+	// the quarantine directory is neither verified nor imported
+	if report, err = database.Fsck(ctx, false); err != nil || report.Problems() != 0 || len(report.Unmanaged) != 0 {
+		t.Fatalf("Checking a repaired database reported %+v %v\n", report, err)
+	}
+	database.importFiles = true
+	if _, err = database.Index(ctx); err != nil {
+		t.Fatalf("Unable to index: %v\n", err)
+	}
+	for _, filename := range []string{"initrd", "lost", "failed", "ghost"} {
+		if versions, _ := database.Versions(ctx, filename); len(versions) != 0 {
+			t.Fatalf("%v still has versions %+v\n", filename, versions)
+		}
+	}
+	if versions, _ := database.Versions(ctx, "kernel"); len(versions) != 1 || versions[0].Consumers != 0 {
+		t.Fatalf("kernel has versions %+v\n", versions)
+	}
+}
+
+// repairs wait for servers to stop since their uploads and readers would be taken for stale ones
+func TestFsckRefusesWhileServing(t *testing.T) {
+	ctx := context.Background()
+	database := testStores(t, nil)["database"].(*Database)
+
+	attached, err := AttachDatabase(&Config{Directory: database.Directory, Sqlite3DBPath: database.path}, discardLog(t))
+	if err != nil {
+		t.Fatalf("Unable to attach: %v\n", err)
+	}
+	defer attached.Close()
+
+	inProgress, err := database.BeginUpload(ctx, "kernel")
+	if err != nil {
+		t.Fatalf("Unable to begin upload: %v\n", err)
+	}
+	if report, err := attached.Fsck(ctx, false); err != nil || len(report.FailedUploads) != 1 {
+		t.Fatalf("Checking while serving reported %+v %v\n", report, err)
+	}
+	if _, err = attached.Fsck(ctx, true); !errors.Is(err, ErrDatabaseInUse) {
+		t.Fatalf("Repairing while serving returned %v instead of %v\n", err, ErrDatabaseInUse)
+	}
+	if _, err = OpenDatabase(&Config{Directory: database.Directory, Sqlite3DBPath: database.path}, discardLog(t)); !errors.Is(err, ErrDatabaseInUse) {
+		t.Fatalf("Opening for a second server returned %v instead of %v\n", err, ErrDatabaseInUse)
+	}
+	if err = inProgress.Commit(); err != nil {
+		t.Fatalf("Upload in progress was disturbed: %v\n", err)
+	}
+
+	// an upload whose row was deleted anyway is never reported as kept
+	deleted, err := database.BeginUpload(ctx, "initrd")
+	if err != nil {
+		t.Fatalf("Unable to begin upload: %v\n", err)
+	}
+	if _, err = database.DB.ExecContext(ctx, `DELETE FROM files WHERE filename = 'initrd';`); err != nil {
+		t.Fatalf("Unable to delete row: %v\n", err)
+	}
+	if err = deleted.Commit(); err == nil {
+		t.Fatalf("Committing an upload without a row succeeded\n")
+	}
+	if versions, _ := database.Versions(ctx, "initrd"); len(versions) != 0 {
+		t.Fatalf("initrd has versions %+v\n", versions)
+	}
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// a read or write request as the client sent it
+type Request struct {
+	Filename string
+	Mode     string
+	// options the client asked for keyed by lowercase name, negotiated only after the handler answered
+	Options    map[string]string
+	RemoteAddr net.Addr
+}
+
+/*
+ * Answers read requests with the contents of the file asked for.
+ * The reader is closed once the transfer is over when it implements io.Closer.
+ * Errors wrapping one of the Err* categories are sent to the client with that category's error code,
+ * so returning newError(ErrNotFound, filename) answers with error 1.
+ */
+type ReadHandler interface {
+	ServeRead(ctx context.Context, request *Request) (io.ReadSeeker, error)
+}
+
+/*
+ * Answers write requests with where the file received should be written.
+ * Close is called once every block was received, the upload is complete only if it succeeds.
+ * When the upload fails Abort is called instead if the writer has it, otherwise Close is.
+ * Errors are sent to the client just like those of a ReadHandler.
+ */
+type WriteHandler interface {
+	ServeWrite(ctx context.Context, request *Request) (io.WriteCloser, error)
+}
+
+// lets an ordinary function be used as a ReadHandler
+type ReadHandlerFunc func(ctx context.Context, request *Request) (io.ReadSeeker, error)
+
+func (handler ReadHandlerFunc) ServeRead(ctx context.Context, request *Request) (io.ReadSeeker, error) {
+	return handler(ctx, request)
+}
+
+// lets an ordinary function be used as a WriteHandler
+type WriteHandlerFunc func(ctx context.Context, request *Request) (io.WriteCloser, error)
+
+func (handler WriteHandlerFunc) ServeWrite(ctx context.Context, request *Request) (io.WriteCloser, error) {
+	return handler(ctx, request)
+}
+
+// writers given to a WriteHandler may implement this to hear that an upload failed
+type aborter interface {
+	Abort() error
+}
+
+// number of bytes left in reader, which is moved back to where it was
+func remainingSize(reader io.ReadSeeker) (int64, error) {
+	current, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = reader.Seek(current, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return end - current, nil
+}
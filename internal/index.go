@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * What indexing the root directory found.
+ * Imported files were registered as versions, the orphans are only reported and left alone.
+ */
+type IndexReport struct {
+	// files that were not versions keyed by their name, each now also the version it was linked to
+	Imported map[string]Version
+	// files that are not versions and were left alone since importing was not asked for
+	Unmanaged []string
+	// completed versions with a row but no file
+	RowsWithoutFiles []Version
+	// files named like versions that have no row
+	FilesWithoutRows []string
+}
+
+// whether name looks like filename.<unixMicro>, the way every version is named in the root directory
+func isVersionName(name string) bool {
+	name = path.Base(name)
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 || len(name)-dot-1 != 16 {
+		return false
+	}
+	_, err := strconv.ParseUint(name[dot+1:], 10, 64)
+
+	return err == nil
+}
+
+// when the newest version of each file completed
+func newestCompleted(rows map[string]fileModel) map[string]int64 {
+	var newest map[string]int64 = make(map[string]int64)
+
+	for _, model := range rows {
+		newest[model.filename] = max(newest[model.filename], model.timeCompleted)
+	}
+
+	return newest
+}
+
+// whether the file name last modified at modified is already served, having not changed since a version of it completed
+// imported files stay where they were found, this keeps them from being imported again every time
+func alreadyImported(name string, modified time.Time, newest map[string]int64) bool {
+	return newest[name] != 0 && modified.UnixMicro() <= newest[name]
+}
+
+/*
+ * Reconcile the root directory and every directory below it with the files table.
+ * With Config.Import, files put there some other way than by an upload are registered as versions and hard linked to filename.<unixMicro>,
+ * so a directory of boot images can be served by starting the server on it without moving or renaming anything in it.
+ * Each is started and completed when it is imported, making it the newest version of its file.
+ * A file is imported again once it is modified after its newest version completed.
+ */
+func (database *Database) Index(ctx context.Context) (IndexReport, error) {
+	var report IndexReport = IndexReport{Imported: make(map[string]Version)}
+	var started map[int64]bool = make(map[int64]bool)
+
+	// everything the database knows about
+	rows, err := database.rowsByPath(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, model := range rows {
+		started[model.timeStarted] = true
+	}
+	newest := newestCompleted(rows)
+
+	// every file in every directory below the root directory
+	present := make(map[string]bool)
+	err = fs.WalkDir(database.Directory.FS(), ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if database.ownFile(name) {
+			return skipOwn(entry)
+		}
+		present[name] = true
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if _, ok := rows[name]; ok {
+			return nil
+		}
+		if isVersionName(name) {
+			report.FilesWithoutRows = append(report.FilesWithoutRows, name)
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if alreadyImported(name, info.ModTime(), newest) {
+			return nil
+		}
+		if !database.importFiles {
+			report.Unmanaged = append(report.Unmanaged, name)
+			return nil
+		}
+
+		// modification times may be anything, uploadStarted has to be unique and as long as every other
+		unixMicro := time.Now().UnixMicro()
+		for started[unixMicro] {
+			unixMicro += 1
+		}
+
+		version, err := database.importFile(ctx, name, unixMicro, info.Size())
+		if err != nil {
+			return err
+		}
+		started[unixMicro] = true
+		report.Imported[name] = version
+
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for path, model := range rows {
+		if model.timeCompleted != 0 && !present[path] {
+			report.RowsWithoutFiles = append(report.RowsWithoutFiles, model.version())
+		}
+	}
+
+	return report, nil
+}
+
+// every row of the files table keyed by the path of its version
+func (database *Database) rowsByPath(ctx context.Context) (map[string]fileModel, error) {
+	var model fileModel = newFileModel()
+	var rows map[string]fileModel = make(map[string]fileModel)
+
+	result, err := database.DB.QueryContext(ctx, `SELECT * FROM files;`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	for result.Next() {
+		if err = model.scanRows(result); err != nil {
+			return nil, err
+		}
+		rows[model.Path()] = model
+	}
+
+	return rows, result.Err()
+}
+
+// register the file name of size bytes as the version of itself started at unixMicro and link it into place
+func (database *Database) importFile(ctx context.Context, name string, unixMicro int64, size int64) (Version, error) {
+	var version Version = Version{Filename: name, Started: unixMicro, Completed: max(time.Now().UnixMicro(), unixMicro), Size: size}
+
+	tx, err := database.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
+	if err != nil {
+		return version, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO files(filename, uploadStarted, uploadCompleted, consumers, size) VALUES (?, ?, ?, 0, ?);`, version.Filename, version.Started, version.Completed, version.Size)
+	if err != nil {
+		_ = tx.Rollback()
+		return version, err
+	}
+
+	err = database.Directory.Link(name, version.Path())
+	if err != nil {
+		_ = tx.Rollback()
+		return version, fmt.Errorf("Unable to link %v to %v: %w", name, version.Path(), err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		// the file itself was never touched so the next start tries again
+		_ = database.Directory.Remove(version.Path())
+		return version, err
+	}
+
+	return version, nil
+}
+
+// skip the directory entry when walking the root directory, without skipping the rest of the directory it is in
+func skipOwn(entry fs.DirEntry) error {
+	if entry.IsDir() {
+		return fs.SkipDir
+	}
+
+	return nil
+}
+
+// whether name is the database, one of its journals, a log file, or quarantined
+// the database and log files live in the root directory when nothing else was asked for
+func (database *Database) ownFile(name string) bool {
+	if name == quarantineDirectory || strings.HasPrefix(name, quarantineDirectory+"/") {
+		return true
+	}
+
+	for _, logFile := range database.logFiles {
+		if relative, ok := database.belowRoot(logFile); ok && name == relative {
+			return true
+		}
+	}
+
+	databasePath, _, _ := strings.Cut(database.path, "?")
+	relative, ok := database.belowRoot(strings.TrimPrefix(databasePath, "file:"))
+	if !ok {
+		return false
+	}
+
+	return name == relative || name == relative+"-journal" || name == relative+"-wal" || name == relative+"-shm" ||
+		name == relative+".lock" || name == relative+".lock-journal"
+}
+
+// the path below the root directory of the file at name, false when it is somewhere else
+func (database *Database) belowRoot(name string) (string, bool) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return "", false
+	}
+	directory, err := filepath.Abs(database.Directory.Name())
+	if err != nil {
+		return "", false
+	}
+	relative, err := filepath.Rel(directory, name)
+	if err != nil || !filepath.IsLocal(relative) {
+		return "", false
+	}
+
+	return filepath.ToSlash(relative), true
+}
+
+// index the root directory and log what was found
+func (database *Database) logIndex(ctx context.Context) error {
+	report, err := database.Index(ctx)
+	if err != nil {
+		return err
+	}
+
+	for name, version := range report.Imported {
+		database.log <- NewNormalEvent("DATABASE", fmt.Sprintf("Imported %v as version %v", name, version.Path()))
+	}
+	for _, version := range report.RowsWithoutFiles {
+		database.log <- NewErrorEvent("DATABASE", fmt.Sprintf("Version %v has no file", version.Path()))
+	}
+	for _, name := range report.FilesWithoutRows {
+		database.log <- NewErrorEvent("DATABASE", fmt.Sprintf("File %v looks like a version but has no row", name))
+	}
+	if len(report.Unmanaged) != 0 {
+		database.log <- NewNormalEvent("DATABASE", fmt.Sprintf("%v files in the root directory are not served, start with -import to serve them", len(report.Unmanaged)))
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestIsVersionName(t *testing.T) {
+	cases := map[string]bool{
+		"kernel.bin.1700000000000000":  true,
+		"kernel.1700000000000000":      true,
+		".1700000000000000":            false,
+		"kernel.bin":                   false,
+		"kernel.170000000000000":       false,
+		"kernel.17000000000000000":     false,
+		"kernel.17000000000000x0":      false,
+		"boot/kernel.1700000000000000": true,
+		"boot.1700000000000000/kernel": false,
+	}
+
+	for name, expected := range cases {
+		if isVersionName(name) != expected {
+			t.Fatalf("%q is a version name: %v\n", name, !expected)
+		}
+	}
+}
+
+// a root directory holding files as if tftpcpd was started in it, along with its database and log file
+func indexFixture(t *testing.T, files map[string]string) (string, *os.Root) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/pxelinux.cfg", 0755); err != nil {
+		t.Fatalf("Unable to create pxelinux.cfg: %v\n", err)
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(dir+"/"+name, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write %v: %v\n", name, err)
+		}
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatalf("Unable to open root: %v\n", err)
+	}
+	t.Cleanup(func() { root.Close() })
+
+	return dir, root
+}
+
+// files already in the root directory are served once the database is opened with Config.Import
+func TestIndexAtStartup(t *testing.T) {
+	ctx := context.Background()
+	files := map[string]string{
+		"pxelinux.0":                  "boot loader",
+		"ghost.bin.1700000000000000":  "nobody knows about me",
+		"tftpcpd.db-journal":          "not a boot image",
+		"tftpcpd.log":                 "already being logged to",
+		"also-imported.cfg":           "menu",
+		"also-imported.cfg.123456789": "short suffix so still imported",
+		"epoch.img":                   "unpacked from a reproducible archive",
+		"pxelinux.cfg/default":        "nested",
+		"pxelinux.cfg/tftpcpd.db":     "only the database in the root directory is skipped",
+	}
+	dir, root := indexFixture(t, files)
+	if err := os.Chtimes(dir+"/epoch.img", time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		t.Fatalf("Unable to date epoch.img: %v\n", err)
+	}
+
+	// the database and log file live in the root directory just like when tftpcpd is run with its defaults
+	database, err := OpenDatabase(&Config{Directory: root, Sqlite3DBPath: dir + "/tftpcpd.db", NormalLogFile: dir + "/tftpcpd.log", Import: true}, discardLog(t))
+	if err != nil {
+		t.Fatalf("Unable to open database: %v\n", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	for _, name := range []string{"pxelinux.0", "also-imported.cfg", "also-imported.cfg.123456789", "epoch.img", "pxelinux.cfg/default", "pxelinux.cfg/tftpcpd.db"} {
+		reader, err := database.OpenLatest(ctx, name)
+		if err != nil {
+			t.Fatalf("Unable to open imported %v: %v\n", name, err)
+		}
+		version := reader.Version()
+		contents, _ := io.ReadAll(reader)
+		reader.Close()
+		if string(contents) != files[name] {
+			t.Fatalf("Imported %v contains %q\n", name, contents)
+		}
+		if !isVersionName(version.Path()) {
+			t.Fatalf("Imported %v as %v\n", name, version.Path())
+		}
+
+		// the file is linked in, not moved
+		original, err := root.Stat(name)
+		if err != nil {
+			t.Fatalf("Imported %v was moved: %v\n", name, err)
+		}
+		linked, err := root.Stat(version.Path())
+		if err != nil || !os.SameFile(original, linked) {
+			t.Fatalf("Imported %v is not linked to %v: %v\n", name, version.Path(), err)
+		}
+	}
+	for _, name := range []string{"ghost.bin", "ghost.bin.1700000000000000", "tftpcpd.db-journal", "tftpcpd.db", "tftpcpd.log"} {
+		if reader, err := database.OpenLatest(ctx, name); err == nil {
+			reader.Close()
+			t.Fatalf("%v was imported\n", name)
+		}
+	}
+	if contents, err := os.ReadFile(dir + "/tftpcpd.log"); err != nil || string(contents) != files["tftpcpd.log"] {
+		t.Fatalf("Log file was disturbed: %q %v\n", contents, err)
+	}
+
+	// a version losing its file is reported along with the file that never had a row
+	latest, err := database.OpenLatest(ctx, "pxelinux.0")
+	if err != nil {
+		t.Fatalf("Unable to open pxelinux.0: %v\n", err)
+	}
+	version := latest.Version()
+	latest.Close()
+	if err = root.Remove(version.Path()); err != nil {
+		t.Fatalf("Unable to remove %v: %v\n", version.Path(), err)
+	}
+
+	// files left where they were found are not imported again
+	report, err := database.Index(ctx)
+	if err != nil {
+		t.Fatalf("Unable to index: %v\n", err)
+	}
+	if len(report.Imported) != 0 || len(report.Unmanaged) != 0 {
+		t.Fatalf("Imported %v again and left %v\n", report.Imported, report.Unmanaged)
+	}
+	if len(report.RowsWithoutFiles) != 1 || report.RowsWithoutFiles[0].Started != version.Started {
+		t.Fatalf("Rows without files %+v instead of %+v\n", report.RowsWithoutFiles, version)
+	}
+	if !slices.Equal(report.FilesWithoutRows, []string{"ghost.bin.1700000000000000"}) {
+		t.Fatalf("Files without rows %v\n", report.FilesWithoutRows)
+	}
+
+	// replacing a file imports it as a new version
+	if err = os.WriteFile(dir+"/also-imported.cfg.new", []byte("new menu"), 0644); err != nil {
+		t.Fatalf("Unable to write new menu: %v\n", err)
+	}
+	if err = os.Rename(dir+"/also-imported.cfg.new", dir+"/also-imported.cfg"); err != nil {
+		t.Fatalf("Unable to replace menu: %v\n", err)
+	}
+	if report, err = database.Index(ctx); err != nil || len(report.Imported) != 1 || report.Imported["also-imported.cfg"].Filename != "also-imported.cfg" {
+		t.Fatalf("Replacing a file imported %v %v\n", report.Imported, err)
+	}
+	if versions, _ := database.Versions(ctx, "also-imported.cfg"); len(versions) != 2 {
+		t.Fatalf("Replaced file has versions %+v\n", versions)
+	}
+}
+
+// without Config.Import files in the root directory are only reported
+func TestIndexWithoutImport(t *testing.T) {
+	ctx := context.Background()
+	dir, root := indexFixture(t, map[string]string{"pxelinux.0": "boot loader", "pxelinux.cfg/default": "nested"})
+
+	database, err := OpenDatabase(&Config{Directory: root, Sqlite3DBPath: dir + "/tftpcpd.db"}, discardLog(t))
+	if err != nil {
+		t.Fatalf("Unable to open database: %v\n", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	report, err := database.Index(ctx)
+	if err != nil || len(report.Imported) != 0 || !slices.Equal(report.Unmanaged, []string{"pxelinux.0", "pxelinux.cfg/default"}) {
+		t.Fatalf("Indexing reported %+v %v\n", report, err)
+	}
+	if filenames, err := database.Filenames(ctx); err != nil || len(filenames) != 0 {
+		t.Fatalf("Registered %v %v\n", filenames, err)
+	}
+	for _, name := range []string{"pxelinux.0", "pxelinux.cfg/default"} {
+		if _, err = root.Stat(name); err != nil {
+			t.Fatalf("%v was moved: %v\n", name, err)
+		}
+	}
+}
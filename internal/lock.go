@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"strings"
+)
+
+// returned when the database is used by a server while something that must not run alongside one is attempted, or the other way around
+var ErrDatabaseInUse = errors.New("Database is in use by a server or a repair")
+
+/*
+ * An exclusive lock on a second sqlite database next to the one at path, path.lock.
+ * Servers hold it for as long as they use the database and repairs while they change what servers rely on.
+ * The operating system releases it when the holder exits, so a server that crashed never leaves it behind.
+ */
+type databaseLock struct {
+	db *sql.DB
+	tx *sql.Tx
+}
+
+// the file the lock of the database at path is taken on, empty for databases only this process can open
+func lockPath(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	if path == "" || path == ":memory:" || path == "file::memory:" {
+		return ""
+	}
+
+	return path + ".lock"
+}
+
+// take the lock of the database at path without waiting, returning ErrDatabaseInUse when it is held
+func acquireDatabaseLock(path string) (*databaseLock, error) {
+	var lock databaseLock
+
+	name := lockPath(path)
+	if name == "" {
+		return &lock, nil
+	}
+	if strings.HasPrefix(name, "file:") {
+		name = name + "?_txlock=exclusive&_busy_timeout=0"
+	} else {
+		name = "file:" + name + "?_txlock=exclusive&_busy_timeout=0"
+	}
+
+	db, err := sql.Open("sqlite3", name)
+	if err != nil {
+		return nil, err
+	}
+	// the lock belongs to the one connection the transaction is on
+	db.SetMaxOpenConns(1)
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		db.Close()
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+			return nil, ErrDatabaseInUse
+		}
+		return nil, err
+	}
+	lock.db, lock.tx = db, tx
+
+	return &lock, nil
+}
+
+// let others take the lock
+func (lock *databaseLock) release() error {
+	if lock == nil || lock.db == nil {
+		return nil
+	}
+
+	_ = lock.tx.Rollback()
+	return lock.db.Close()
+}
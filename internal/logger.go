@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"time"
 )
@@ -53,68 +54,98 @@ func (event logEvent) String() string {
 		event.message)
 }
 
-func LoggerInit() error {
-	return nil
+/*
+ * Writes the events sent to Events to the log files named in the config, or to Config.LogOutput when none are named.
+ * Every server and client has a logger of its own.
+ * Nothing may be sent to Events once Close is called.
+ */
+type Logger struct {
+	Events chan logEvent
+
+	normalMessageLog io.Writer
+	debugMessageLog  io.Writer
+	errorMessageLog  io.Writer
+	// log files opened by the logger, closed along with it
+	files []*os.File
+
+	// closed once every event has been written
+	done chan struct{}
 }
 
-func LoggerRoutine(childToParent chan<- Signal, parentToChild <-chan Signal) {
-	normalMessageLog := os.Stdout
-	debugMessageLog := os.Stderr
-	errorMessageLog := os.Stderr
-	var normalMessageLogError, debugMessageLogError, errorMessageLogError error
-	if Cfg.NormalLogFile != "" {
-		normalMessageLog, normalMessageLogError = os.OpenFile(Cfg.NormalLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
-		defer normalMessageLog.Close()
+// open the log files and start writing events to them
+func NewLogger(cfg *Config) (*Logger, error) {
+	var logger Logger = Logger{
+		Events:           make(chan logEvent, 150),
+		normalMessageLog: os.Stdout,
+		debugMessageLog:  os.Stderr,
+		errorMessageLog:  os.Stderr,
+		done:             make(chan struct{}),
 	}
-	if Cfg.DebugLogFile != "" {
-		debugMessageLog, debugMessageLogError = os.OpenFile(Cfg.DebugLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
-		defer debugMessageLog.Close()
+
+	if cfg.LogOutput != nil {
+		logger.normalMessageLog = cfg.LogOutput
+		logger.debugMessageLog = cfg.LogOutput
+		logger.errorMessageLog = cfg.LogOutput
 	}
-	if Cfg.ErrorLogFile != "" {
-		errorMessageLog, errorMessageLogError = os.OpenFile(Cfg.ErrorLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
-		defer errorMessageLog.Close()
+
+	for _, log := range []struct {
+		path   string
+		writer *io.Writer
+	}{
+		{cfg.NormalLogFile, &logger.normalMessageLog},
+		{cfg.DebugLogFile, &logger.debugMessageLog},
+		{cfg.ErrorLogFile, &logger.errorMessageLog},
+	} {
+		if log.path == "" {
+			continue
+		}
+		file, err := os.OpenFile(log.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to open one or more files logging was requested to")
+			logger.closeFiles()
+			return nil, err
+		}
+		*log.writer = file
+		logger.files = append(logger.files, file)
 	}
-	if normalMessageLogError != nil || debugMessageLogError != nil || errorMessageLogError != nil {
-		fmt.Fprintln(os.Stderr, "Unable to open one or more files logging was requested to")
-		childToParent <- NewSignal(SignalTerminate, SignalRequest)
-		<-parentToChild
 
-		return
+	go logger.run()
+
+	return &logger, nil
+}
+
+func (logger *Logger) run() {
+	defer close(logger.done)
+	defer logger.closeFiles()
+
+	for event := range logger.Events {
+		logger.write(event)
 	}
+}
 
-	for true {
-		select {
-		case event, isOpen := <-Log:
-			if !isOpen {
-				// signal to main that we want to terminate this routine and all others
-				childToParent <- NewSignal(SignalTerminate, SignalRequest)
-				<-parentToChild
-
-				return
-			} else {
-				writeEventToLog(event, normalMessageLog, debugMessageLog, errorMessageLog)
-			}
-		default:
-			select {
-			case sig := <-parentToChild:
-				childToParent <- NewSignal(sig.Kind, SignalAccept)
-				return
-			default:
-				// pass
-			}
-		}
+// write every event already sent then close the log files
+func (logger *Logger) Close() error {
+	close(logger.Events)
+	<-logger.done
+
+	return nil
+}
+
+func (logger *Logger) closeFiles() {
+	for _, file := range logger.files {
+		file.Close()
 	}
 }
 
-func writeEventToLog(event logEvent, normalMessageLog, debugMessageLog, errorMessageLog *os.File) {
+func (logger *Logger) write(event logEvent) {
 	switch event.kind {
 	case normalMsg:
-		fmt.Fprintln(normalMessageLog, event)
+		fmt.Fprintln(logger.normalMessageLog, event)
 	case debugMsg:
-		fmt.Fprintln(debugMessageLog, event)
+		fmt.Fprintln(logger.debugMessageLog, event)
 	case errorMsg:
-		fmt.Fprintln(errorMessageLog, event)
+		fmt.Fprintln(logger.errorMessageLog, event)
 	default:
-		Log <- NewErrorEvent("LOGGER", fmt.Sprintf("Malformed log partial: %v", event.message))
+		fmt.Fprintln(logger.errorMessageLog, NewErrorEvent("LOGGER", fmt.Sprintf("Malformed log partial: %v", event.message)))
 	}
 }
@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// what happens to a packet on its way through a LossyConn
+type Fault uint8
+
+const (
+	// delivered untouched
+	FaultNone Fault = iota
+	// never delivered
+	FaultDrop
+	// delivered twice
+	FaultDuplicate
+	// held back and delivered after the next packet sent to anywhere
+	FaultReorder
+	// delivered once LossyConn.Delay has passed
+	FaultDelay
+	// delivered with every bit of its last byte flipped, TFTP has no checksum of its own so this goes unnoticed in data
+	FaultCorrupt
+)
+
+func (fault Fault) String() string {
+	switch fault {
+	case FaultNone:
+		return "none"
+	case FaultDrop:
+		return "drop"
+	case FaultDuplicate:
+		return "duplicate"
+	case FaultReorder:
+		return "reorder"
+	case FaultDelay:
+		return "delay"
+	case FaultCorrupt:
+		return "corrupt"
+	}
+
+	return "???"
+}
+
+/*
+ * Decides the fault applied to each packet a LossyConn sends.
+ * Called once per packet in the order packets are sent, possibly by many conns at once.
+ * buf must not be modified or kept.
+ */
+type FaultSchedule interface {
+	Next(from net.Addr, to net.Addr, buf []byte) Fault
+}
+
+// lets a function be used as a FaultSchedule, useful for faults that only affect certain messages
+type FaultFunc func(from net.Addr, to net.Addr, buf []byte) Fault
+
+func (schedule FaultFunc) Next(from net.Addr, to net.Addr, buf []byte) Fault {
+	return schedule(from, to, buf)
+}
+
+/*
+ * Applies faults in order, one for each packet sent, then FaultNone once they run out.
+ * NewScriptedFaults(FaultNone, FaultDrop) drops the second packet sent and nothing else.
+ */
+type ScriptedFaults struct {
+	lock   sync.Mutex
+	faults []Fault
+}
+
+func NewScriptedFaults(faults ...Fault) *ScriptedFaults {
+	return &ScriptedFaults{faults: faults}
+}
+
+func (schedule *ScriptedFaults) Next(from net.Addr, to net.Addr, buf []byte) Fault {
+	schedule.lock.Lock()
+	defer schedule.lock.Unlock()
+
+	if len(schedule.faults) == 0 {
+		return FaultNone
+	}
+	fault := schedule.faults[0]
+	schedule.faults = schedule.faults[1:]
+
+	return fault
+}
+
+/*
+ * Chance between 0 and 1 of each fault happening to a packet.
+ * At most one fault happens to any packet, so the chances should add up to no more than 1.
+ */
+type FaultRates struct {
+	Drop      float64
+	Duplicate float64
+	Reorder   float64
+	Delay     float64
+	Corrupt   float64
+}
+
+// faults picked at random, the same seed always picks the same faults in the same order
+type RandomFaults struct {
+	lock  sync.Mutex
+	rates FaultRates
+	rand  *rand.Rand
+}
+
+func NewRandomFaults(seed uint64, rates FaultRates) *RandomFaults {
+	return &RandomFaults{rates: rates, rand: rand.New(rand.NewPCG(seed, seed))}
+}
+
+func (schedule *RandomFaults) Next(from net.Addr, to net.Addr, buf []byte) Fault {
+	schedule.lock.Lock()
+	roll := schedule.rand.Float64()
+	schedule.lock.Unlock()
+
+	for _, chance := range []struct {
+		rate  float64
+		fault Fault
+	}{
+		{schedule.rates.Drop, FaultDrop},
+		{schedule.rates.Duplicate, FaultDuplicate},
+		{schedule.rates.Reorder, FaultReorder},
+		{schedule.rates.Delay, FaultDelay},
+		{schedule.rates.Corrupt, FaultCorrupt},
+	} {
+		if roll < chance.rate {
+			return chance.fault
+		}
+		roll -= chance.rate
+	}
+
+	return FaultNone
+}
+
+/*
+ * Wraps a packet conn so that what it sends suffers the faults picked by Schedule.
+ * Only sending is affected, wrap both ends of a conversation for faults in both directions.
+ * A packet held back for reordering is lost if nothing is sent after it before the conn is closed.
+ */
+type LossyConn struct {
+	net.PacketConn
+	Schedule FaultSchedule
+	// how long FaultDelay holds a packet back
+	Delay time.Duration
+
+	lock sync.Mutex
+	held []byte
+	// where held is going
+	heldTo net.Addr
+}
+
+func NewLossyConn(conn net.PacketConn, schedule FaultSchedule, delay time.Duration) *LossyConn {
+	return &LossyConn{PacketConn: conn, Schedule: schedule, Delay: delay}
+}
+
+func (conn *LossyConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	var err error
+
+	conn.lock.Lock()
+	held, heldTo := conn.held, conn.heldTo
+	conn.held, conn.heldTo = nil, nil
+	conn.lock.Unlock()
+
+	switch conn.Schedule.Next(conn.LocalAddr(), addr, buf) {
+	case FaultNone:
+		_, err = conn.PacketConn.WriteTo(buf, addr)
+	case FaultDrop:
+		// pass
+	case FaultDuplicate:
+		if _, err = conn.PacketConn.WriteTo(buf, addr); err == nil {
+			_, err = conn.PacketConn.WriteTo(buf, addr)
+		}
+	case FaultReorder:
+		// whatever was already held goes now so that only one packet is ever held
+		conn.lock.Lock()
+		conn.held, conn.heldTo = append([]byte(nil), buf...), addr
+		conn.lock.Unlock()
+	case FaultDelay:
+		delayed := append([]byte(nil), buf...)
+		time.AfterFunc(conn.Delay, func() { conn.PacketConn.WriteTo(delayed, addr) })
+	case FaultCorrupt:
+		corrupted := append([]byte(nil), buf...)
+		if len(corrupted) > 0 {
+			corrupted[len(corrupted)-1] ^= 0xff
+		}
+		_, err = conn.PacketConn.WriteTo(corrupted, addr)
+	}
+
+	// the packet held back by the previous send follows this one
+	if held != nil && err == nil {
+		_, err = conn.PacketConn.WriteTo(held, heldTo)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+// hands out lossy conns, all of them sharing the same schedule
+type LossyNetwork struct {
+	Network  Network
+	Schedule FaultSchedule
+	Delay    time.Duration
+}
+
+func (network *LossyNetwork) ListenPacket(laddr *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := network.Network.ListenPacket(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLossyConn(conn, network.Schedule, network.Delay), nil
+}
+
+// receive what is sent to group on the wrapped network, which must be able to
+func (network *LossyNetwork) ListenMulticast(group *net.UDPAddr) (net.PacketConn, error) {
+	inner, ok := network.Network.(multicastNetwork)
+	if !ok {
+		return nil, errors.New("Wrapped network can not listen to multicast groups")
+	}
+	conn, err := inner.ListenMulticast(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLossyConn(conn, network.Schedule, network.Delay), nil
+}
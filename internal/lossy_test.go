@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// every packet waiting to be read from conn
+func readAll(t *testing.T, conn net.PacketConn, wait time.Duration) []string {
+	var packets []string
+	buf := make([]byte, 16)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(wait))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestLossyConnFaults(t *testing.T) {
+	cases := []struct {
+		faults   []Fault
+		expected []string
+	}{
+		{[]Fault{FaultNone, FaultNone}, []string{"a", "b"}},
+		{[]Fault{FaultDrop, FaultNone}, []string{"b"}},
+		{[]Fault{FaultDuplicate, FaultNone}, []string{"a", "a", "b"}},
+		{[]Fault{FaultReorder, FaultNone}, []string{"b", "a"}},
+		{[]Fault{FaultDelay, FaultNone}, []string{"b", "a"}},
+		{[]Fault{FaultCorrupt, FaultNone}, []string{"\x9e", "b"}},
+		{[]Fault{FaultReorder, FaultReorder}, []string{"a"}},
+	}
+
+	for _, c := range cases {
+		a, b := NewPacketPipe()
+		lossy := NewLossyConn(a, NewScriptedFaults(c.faults...), 20*time.Millisecond)
+
+		lossy.WriteTo([]byte("a"), b.LocalAddr())
+		lossy.WriteTo([]byte("b"), b.LocalAddr())
+
+		received := readAll(t, b, 50*time.Millisecond)
+		if !slices.Equal(received, c.expected) {
+			t.Fatalf("%v: %q != %q\n", c.faults, received, c.expected)
+		}
+
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestRandomFaultsSeeded(t *testing.T) {
+	rates := FaultRates{Drop: 0.2, Duplicate: 0.2, Reorder: 0.2, Delay: 0.2, Corrupt: 0.1}
+	picked := func(seed uint64) []Fault {
+		var faults []Fault
+		schedule := NewRandomFaults(seed, rates)
+		for i := 0; i < 100; i++ {
+			faults = append(faults, schedule.Next(nil, nil, nil))
+		}
+		return faults
+	}
+
+	first := picked(7)
+	if !slices.Equal(first, picked(7)) {
+		t.Fatalf("Same seed picked different faults\n")
+	}
+	if slices.Equal(first, picked(8)) {
+		t.Fatalf("Different seeds picked the same faults\n")
+	}
+	for _, fault := range []Fault{FaultNone, FaultDrop, FaultDuplicate, FaultReorder, FaultDelay, FaultCorrupt} {
+		if !slices.Contains(first, fault) {
+			t.Fatalf("%v never picked in %v\n", fault, first)
+		}
+	}
+}
+
+// lossy networks listen to groups on the network they wrap and refuse to when it can not
+func TestLossyNetworkMulticast(t *testing.T) {
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 42, 1), Port: 1758}
+	memory := NewMemoryNetwork()
+	lossy := &LossyNetwork{Network: memory, Schedule: NewScriptedFaults()}
+
+	member, err := lossy.ListenMulticast(group)
+	if err != nil {
+		t.Fatalf("Unable to listen to %v: %v\n", group, err)
+	}
+	defer member.Close()
+	if _, ok := member.(*LossyConn); !ok {
+		t.Fatalf("Group conn is a %T instead of a lossy one\n", member)
+	}
+	sender, err := memory.ListenPacket(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %v\n", err)
+	}
+	defer sender.Close()
+	sender.WriteTo([]byte("a"), group)
+	if received := readAll(t, member, 50*time.Millisecond); !slices.Equal(received, []string{"a"}) {
+		t.Fatalf("Group member received %q\n", received)
+	}
+
+	// only ListenPacket of the wrapped network is visible
+	unicast := &LossyNetwork{Network: struct{ Network }{memory}, Schedule: NewScriptedFaults()}
+	if conn, err := unicast.ListenMulticast(group); err == nil {
+		conn.Close()
+		t.Fatalf("Listened to %v on a network without multicast\n", group)
+	}
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// returned when opening a database written by a newer server, which this one could only damage
+var ErrSchemaTooNew = errors.New("Database schema is newer than this server understands")
+
+// one step of upgrading the schema, taking it from the version before to its own
+type migration struct {
+	description string
+	statements  []string
+}
+
+/*
+ * Every schema there has been, the schema after migrations[i] is version i+1.
+ * Only ever append, a released migration is never changed since databases already ran it.
+ */
+var migrations []migration = []migration{
+	{"create files table", []string{
+		`CREATE TABLE IF NOT EXISTS files(filename STRING, uploadStarted INT UNIQUE, uploadCompleted INT, consumers INT);`,
+		`CREATE INDEX IF NOT EXISTS files_filename ON files(filename);`,
+	}},
+	{"record the size of uploads", []string{
+		`ALTER TABLE files ADD COLUMN size INT NOT NULL DEFAULT -1;`,
+	}},
+	{"record when versions were promoted", []string{
+		`ALTER TABLE files ADD COLUMN promoted INT NOT NULL DEFAULT 0;`,
+	}},
+}
+
+// the version of the schema migrations creates
+func schemaVersion() int {
+	return len(migrations)
+}
+
+/*
+ * Upgrade the schema to schemaVersion in one transaction so a failed migration leaves the database as it was.
+ * Databases from before versions were recorded have no schema_version table, their version is worked out from the files table.
+ */
+func (database *Database) migrate(ctx context.Context) error {
+	tx, err := database.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	version, recorded, err := currentSchemaVersion(ctx, tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if version > schemaVersion() {
+		_ = tx.Rollback()
+		return fmt.Errorf("%w: version %v, at most %v", ErrSchemaTooNew, version, schemaVersion())
+	}
+	if version == schemaVersion() && recorded {
+		return tx.Commit()
+	}
+
+	for i := version; i < schemaVersion(); i++ {
+		for _, statement := range migrations[i].statements {
+			_, err = tx.ExecContext(ctx, statement)
+			if err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("Unable to migrate database schema to version %v: %w", i+1, err)
+			}
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version(version INT NOT NULL);`)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_version;`)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_version(version) VALUES (?);`, schemaVersion())
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < schemaVersion(); i++ {
+		database.log <- NewNormalEvent("DATABASE", fmt.Sprintf("Migrated database schema to version %v: %v", i+1, migrations[i].description))
+	}
+
+	return nil
+}
+
+// the version recorded in schema_version and true, or for older databases the version their files table matches and 0 for new ones
+func currentSchemaVersion(ctx context.Context, tx *sql.Tx) (int, bool, error) {
+	var tables int
+	var version int
+
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version';`).Scan(&tables)
+	if err != nil {
+		return 0, false, err
+	}
+	if tables != 0 {
+		err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version;`).Scan(&version)
+		return version, true, err
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'files';`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, false, err
+	}
+
+	// the size column came with version 2
+	var sizes int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info('files') WHERE name = 'size';`).Scan(&sizes)
+	if err != nil || sizes == 0 {
+		return 1, false, err
+	}
+
+	return 2, false, nil
+}
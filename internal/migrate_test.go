@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+)
+
+// databases as every earlier schema version wrote them, each with a completed version of kernel and a failed upload of initrd
+var schemaFixtures map[int][]string = map[int][]string{
+	1: {
+		`CREATE TABLE IF NOT EXISTS files(filename STRING, uploadStarted INT UNIQUE, uploadCompleted INT, consumers INT);`,
+		`CREATE INDEX IF NOT EXISTS files_filename ON files(filename);`,
+		`INSERT INTO files VALUES ('kernel', 1700000000000000, 1700000000000001, 0), ('initrd', 1700000000000002, 0, 0);`,
+	},
+	2: {
+		`CREATE TABLE IF NOT EXISTS files(filename STRING, uploadStarted INT UNIQUE, uploadCompleted INT, consumers INT, size INT NOT NULL DEFAULT -1);`,
+		`CREATE INDEX IF NOT EXISTS files_filename ON files(filename);`,
+		`INSERT INTO files VALUES ('kernel', 1700000000000000, 1700000000000001, 0, 6), ('initrd', 1700000000000002, 0, 0, -1);`,
+	},
+	3: {
+		`CREATE TABLE IF NOT EXISTS files(filename STRING, uploadStarted INT UNIQUE, uploadCompleted INT, consumers INT, size INT NOT NULL DEFAULT -1, promoted INT NOT NULL DEFAULT 0);`,
+		`CREATE INDEX IF NOT EXISTS files_filename ON files(filename);`,
+		`INSERT INTO files VALUES ('kernel', 1700000000000000, 1700000000000001, 0, 6, 0), ('initrd', 1700000000000002, 0, 0, -1, 0);`,
+		`CREATE TABLE schema_version(version INT NOT NULL);`,
+		`INSERT INTO schema_version VALUES (3);`,
+	},
+}
+
+// a root directory and a database at path run through statements with the files its rows point at
+func schemaFixture(t *testing.T, statements []string) (*os.Root, string) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/root", 0755); err != nil {
+		t.Fatalf("Unable to create root: %v\n", err)
+	}
+	for _, name := range []string{"kernel.1700000000000000", "initrd.1700000000000002"} {
+		if err := os.WriteFile(dir+"/root/"+name, []byte("served"), 0644); err != nil {
+			t.Fatalf("Unable to write %v: %v\n", name, err)
+		}
+	}
+	root, err := os.OpenRoot(dir + "/root")
+	if err != nil {
+		t.Fatalf("Unable to open root: %v\n", err)
+	}
+	t.Cleanup(func() { root.Close() })
+
+	db, err := sql.Open("sqlite3", dir+"/tftpcpd.db")
+	if err != nil {
+		t.Fatalf("Unable to open fixture: %v\n", err)
+	}
+	defer db.Close()
+	for _, statement := range statements {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatalf("Unable to write fixture with %v: %v\n", statement, err)
+		}
+	}
+
+	return root, dir + "/tftpcpd.db"
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	if len(schemaFixtures) != schemaVersion() {
+		t.Fatalf("Fixtures cover %v schema versions, there are %v\n", len(schemaFixtures), schemaVersion())
+	}
+
+	for from, statements := range schemaFixtures {
+		root, path := schemaFixture(t, statements)
+		database, err := OpenDatabase(&Config{Directory: root, Sqlite3DBPath: path}, discardLog(t))
+		if err != nil {
+			t.Fatalf("Unable to open version %v: %v\n", from, err)
+		}
+
+		var version int
+		if err = database.DB.QueryRow(`SELECT version FROM schema_version;`).Scan(&version); err != nil || version != schemaVersion() {
+			t.Fatalf("Version %v migrated to %v %v\n", from, version, err)
+		}
+
+		// rows survive and the failed upload is cleaned up as before
+		versions, err := database.Versions(ctx, "kernel")
+		if err != nil || len(versions) != 1 || versions[0].Started != 1700000000000000 {
+			t.Fatalf("Version %v has kernel versions %+v %v\n", from, versions, err)
+		}
+		if versions, _ = database.Versions(ctx, "initrd"); len(versions) != 0 {
+			t.Fatalf("Version %v kept the failed upload %+v\n", from, versions)
+		}
+		reader, err := database.OpenLatest(ctx, "kernel")
+		if err != nil {
+			t.Fatalf("Version %v is unable to open kernel: %v\n", from, err)
+		}
+		if contents := readAllStored(t, reader); contents != "served" {
+			t.Fatalf("Version %v read %q\n", from, contents)
+		}
+		reader.Close()
+		upload(t, database, "kernel", "newer")
+		if versions, _ = database.Versions(ctx, "kernel"); len(versions) != 2 || versions[1].Size != 5 {
+			t.Fatalf("Version %v uploaded %+v\n", from, versions)
+		}
+		database.Close()
+
+		// migrating is done once
+		database, err = OpenDatabase(&Config{Directory: root, Sqlite3DBPath: path}, discardLog(t))
+		if err != nil {
+			t.Fatalf("Unable to open version %v again: %v\n", from, err)
+		}
+		var rows int
+		if err = database.DB.QueryRow(`SELECT COUNT(*) FROM schema_version;`).Scan(&rows); err != nil || rows != 1 {
+			t.Fatalf("Version %v has %v schema versions %v\n", from, rows, err)
+		}
+		database.Close()
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	newer := append(append([]string{}, schemaFixtures[schemaVersion()]...),
+		`ALTER TABLE files ADD COLUMN checksum STRING;`,
+		`CREATE TABLE IF NOT EXISTS schema_version(version INT NOT NULL);`,
+		`DELETE FROM schema_version;`,
+		`INSERT INTO schema_version VALUES (99);`,
+	)
+	root, path := schemaFixture(t, newer)
+
+	if _, err := OpenDatabase(&Config{Directory: root, Sqlite3DBPath: path}, discardLog(t)); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("Opening a newer schema returned %v instead of %v\n", err, ErrSchemaTooNew)
+	}
+
+	// nothing was cleaned up or changed
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Unable to open fixture: %v\n", err)
+	}
+	defer db.Close()
+	var rows, version int
+	if err = db.QueryRow(`SELECT COUNT(*) FROM files;`).Scan(&rows); err != nil || rows != 2 {
+		t.Fatalf("Files table has %v rows %v\n", rows, err)
+	}
+	if err = db.QueryRow(`SELECT version FROM schema_version;`).Scan(&version); err != nil || version != 99 {
+		t.Fatalf("Schema version is %v %v\n", version, err)
+	}
+}
+
+func TestMigrateRollsBack(t *testing.T) {
+	// a version 1 database that already has a size column can not be migrated
+	broken := append([]string{}, schemaFixtures[1]...)
+	broken = append(broken, `ALTER TABLE files ADD COLUMN size INT;`, `CREATE TABLE schema_version(version INT NOT NULL);`, `INSERT INTO schema_version VALUES (1);`)
+	root, path := schemaFixture(t, broken)
+
+	if _, err := OpenDatabase(&Config{Directory: root, Sqlite3DBPath: path}, discardLog(t)); err == nil {
+		t.Fatalf("Migrating a broken database succeeded\n")
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Unable to open fixture: %v\n", err)
+	}
+	defer db.Close()
+	var version int
+	if err = db.QueryRow(`SELECT version FROM schema_version;`).Scan(&version); err != nil || version != 1 {
+		t.Fatalf("Failed migration left schema version %v %v\n", version, err)
+	}
+}
@@ -0,0 +1,653 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Multicast as described by RFC 2090:
+ * every client reading the same version of a file shares a single transfer
+ * data is sent once to a multicast group that all of those clients listen on
+ * one client at a time is the master client, only its acknowledgements drive the transfer
+ * when the master client finishes the next client becomes master and asks for the blocks it missed
+ */
+
+// returned when a read request asking for multicast has to be served by unicast instead
+var ErrMulticastUnavailable = errors.New("Multicast unavailable for this transfer")
+
+// a message received by a goroutine reading from a socket on behalf of a transfer
+type multicastPacket struct {
+	bytes []byte
+	addr  *net.UDPAddr
+}
+
+// a client taking part in a multicast transfer
+type multicastMember struct {
+	addr    *net.UDPAddr
+	options map[string]string
+
+	// whether the client has been sent an option acknowledgement since it last asked to join
+	announced bool
+
+	// closed once the client received every block or was given up on, err says which
+	done chan struct{}
+	err  error
+}
+
+type multicastTransfer struct {
+	server *Server
+	key    string
+	ctx    context.Context
+	conn   net.PacketConn
+	group  *net.UDPAddr
+	slot   int
+	reader StoredReader
+
+	blockSize uint16
+	timeout   time.Duration
+	// number of data blocks, the last one is always shorter than blockSize
+	blocks uint64
+
+	// guarded by server.multicastLock
+	members []*multicastMember
+	joined  chan struct{}
+}
+
+// serve the read request held by session as part of a multicast transfer
+// returns once the client received every block or was given up on
+func (session *TftpSession) MulticastAsServer() error {
+	member, err := joinMulticastTransfer(session)
+	if err != nil {
+		return err
+	}
+
+	<-member.done
+	return member.err
+}
+
+// add the client of session to the transfer of the file it reserved, starting the transfer if needed
+func joinMulticastTransfer(session *TftpSession) (*multicastMember, error) {
+	var err error
+	var server *Server = session.Server
+
+	server.multicastLock.Lock()
+	defer server.multicastLock.Unlock()
+
+	// only versions kept by the store can be opened again by the transfer
+	stored, ok := session.Reader.(StoredReader)
+	if !ok || server.Store == nil {
+		return nil, ErrMulticastUnavailable
+	}
+	version := stored.Version()
+	key := version.Path()
+	transfer, ok := server.multicastTransfers[key]
+	if !ok {
+		transfer, err = newMulticastTransfer(session, version)
+		if err != nil {
+			return nil, err
+		}
+		server.multicastTransfers[key] = transfer
+		go transfer.run()
+	}
+
+	// everyone in the group receives the same data messages
+	if transfer.blockSize != session.BlockSize {
+		return nil, ErrMulticastUnavailable
+	}
+
+	// a client sending its read request again did not see its option acknowledgement
+	for _, member := range transfer.members {
+		if sameTransferId(member.addr, session.TransferId) {
+			member.announced = false
+			transfer.wake()
+			return member, nil
+		}
+	}
+
+	member := &multicastMember{addr: session.TransferId, options: session.Options, done: make(chan struct{})}
+	transfer.members = append(transfer.members, member)
+	transfer.wake()
+
+	if server.Cfg.Debug {
+		server.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Joined multicast transfer of %v on %v", session.Filename, transfer.group))
+	}
+
+	return member, nil
+}
+
+// must hold server.multicastLock
+func newMulticastTransfer(session *TftpSession, version Version) (*multicastTransfer, error) {
+	var transfer multicastTransfer = multicastTransfer{server: session.Server, key: version.Path(), ctx: session.Ctx, blockSize: session.BlockSize, timeout: session.Timeout}
+
+	size, err := remainingSize(session.Reader)
+	if err != nil {
+		return nil, err
+	}
+	// block numbers never roll over during a multicast transfer
+	transfer.blocks = uint64(size)/uint64(transfer.blockSize) + 1
+	if transfer.blocks > 0xffff {
+		return nil, ErrMulticastUnavailable
+	}
+
+	base, err := net.ResolveUDPAddr("udp", transfer.server.Cfg.MulticastAddress)
+	if err != nil || !base.IP.IsMulticast() {
+		return nil, ErrMulticastUnavailable
+	}
+	// every transfer in progress uses its own port starting from the one configured
+	for transfer.slot = 0; ; transfer.slot++ {
+		inUse := false
+		for _, other := range transfer.server.multicastTransfers {
+			inUse = inUse || other.slot == transfer.slot
+		}
+		if !inUse {
+			break
+		}
+	}
+	transfer.group = &net.UDPAddr{IP: base.IP, Port: base.Port + transfer.slot}
+
+	// the transfer has a transfer id of its own shared by every client
+	local := session.Destination.LocalAddr().(*net.UDPAddr)
+	transfer.conn, err = transfer.server.Cfg.listenPacket(&net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return nil, err
+	}
+
+	// the transfer holds a reservation of its own for as long as it runs
+	transfer.reader, err = transfer.server.Store.OpenVersion(transfer.ctx, version.Filename, version.Started)
+	if err != nil {
+		transfer.conn.Close()
+		return nil, err
+	}
+
+	transfer.joined = make(chan struct{}, 1)
+
+	return &transfer, nil
+}
+
+// must hold server.multicastLock
+func (transfer *multicastTransfer) wake() {
+	select {
+	case transfer.joined <- struct{}{}:
+	default:
+		// already awake
+	}
+}
+
+func (transfer *multicastTransfer) run() {
+	var packets chan multicastPacket = make(chan multicastPacket, 64)
+	var master *multicastMember
+	var sendBuf []byte
+	var sendTo *net.UDPAddr
+	var timeout time.Duration
+	var attempt int
+	var timer *time.Timer = time.NewTimer(transfer.timeout)
+
+	defer transfer.reader.Close()
+	defer transfer.conn.Close()
+	defer timer.Stop()
+
+	go receivePackets(transfer.conn, packets, transfer.ctx.Done())
+
+	// remember what was sent so that it can be sent again when the master client does not respond
+	send := func(buf []byte, addr *net.UDPAddr) {
+		sendBuf, sendTo = buf, addr
+		timeout, attempt = transfer.timeout, 0
+		timer.Reset(timeout)
+		transfer.conn.WriteTo(sendBuf, sendTo)
+	}
+
+	for {
+		if master == nil {
+			master = transfer.nextMaster()
+			if master == nil {
+				return
+			}
+		}
+
+		// clients that just joined learn the group address and whether they are the master client
+		for _, member := range transfer.unannounced() {
+			buf, err := transfer.optionAcknowledgement(member, member == master)
+			if err != nil {
+				transfer.finish(member, err)
+				if member == master {
+					master = nil
+				}
+				continue
+			}
+			if member == master {
+				send(buf, member.addr)
+			} else {
+				transfer.conn.WriteTo(buf, member.addr)
+			}
+		}
+		if master == nil {
+			continue
+		}
+
+		select {
+		case <-transfer.ctx.Done():
+			transfer.finishAll(context.Cause(transfer.ctx))
+			return
+		case <-transfer.joined:
+			// pass
+		case <-timer.C:
+			attempt += 1
+			if attempt > transfer.server.Cfg.Retries {
+				transfer.finish(master, errors.New("Client connection (likely) dead"))
+				master = nil
+				continue
+			}
+			if transfer.server.Cfg.Debug {
+				transfer.server.Log <- NewDebugEvent(master.addr.String(), fmt.Sprintf("Timed out after %v, resending (attempt %v of %v)", timeout, attempt, transfer.server.Cfg.Retries))
+			}
+			timeout = min(time.Duration(float64(timeout)*max(transfer.server.Cfg.Backoff, 1)), MaxTimeout)
+			timer.Reset(timeout)
+			transfer.conn.WriteTo(sendBuf, sendTo)
+		case packet, ok := <-packets:
+			if !ok {
+				transfer.finishAll(errors.New("Multicast transfer socket closed"))
+				return
+			}
+
+			member := transfer.member(packet.addr)
+			if member == nil {
+				refuseUnknownTransferId(transfer.conn, packet.bytes, packet.addr)
+				continue
+			}
+
+			message, err := BytesAsMessage(packet.bytes)
+			if err != nil {
+				continue
+			}
+
+			switch message.(type) {
+			case *AcknowledgeMessage:
+				blockNumber := uint64(message.(*AcknowledgeMessage).BlockNumber)
+				if blockNumber >= transfer.blocks {
+					// any client acknowledging the last block has everything
+					transfer.finish(member, nil)
+					if member == master {
+						master = nil
+					}
+				} else if member == master {
+					buf, err := transfer.data(blockNumber + 1)
+					if err != nil {
+						transfer.finishAll(err)
+						return
+					}
+					send(buf, transfer.group)
+				}
+			case *ErrorMessage:
+				transfer.finish(member, errorFromMessage(message.(*ErrorMessage)))
+				if member == master {
+					master = nil
+				}
+			default:
+				// pass
+			}
+		}
+	}
+}
+
+// the member that has been waiting longest becomes the master client
+// once nobody is left the transfer is forgotten so the next request starts a new one
+func (transfer *multicastTransfer) nextMaster() *multicastMember {
+	transfer.server.multicastLock.Lock()
+	defer transfer.server.multicastLock.Unlock()
+
+	if len(transfer.members) == 0 {
+		delete(transfer.server.multicastTransfers, transfer.key)
+		return nil
+	}
+
+	// the new master client has to be told it is in charge
+	transfer.members[0].announced = false
+	return transfer.members[0]
+}
+
+func (transfer *multicastTransfer) unannounced() []*multicastMember {
+	var members []*multicastMember
+
+	transfer.server.multicastLock.Lock()
+	defer transfer.server.multicastLock.Unlock()
+
+	for _, member := range transfer.members {
+		if !member.announced {
+			member.announced = true
+			members = append(members, member)
+		}
+	}
+
+	return members
+}
+
+func (transfer *multicastTransfer) member(addr *net.UDPAddr) *multicastMember {
+	transfer.server.multicastLock.Lock()
+	defer transfer.server.multicastLock.Unlock()
+
+	for _, member := range transfer.members {
+		if sameTransferId(member.addr, addr) {
+			return member
+		}
+	}
+
+	return nil
+}
+
+func (transfer *multicastTransfer) finish(member *multicastMember, err error) {
+	transfer.server.multicastLock.Lock()
+	defer transfer.server.multicastLock.Unlock()
+
+	for i := range transfer.members {
+		if transfer.members[i] == member {
+			transfer.members = append(transfer.members[:i], transfer.members[i+1:]...)
+			member.err = err
+			close(member.done)
+			return
+		}
+	}
+}
+
+func (transfer *multicastTransfer) finishAll(err error) {
+	transfer.server.multicastLock.Lock()
+	defer transfer.server.multicastLock.Unlock()
+
+	for _, member := range transfer.members {
+		member.err = err
+		close(member.done)
+	}
+	transfer.members = nil
+	delete(transfer.server.multicastTransfers, transfer.key)
+}
+
+// the options member negotiated along with where to find the group and whether it is the master client
+func (transfer *multicastTransfer) optionAcknowledgement(member *multicastMember, master bool) ([]byte, error) {
+	var options map[string]string = make(map[string]string)
+
+	for key, value := range member.options {
+		options[key] = value
+	}
+	// every block is acknowledged by the master client so there is no window to speak of
+	delete(options, "windowsize")
+
+	mc := "0"
+	if master {
+		mc = "1"
+	}
+	options["multicast"] = fmt.Sprintf("%v,%v,%v", transfer.group.IP, transfer.group.Port, mc)
+
+	return NewOptionAcknowledgeMessage(options).MarshalBinary()
+}
+
+func (transfer *multicastTransfer) data(blockNumber uint64) ([]byte, error) {
+	buf, err := NewDataMessage(uint16(blockNumber), nil).AppendBinary(make([]byte, 0, DataPreambleLength+int(transfer.blockSize)))
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:DataPreambleLength+int(transfer.blockSize)]
+
+	n, err := transfer.reader.ReadAt(buf[DataPreambleLength:], int64(blockNumber-1)*int64(transfer.blockSize))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return buf[:DataPreambleLength+n], nil
+}
+
+// copy every message read from conn to packets until conn is closed
+func receivePackets(conn net.PacketConn, packets chan<- multicastPacket, stop <-chan struct{}) {
+	defer close(packets)
+
+	for {
+		buf := make([]byte, 0xffff)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		addr, err := udpAddr(from)
+		if err != nil {
+			continue
+		}
+
+		select {
+		case packets <- multicastPacket{buf[:n], addr}:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// parse the value of the multicast option sent by a server, "address,port,master"
+// the address and port may be left empty when they have not changed
+func parseMulticastOption(value string, group *net.UDPAddr) (*net.UDPAddr, bool, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 3 {
+		return nil, false, errors.New(fmt.Sprintf("Invalid multicast value %q", value))
+	}
+
+	if fields[0] != "" || fields[1] != "" {
+		ip := net.ParseIP(fields[0])
+		port, err := strconv.ParseUint(fields[1], 10, 16)
+		if ip == nil || !ip.IsMulticast() || err != nil {
+			return nil, false, errors.New(fmt.Sprintf("Invalid multicast value %q", value))
+		}
+		group = &net.UDPAddr{IP: ip, Port: int(port)}
+	} else if group == nil {
+		return nil, false, errors.New(fmt.Sprintf("Invalid multicast value %q", value))
+	}
+
+	switch fields[2] {
+	case "0":
+		return group, false, nil
+	case "1":
+		return group, true, nil
+	default:
+		return nil, false, errors.New(fmt.Sprintf("Invalid multicast value %q", value))
+	}
+}
+
+// receive the file as one of possibly many clients of a multicast transfer
+// data arrives from the group, everything else is exchanged with the server directly
+func (session *TftpSession) MulticastAsClient() error {
+	var received map[uint16]bool = make(map[uint16]bool)
+	// blocks ahead of next kept until everything before them is written, only for writers that can not write at an offset
+	var early map[uint16][]byte = make(map[uint16][]byte)
+	// lowest block not yet received
+	var next uint16 = 1
+	// block number of the short block ending the file, 0 until it is seen
+	var last uint16 = 0
+	var timeout time.Duration = session.Timeout
+	var attempt int = 0
+	var stop chan struct{} = make(chan struct{})
+	var fromGroup chan multicastPacket = make(chan multicastPacket, 64)
+	var fromServer chan multicastPacket = make(chan multicastPacket, 64)
+
+	if session.Mode != ModeOctet {
+		return errors.New("Multicast transfers must use octet mode")
+	}
+	// blocks arrive in whatever order the master clients ask for them
+	writerAt, _ := session.Writer.(io.WriterAt)
+
+	group, err := session.Cfg.listenMulticast(session.MulticastGroup)
+	if err != nil {
+		return err
+	}
+	defer group.Close()
+	defer close(stop)
+	go receivePackets(group, fromGroup, stop)
+	// clear the deadline left behind by the last call to session.Receive
+	session.Destination.SetReadDeadline(time.Time{})
+	go receivePackets(session.Destination, fromServer, stop)
+	// receivePackets owns session.Destination now, unblock it when done
+	defer session.Destination.SetReadDeadline(time.Now())
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// the master client asks for the first block it is missing by acknowledging the one before it
+	acknowledge := func() error {
+		timeout, attempt = session.Timeout, 0
+		timer.Reset(timeout)
+		if last != 0 && next > last {
+			return session.AcknowledgeMessage(last)
+		}
+		return session.AcknowledgeMessage(next - 1)
+	}
+
+	if session.MasterClient {
+		if err = acknowledge(); err != nil {
+			return err
+		}
+	}
+
+	for last == 0 || next <= last {
+		var packet multicastPacket
+		var ok bool
+
+		select {
+		case <-session.Ctx.Done():
+			return context.Cause(session.Ctx)
+		case <-timer.C:
+			attempt += 1
+			if attempt > session.Retries {
+				return errors.New("Server connection (likely) dead")
+			}
+			timeout = min(time.Duration(float64(timeout)*session.Backoff), MaxTimeout)
+			timer.Reset(timeout)
+			if session.MasterClient {
+				if err = session.Resend(); err != nil {
+					return err
+				}
+			}
+			continue
+		case packet, ok = <-fromGroup:
+			if !ok {
+				return errors.New("Unable to receive from multicast group")
+			}
+			// multicast may leave the server through another address but always from the same port
+			if packet.addr.Port != session.TransferId.Port {
+				continue
+			}
+		case packet, ok = <-fromServer:
+			if !ok {
+				return errors.New("Unable to receive from server")
+			}
+			if !sameTransferId(packet.addr, session.TransferId) {
+				refuseUnknownTransferId(session.Destination, packet.bytes, packet.addr)
+				continue
+			}
+		}
+
+		message, err := BytesAsMessage(packet.bytes)
+		if err != nil {
+			continue
+		}
+
+		switch message.(type) {
+		case *DataMessage:
+			data := message.(*DataMessage)
+			if data.BlockNumber == 0 || received[data.BlockNumber] {
+				if session.MasterClient {
+					// the server is sending a block we already have, our acknowledgement was probably lost
+					if err = acknowledge(); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if writerAt != nil {
+				if _, err = writerAt.WriteAt(data.Body, int64(data.BlockNumber-1)*int64(session.BlockSize)); err != nil {
+					return err
+				}
+			} else {
+				early[data.BlockNumber] = data.Body
+			}
+			received[data.BlockNumber] = true
+			session.TotalBytesTransferred += uint64(len(data.Body))
+			if len(data.Body) < int(session.BlockSize) {
+				last = data.BlockNumber
+			}
+			for received[next] {
+				if body, ok := early[next]; ok {
+					if _, err = session.Writer.Write(body); err != nil {
+						return err
+					}
+					delete(early, next)
+				}
+				next += 1
+			}
+
+			if session.MasterClient {
+				if err = acknowledge(); err != nil {
+					return err
+				}
+			} else {
+				// data is still flowing so the server is alive
+				timeout, attempt = session.Timeout, 0
+				timer.Reset(timeout)
+			}
+		case *OptionAcknowledgeMessage:
+			// the server chose us as the next master client or repeated itself
+			err = session.UpdateOptions(message.(*OptionAcknowledgeMessage).Options)
+			if err != nil {
+				session.ReportError(err)
+				return err
+			}
+			if session.MasterClient {
+				if session.Cfg.Debug {
+					session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Became master client, missing block #%v", next))
+				}
+				if err = acknowledge(); err != nil {
+					return err
+				}
+			}
+		case *ErrorMessage:
+			return errorFromMessage(message.(*ErrorMessage))
+		default:
+			// pass
+		}
+	}
+
+	// clients that are not the master tell the server they are done so it never picks them
+	if !session.MasterClient {
+		if err = session.AcknowledgeMessage(last); err != nil {
+			return err
+		}
+	}
+
+	// the final acknowledgement may be lost, in which case the server sends the last block again
+	deadline := time.After(session.Timeout)
+	for {
+		select {
+		case <-deadline:
+			return nil
+		case <-session.Ctx.Done():
+			return nil
+		case packet, ok := <-fromGroup:
+			if !ok {
+				return nil
+			}
+			message, err := BytesAsMessage(packet.bytes)
+			if err != nil || packet.addr.Port != session.TransferId.Port {
+				continue
+			}
+			if data, isData := message.(*DataMessage); isData && data.BlockNumber == last && session.MasterClient {
+				if err = session.Resend(); err != nil {
+					return err
+				}
+			}
+		case _, ok := <-fromServer:
+			if !ok {
+				return nil
+			}
+		}
+	}
+}
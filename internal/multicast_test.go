@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// server sending image.bin, holding contents, to groups starting at 239.255.42.1:1758 of network
+func newMulticastServer(t *testing.T, network *MemoryNetwork, contents []byte) *Server {
+	store := NewMemoryStore(nil)
+	upload(t, store, "image.bin", string(contents))
+
+	server, err := NewServer(Config{
+		Network:          network,
+		Retries:          5,
+		Backoff:          1,
+		Store:            store,
+		MulticastAddress: "239.255.42.1:1758",
+		LogOutput:        io.Discard,
+		Address:          "127.0.0.1:69",
+	})
+	if err != nil {
+		t.Fatalf("Unable to create server: %v\n", err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(context.Background()) }()
+	for deadline := time.Now().Add(time.Second); server.Addr() == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server never started listening\n")
+		}
+	}
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		<-served
+	})
+
+	return server
+}
+
+// the clients taking part in the multicast transfer of image.bin, the master client first
+func multicastMembers(server *Server) []*net.UDPAddr {
+	var members []*net.UDPAddr
+
+	server.multicastLock.Lock()
+	defer server.multicastLock.Unlock()
+
+	for _, transfer := range server.multicastTransfers {
+		for _, member := range transfer.members {
+			members = append(members, member.addr)
+		}
+	}
+
+	return members
+}
+
+// wait until count clients take part in the multicast transfer
+func waitForMembers(server *Server, count int) ([]*net.UDPAddr, error) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if members := multicastMembers(server); len(members) == count {
+			return members, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("Never %v clients in the multicast transfer", count))
+}
+
+// writer that calls gate once the first block was written, keeping the client from acknowledging it until gate returns
+type gatedWriter struct {
+	bytes.Buffer
+	gate  func() error
+	gated bool
+}
+
+func (writer *gatedWriter) Write(buf []byte) (int, error) {
+	n, err := writer.Buffer.Write(buf)
+	if err != nil || writer.gated {
+		return n, err
+	}
+	writer.gated = true
+
+	return n, writer.gate()
+}
+
+// a client joining late receives the blocks it missed once the master client is done and it takes over
+func TestMulticastLateJoiner(t *testing.T) {
+	network := NewMemoryNetwork()
+	contents := bytes.Repeat([]byte("multicast"), 4000)
+	server := newMulticastServer(t, network, contents)
+	options := map[string]string{"multicast": "", "timeout": "1"}
+
+	var joined []*net.UDPAddr
+	first := &gatedWriter{gate: func() (err error) {
+		joined, err = waitForMembers(server, 2)
+		return err
+	}}
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := newTestClient(t, network, "127.0.0.1:69").Get(context.Background(), "image.bin", func() (io.Writer, error) { return first, nil }, options)
+		firstDone <- err
+	}()
+	master, err := waitForMembers(server, 1)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	// blocks reach the late client out of order, a writer without WriteAt has them written in order anyway
+	var second bytes.Buffer
+	_, err = newTestClient(t, network, "127.0.0.1:69").Get(context.Background(), "image.bin", func() (io.Writer, error) { return &second, nil }, options)
+	if err != nil {
+		t.Fatalf("Late client failed: %v\n", err)
+	}
+	if err = <-firstDone; err != nil {
+		t.Fatalf("First client failed: %v\n", err)
+	}
+	// the client asking first stays the master client when others join
+	if !sameTransferId(joined[0], master[0]) {
+		t.Fatalf("%v became the master client instead of %v\n", joined[0], master[0])
+	}
+
+	if !bytes.Equal(first.Bytes(), contents) {
+		t.Fatalf("First client received %v bytes that differ from the %v sent\n", first.Len(), len(contents))
+	}
+	if !bytes.Equal(second.Bytes(), contents) {
+		t.Fatalf("Late client received %v bytes that differ from the %v sent\n", second.Len(), len(contents))
+	}
+	if members := multicastMembers(server); len(members) != 0 {
+		t.Fatalf("Transfer still has clients %v\n", members)
+	}
+}
+
+// a master client giving up hands the transfer over to the next client
+func TestMulticastMasterLeaves(t *testing.T) {
+	network := NewMemoryNetwork()
+	contents := bytes.Repeat([]byte("multicast"), 4000)
+	server := newMulticastServer(t, network, contents)
+	options := map[string]string{"multicast": "", "timeout": "1"}
+
+	leaving := &gatedWriter{gate: func() error {
+		if _, err := waitForMembers(server, 2); err != nil {
+			return err
+		}
+		return ErrDiskFull
+	}}
+	leavingDone := make(chan error, 1)
+	go func() {
+		_, err := newTestClient(t, network, "127.0.0.1:69").Get(context.Background(), "image.bin", func() (io.Writer, error) { return leaving, nil }, options)
+		leavingDone <- err
+	}()
+	if _, err := waitForMembers(server, 1); err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	file, err := os.Create(t.TempDir() + "/image.bin")
+	if err != nil {
+		t.Fatalf("Unable to create download: %v\n", err)
+	}
+	defer file.Close()
+	if _, err = newTestClient(t, network, "127.0.0.1:69").Get(context.Background(), "image.bin", func() (io.Writer, error) { return file, nil }, options); err != nil {
+		t.Fatalf("Remaining client failed: %v\n", err)
+	}
+	if err = <-leavingDone; !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("Leaving client returned %v instead of %v\n", err, ErrDiskFull)
+	}
+
+	if received, _ := os.ReadFile(file.Name()); !bytes.Equal(received, contents) {
+		t.Fatalf("Remaining client received %v bytes that differ from the %v sent\n", len(received), len(contents))
+	}
+	if members := multicastMembers(server); len(members) != 0 {
+		t.Fatalf("Transfer still has clients %v\n", members)
+	}
+}
+
+func TestParseMulticastOption(t *testing.T) {
+	previous := &net.UDPAddr{IP: net.IPv4(239, 255, 0, 1), Port: 1758}
+
+	cases := []struct {
+		value  string
+		group  string
+		master bool
+		valid  bool
+	}{
+		{"239.255.42.1,1758,1", "239.255.42.1:1758", true, true},
+		{"239.255.42.1,1759,0", "239.255.42.1:1759", false, true},
+		{",,1", "239.255.0.1:1758", true, true},
+		{"10.0.0.1,1758,1", "", false, false},
+		{"239.255.42.1,port,1", "", false, false},
+		{"239.255.42.1,1758,2", "", false, false},
+		{"239.255.42.1,1758", "", false, false},
+	}
+
+	for _, c := range cases {
+		group, master, err := parseMulticastOption(c.value, previous)
+		if !c.valid {
+			if err == nil {
+				t.Fatalf("%q accepted\n", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q refused: %v\n", c.value, err)
+		}
+		if group.String() != c.group || master != c.master {
+			t.Fatalf("%q parsed as %v %v instead of %v %v\n", c.value, group, master, c.group, c.master)
+		}
+	}
+
+	if _, _, err := parseMulticastOption(",,1", nil); err == nil {
+		t.Fatalf("Group left out before it was ever known\n")
+	}
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"io"
+)
+
+const (
+	ModeNetascii = "netascii"
+	ModeOctet    = "octet"
+)
+
+/*
+ * Netascii as described by RFC 1350 and RFC 764 sends:
+ * local newline (LF) as CR LF
+ * bare carriage return (CR) as CR NUL
+ * everything else as is
+ */
+type netasciiState struct {
+	// when encoding, the second byte of a translated pair that did not fit in the previous block
+	// when decoding, a CR at the end of the previous block still waiting on the byte after it
+	pending    byte
+	hasPending bool
+}
+
+// translate local bytes from src into netascii in dst, stopping when either is exhausted
+// returns the number of bytes written to dst and the number of bytes consumed from src
+func (state *netasciiState) encode(dst, src []byte) (int, int) {
+	var written, consumed int
+
+	if state.hasPending && len(dst) > 0 {
+		dst[0] = state.pending
+		state.hasPending = false
+		written += 1
+	}
+
+	for consumed < len(src) && written < len(dst) {
+		var second byte
+
+		switch src[consumed] {
+		case '\n':
+			dst[written] = '\r'
+			second = '\n'
+		case '\r':
+			dst[written] = '\r'
+			second = 0
+		default:
+			dst[written] = src[consumed]
+			written += 1
+			consumed += 1
+			continue
+		}
+		written += 1
+		consumed += 1
+
+		// the pair straddles two blocks so hold on to the second byte for the next one
+		if written == len(dst) {
+			state.pending = second
+			state.hasPending = true
+			break
+		}
+		dst[written] = second
+		written += 1
+	}
+
+	return written, consumed
+}
+
+// translate netascii bytes from src into local bytes appended to dst
+func (state *netasciiState) decode(dst, src []byte) []byte {
+	for _, b := range src {
+		if state.hasPending {
+			state.hasPending = false
+			switch b {
+			case '\n':
+				dst = append(dst, '\n')
+				continue
+			case 0:
+				dst = append(dst, '\r')
+				continue
+			default:
+				// not valid netascii, keep the CR rather than lose data
+				dst = append(dst, '\r')
+			}
+		}
+
+		if b == '\r' {
+			state.hasPending = true
+			continue
+		}
+		dst = append(dst, b)
+	}
+
+	return dst
+}
+
+// called once the last block has been decoded, returns any CR that was never followed by anything
+func (state *netasciiState) flush(dst []byte) []byte {
+	if state.hasPending {
+		state.hasPending = false
+		dst = append(dst, '\r')
+	}
+
+	return dst
+}
+
+// number of bytes reader produces once translated into netascii
+func netasciiSize(reader io.Reader) (int64, error) {
+	var size int64
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := reader.Read(buf)
+		size += int64(n)
+		for _, b := range buf[:n] {
+			if b == '\n' || b == '\r' {
+				size += 1
+			}
+		}
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
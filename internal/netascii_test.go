@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+// encode src one block at a time, the same way readNetascii fills data messages
+func encodeInBlocks(src []byte, blockSize int) [][]byte {
+	var state netasciiState
+	var blocks [][]byte
+
+	for {
+		block := make([]byte, blockSize)
+		filled := 0
+		for filled < blockSize && (len(src) > 0 || state.hasPending) {
+			written, consumed := state.encode(block[filled:], src)
+			filled += written
+			src = src[consumed:]
+		}
+		blocks = append(blocks, block[:filled])
+		if filled < blockSize {
+			return blocks
+		}
+	}
+}
+
+func TestNetasciiEncode(t *testing.T) {
+	input := []byte("a\nb\rc")
+	expected := []byte("a\r\nb\r\x00c")
+
+	blocks := encodeInBlocks(input, 512)
+	if len(blocks) != 1 || !bytes.Equal(blocks[0], expected) {
+		t.Fatalf("%v != %v\n", blocks, expected)
+	}
+}
+
+func TestNetasciiEncodeAcrossBlocks(t *testing.T) {
+	// the LF is translated into a CR LF pair split between the first and second block
+	input := []byte("abc\nd")
+	expected := [][]byte{[]byte("abc\r"), []byte("\nd")}
+
+	blocks := encodeInBlocks(input, 4)
+	if len(blocks) != len(expected) {
+		t.Fatalf("%q != %q\n", blocks, expected)
+	}
+	for i := range expected {
+		if !bytes.Equal(blocks[i], expected[i]) {
+			t.Fatalf("%q != %q\n", blocks, expected)
+		}
+	}
+}
+
+func TestNetasciiDecodeAcrossBlocks(t *testing.T) {
+	var state netasciiState
+	var output []byte
+
+	output = state.decode(output, []byte("abc\r"))
+	output = state.decode(output, []byte("\nd\r"))
+	output = state.decode(output, []byte("\x00e\r"))
+	output = state.flush(output)
+
+	expected := []byte("abc\nd\re\r")
+	if !bytes.Equal(output, expected) {
+		t.Fatalf("%q != %q\n", output, expected)
+	}
+}
+
+func TestNetasciiRoundTrip(t *testing.T) {
+	input := []byte("\r\n\n\r\rline one\nline two\r\nno newline at end\r")
+
+	for blockSize := 1; blockSize <= len(input)*2+1; blockSize++ {
+		var state netasciiState
+		var output []byte
+		var total int
+
+		blocks := encodeInBlocks(input, blockSize)
+		for _, block := range blocks {
+			total += len(block)
+			output = state.decode(output, block)
+		}
+		output = state.flush(output)
+
+		if !bytes.Equal(output, input) {
+			t.Fatalf("blockSize %v: %q != %q\n", blockSize, output, input)
+		}
+
+		size, err := netasciiSize(bytes.NewReader(input))
+		if err != nil {
+			t.Fatalf("netasciiSize failed: %v\n", err)
+		}
+		if size != int64(total) {
+			t.Fatalf("blockSize %v: netasciiSize %v != encoded length %v\n", blockSize, size, total)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// returned by an option handler to leave its option out of the option acknowledgement
+var ErrOptionIgnored = errors.New("Option ignored")
+
+/*
+ * Negotiates a single option as described by RFC 2347.
+ * Called with the value the other side asked for, returns the value to acknowledge.
+ * The returned value may differ from the one requested, for example when it is clamped.
+ * Returning ErrOptionIgnored leaves the option out of the option acknowledgement.
+ * Returning any other error rejects the request, which is answered with ErrOptionRefused.
+ */
+type OptionHandler func(session *TftpSession, value string) (string, error)
+
+// options this implementation knows how to negotiate keyed by lowercase name
+// options missing from here are ignored
+var optionHandlers map[string]OptionHandler = make(map[string]OptionHandler)
+
+// add or replace the handler used to negotiate name
+// must be called before any session is started, usually from an init function
+func RegisterOption(name string, handler OptionHandler) {
+	optionHandlers[strings.ToLower(name)] = handler
+}
+
+func init() {
+	RegisterOption("blksize", blockSizeOption)
+	RegisterOption("timeout", timeoutOption)
+	RegisterOption("tsize", transferSizeOption)
+	RegisterOption("rollover", rolloverOption)
+	RegisterOption("windowsize", windowSizeOption)
+	RegisterOption("multicast", multicastOption)
+}
+
+// negotiate every option in options, keeping only the ones that were accepted in session.Options
+// on the server options are what the client asked for, on the client they are what the server acknowledged
+func (session *TftpSession) UpdateOptions(options map[string]string) error {
+	var accepted map[string]string = make(map[string]string)
+	var asClient bool = session.Operation == ReadAsClient || session.Operation == WriteAsClient
+
+	for keyCased, value := range options {
+		key := strings.ToLower(keyCased)
+
+		// a server must not acknowledge an option the client never asked for
+		if _, requested := session.Options[key]; asClient && !requested {
+			return newError(ErrOptionRefused, fmt.Sprintf("Server acknowledged %v which was never requested", key))
+		}
+
+		handler, ok := optionHandlers[key]
+		if !ok {
+			if session.Cfg.Debug {
+				session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Ignoring unknown option %v", key))
+			}
+			continue
+		}
+
+		value, err := handler(session, value)
+		if errors.Is(err, ErrOptionIgnored) {
+			if session.Cfg.Debug {
+				session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Ignoring option %v", key))
+			}
+			continue
+		} else if err != nil {
+			return newError(ErrOptionRefused, err.Error())
+		}
+		accepted[key] = value
+	}
+
+	session.Options = accepted
+
+	return nil
+}
+
+// parse value as a base 10 integer between low and high inclusive
+func parseOption(name string, value string, low int64, high int64) (int64, error) {
+	valueInt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid %v value %q", name, value))
+	}
+	if valueInt < low || valueInt > high {
+		return 0, errors.New(fmt.Sprintf("Invalid %v value %v", name, valueInt))
+	}
+
+	return valueInt, nil
+}
+
+// RFC 2348, the server may answer with a smaller block size than the one requested
+func blockSizeOption(session *TftpSession, value string) (string, error) {
+	valueInt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Invalid blksize value %q", value))
+	}
+	if valueInt < 8 {
+		return "", errors.New(fmt.Sprintf("Invalid blksize value %v", valueInt))
+	}
+
+	switch session.Operation {
+	case ReadAsServer, WriteAsServer:
+		valueInt = min(valueInt, 65464)
+	default:
+		// the server may only shrink what the client asked for
+		requested, err := strconv.ParseInt(session.Options["blksize"], 10, 64)
+		if err != nil || valueInt > requested {
+			return "", errors.New(fmt.Sprintf("Server acknowledged blksize %v larger than requested", valueInt))
+		}
+	}
+
+	session.BlockSize = uint16(valueInt)
+	return strconv.FormatInt(valueInt, 10), nil
+}
+
+// RFC 2349, a timeout outside of 1 to 255 seconds is left unacknowledged
+func timeoutOption(session *TftpSession, value string) (string, error) {
+	valueInt, err := parseOption("timeout", value, 1, 255)
+	if err != nil {
+		return "", ErrOptionIgnored
+	}
+
+	session.Timeout = time.Second * time.Duration(valueInt)
+	return value, nil
+}
+
+// RFC 2349, a tsize of 0 in a read request asks the server for the size of the file
+func transferSizeOption(session *TftpSession, value string) (string, error) {
+	valueInt, err := parseOption("tsize", value, 0, 1<<63-1)
+	if err != nil {
+		return "", err
+	}
+
+	if valueInt == 0 && session.Operation == ReadAsServer {
+		start, err := session.tell()
+		if err == nil {
+			valueInt, err = remainingSize(session.Reader)
+		}
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Unable to get the size of %v", session.Filename))
+		}
+
+		// netascii grows the file by a byte for every CR and LF
+		if session.Mode == ModeNetascii {
+			valueInt, err = netasciiSize(io.LimitReader(session.Reader, valueInt))
+			if err == nil {
+				err = session.seek(start)
+			}
+			if err != nil {
+				return "", errors.New(fmt.Sprintf("Unable to get the size of %v", session.Filename))
+			}
+		}
+	}
+
+	session.TransferSize = uint64(valueInt)
+	return strconv.FormatInt(valueInt, 10), nil
+}
+
+// de-facto option choosing whether block numbers wrap from 65535 to 0 or to 1
+func rolloverOption(session *TftpSession, value string) (string, error) {
+	valueInt, err := parseOption("rollover", value, 0, 1)
+	if err != nil {
+		return "", err
+	}
+
+	session.Rollover = uint16(valueInt)
+	return value, nil
+}
+
+// RFC 7440 limits windowsize to between 1 and 65535 blocks and the server may answer with a smaller one
+func windowSizeOption(session *TftpSession, value string) (string, error) {
+	valueInt, err := parseOption("windowsize", value, 1, 65535)
+	if err != nil {
+		return "", err
+	}
+	if session.Operation == ReadAsClient || session.Operation == WriteAsClient {
+		// the server may only shrink what the client asked for
+		requested, err := strconv.ParseInt(session.Options["windowsize"], 10, 64)
+		if err != nil || valueInt > requested {
+			return "", errors.New(fmt.Sprintf("Server acknowledged windowsize %v larger than requested", valueInt))
+		}
+	}
+
+	session.WindowSize = uint16(valueInt)
+	return value, nil
+}
+
+// RFC 2090, servers fill in the value once the client joins a multicast transfer
+func multicastOption(session *TftpSession, value string) (string, error) {
+	switch session.Operation {
+	case ReadAsServer:
+		if session.Cfg.MulticastAddress == "" || session.Mode != ModeOctet {
+			return "", ErrOptionIgnored
+		}
+		return "", nil
+	case ReadAsClient:
+		group, master, err := parseMulticastOption(value, session.MulticastGroup)
+		if err != nil {
+			return "", err
+		}
+		session.MulticastGroup, session.MasterClient = group, master
+		return value, nil
+	default:
+		return "", ErrOptionIgnored
+	}
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestUpdateOptionsAcknowledgesOnlyAccepted(t *testing.T) {
+	var session TftpSession = TftpSession{Cfg: &Config{}}
+	session.Operation = WriteAsServer
+
+	err := session.UpdateOptions(map[string]string{
+		"BLKSIZE":    "70000",
+		"timeout":    "0",
+		"windowsize": "4",
+		"unknown":    "1",
+	})
+	if err != nil {
+		t.Fatalf("UpdateOptions failed: %v\n", err)
+	}
+
+	expected := map[string]string{"blksize": "65464", "windowsize": "4"}
+	if !maps.Equal(session.Options, expected) {
+		t.Fatalf("%v != %v\n", session.Options, expected)
+	}
+	if session.BlockSize != 65464 || session.WindowSize != 4 {
+		t.Fatalf("blksize %v and windowsize %v not applied\n", session.BlockSize, session.WindowSize)
+	}
+}
+
+func TestUpdateOptionsRejectsMalformed(t *testing.T) {
+	cases := []map[string]string{
+		{"blksize": "big"},
+		{"blksize": "7"},
+		{"windowsize": "0"},
+		{"rollover": "2"},
+		{"tsize": "-1"},
+	}
+
+	for _, options := range cases {
+		var session TftpSession = TftpSession{Cfg: &Config{}}
+		session.Operation = WriteAsServer
+		if err := session.UpdateOptions(options); err == nil {
+			t.Fatalf("UpdateOptions accepted %v\n", options)
+		}
+	}
+}
+
+func TestUpdateOptionsClientRejectsSurprises(t *testing.T) {
+	var session TftpSession = TftpSession{Cfg: &Config{}}
+	session.Operation = ReadAsClient
+	session.Options = map[string]string{"blksize": "1024"}
+
+	if err := session.UpdateOptions(map[string]string{"windowsize": "4"}); err == nil {
+		t.Fatalf("Client accepted an option it never requested\n")
+	}
+
+	session.Options = map[string]string{"blksize": "1024"}
+	if err := session.UpdateOptions(map[string]string{"blksize": "2048"}); err == nil {
+		t.Fatalf("Client accepted a blksize larger than it requested\n")
+	}
+
+	session.Options = map[string]string{"blksize": "1024"}
+	if err := session.UpdateOptions(map[string]string{"blksize": "512"}); err != nil || session.BlockSize != 512 {
+		t.Fatalf("Client refused a smaller blksize: %v\n", err)
+	}
+
+	session.Options = map[string]string{"windowsize": "4"}
+	if err := session.UpdateOptions(map[string]string{"windowsize": "8"}); err == nil {
+		t.Fatalf("Client accepted a windowsize larger than it requested\n")
+	}
+
+	session.Operation = WriteAsClient
+	session.Options = map[string]string{"windowsize": "4"}
+	if err := session.UpdateOptions(map[string]string{"windowsize": "2"}); err != nil || session.WindowSize != 2 {
+		t.Fatalf("Client refused a smaller windowsize: %v\n", err)
+	}
+}
+
+func TestRegisterOption(t *testing.T) {
+	var session TftpSession = TftpSession{Cfg: &Config{}}
+	session.Operation = ReadAsServer
+
+	RegisterOption("X-Site", func(session *TftpSession, value string) (string, error) {
+		if value == "skip" {
+			return "", ErrOptionIgnored
+		}
+		return value + "!", nil
+	})
+	defer delete(optionHandlers, "x-site")
+
+	if err := session.UpdateOptions(map[string]string{"x-site": "hello"}); err != nil {
+		t.Fatalf("UpdateOptions failed: %v\n", err)
+	}
+	if session.Options["x-site"] != "hello!" {
+		t.Fatalf("%v != hello!\n", session.Options["x-site"])
+	}
+
+	if err := session.UpdateOptions(map[string]string{"x-site": "skip"}); err != nil {
+		t.Fatalf("UpdateOptions failed: %v\n", err)
+	}
+	if _, ok := session.Options["x-site"]; ok {
+		t.Fatalf("Ignored option was acknowledged\n")
+	}
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Which out of date versions of a file are kept once nobody reads them instead of being deleted.
+ * The first rule whose pattern matches the filename applies, files matching none keep only the newest version and the one before it.
+ * Those two are always kept so that a bad upload can be rolled back.
+ */
+type RetentionPolicy []RetentionRule
+
+// keep the newest Keep versions and every version younger than MaxAge of the files matching Pattern
+type RetentionRule struct {
+	// matched against the whole filename with path.Match, so * never matches a /
+	Pattern string
+	// the newest version and the one before it are always kept even when this is lower
+	Keep int
+	// measured from when the upload completed, 0 to only go by Keep
+	MaxAge time.Duration
+}
+
+/*
+ * Parse a rule written as pattern=value[,value] where each value is either a number of versions or a duration.
+ * For example "pxelinux.cfg/*=5", "*.img=72h", or "*=3,24h" which keeps at least three versions and any younger than a day.
+ */
+func ParseRetentionRule(text string) (RetentionRule, error) {
+	var rule RetentionRule
+
+	pattern, values, found := strings.Cut(text, "=")
+	if !found || pattern == "" || values == "" {
+		return rule, fmt.Errorf("Retention rule is not pattern=value[,value]: %v", text)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return rule, fmt.Errorf("Invalid retention pattern %v: %w", pattern, err)
+	}
+	rule.Pattern = pattern
+
+	for value := range strings.SplitSeq(values, ",") {
+		if keep, err := strconv.Atoi(value); err == nil && keep >= 0 {
+			rule.Keep = keep
+		} else if maxAge, err := time.ParseDuration(value); err == nil && maxAge >= 0 {
+			rule.MaxAge = maxAge
+		} else {
+			return rule, fmt.Errorf("Retention value is neither a number of versions nor a duration: %v", value)
+		}
+	}
+
+	return rule, nil
+}
+
+// the rule that applies to filename
+func (policy RetentionPolicy) rule(filename string) RetentionRule {
+	for _, rule := range policy {
+		if matched, _ := path.Match(rule.Pattern, filename); matched {
+			return rule
+		}
+	}
+
+	return RetentionRule{Pattern: "*", Keep: 2}
+}
+
+// whether the completed version of filename with newer completed versions after it and completed at completed is kept
+func (policy RetentionPolicy) retains(filename string, newer int, completed int64, now time.Time) bool {
+	rule := policy.rule(filename)
+
+	// the version before the newest one is pinned so that the newest can be rolled back
+	if newer <= 1 || newer < rule.Keep {
+		return true
+	}
+
+	return rule.MaxAge > 0 && now.Sub(time.UnixMicro(completed)) < rule.MaxAge
+}
+
+// check a whole policy at once, for callers that build one by hand
+func (policy RetentionPolicy) validate() error {
+	for _, rule := range policy {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid retention pattern %v: %w", rule.Pattern, err)
+		}
+		if rule.Keep < 0 || rule.MaxAge < 0 {
+			return errors.New("Retention rules can not keep a negative number of versions or age")
+		}
+	}
+
+	return nil
+}
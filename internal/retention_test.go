@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionRule(t *testing.T) {
+	cases := map[string]RetentionRule{
+		"pxelinux.cfg/*=5": {Pattern: "pxelinux.cfg/*", Keep: 5},
+		"*.img=72h":        {Pattern: "*.img", MaxAge: 72 * time.Hour},
+		"*=3,24h":          {Pattern: "*", Keep: 3, MaxAge: 24 * time.Hour},
+	}
+	for text, expected := range cases {
+		rule, err := ParseRetentionRule(text)
+		if err != nil || rule != expected {
+			t.Fatalf("%v parsed as %+v %v instead of %+v\n", text, rule, err, expected)
+		}
+	}
+
+	for _, text := range []string{"*", "=5", "*=", "*=-1", "*=soon", "[=5"} {
+		if rule, err := ParseRetentionRule(text); err == nil {
+			t.Fatalf("%v parsed as %+v\n", text, rule)
+		}
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour).UnixMicro()
+	policy := RetentionPolicy{
+		{Pattern: "boot/*", Keep: 3},
+		{Pattern: "*.img", MaxAge: 2 * time.Hour},
+		{Pattern: "*", Keep: 2, MaxAge: time.Minute},
+	}
+
+	cases := []struct {
+		filename string
+		newer    int
+		expected bool
+	}{
+		{"boot/kernel", 2, true},
+		{"boot/kernel", 3, false},
+		// * never matches a /
+		{"boot/kernel.img", 3, false},
+		{"kernel.img", 10, true},
+		{"kernel", 1, true},
+		{"kernel", 2, false},
+	}
+	for _, c := range cases {
+		if policy.retains(c.filename, c.newer, hourAgo, now) != c.expected {
+			t.Fatalf("Version of %v with %v newer ones retained: %v\n", c.filename, c.newer, !c.expected)
+		}
+	}
+
+	// the newest version and the one before it are always kept and nothing else is without a policy
+	if !RetentionPolicy(nil).retains("kernel", 1, hourAgo, now) || RetentionPolicy(nil).retains("kernel", 2, now.UnixMicro(), now) {
+		t.Fatalf("Empty policy keeps more than the newest version and the one before it\n")
+	}
+	if !(RetentionPolicy{{Pattern: "*", Keep: 0}}).retains("kernel", 1, hourAgo, now) {
+		t.Fatalf("Version before the newest one was not pinned\n")
+	}
+}
+
+// kept versions survive garbage collection and are read by asking for name@<uploadStarted>
+func TestReadKeptVersion(t *testing.T) {
+	ctx := context.Background()
+	database := testStores(t, nil)["database"].(*Database)
+	database.retention = RetentionPolicy{{Pattern: "*.cfg", Keep: 3}}
+	handler := storeHandler{database}
+
+	for _, filename := range []string{"menu.cfg", "kernel"} {
+		for _, contents := range []string{"first", "second", "third", "fourth"} {
+			upload(t, database, filename, contents)
+		}
+	}
+	if err := database.GarbageCollect(ctx); err != nil {
+		t.Fatalf("Unable to collect garbage: %v\n", err)
+	}
+	kept, _ := database.Versions(ctx, "menu.cfg")
+	if len(kept) != 3 {
+		t.Fatalf("Versions of menu.cfg %+v instead of the newest three\n", kept)
+	}
+	if versions, _ := database.Versions(ctx, "kernel"); len(versions) != 2 {
+		t.Fatalf("Versions of kernel %+v instead of the newest and the one before it\n", versions)
+	}
+
+	cases := map[string]string{
+		"menu.cfg": "fourth",
+		"menu.cfg@" + strconv.FormatInt(kept[0].Started, 10): "second",
+		"menu.cfg@" + strconv.FormatInt(kept[2].Started, 10): "fourth",
+	}
+	for filename, expected := range cases {
+		reader, err := handler.ServeRead(ctx, &Request{Filename: filename})
+		if err != nil {
+			t.Fatalf("Unable to read %v: %v\n", filename, err)
+		}
+		contents, _ := io.ReadAll(reader)
+		reader.(io.Closer).Close()
+		if string(contents) != expected {
+			t.Fatalf("%v contains %q instead of %q\n", filename, contents, expected)
+		}
+	}
+
+	if _, err := handler.ServeRead(ctx, &Request{Filename: "menu.cfg@1"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Reading a deleted version returned %v instead of %v\n", err, ErrNotFound)
+	}
+	if _, err := handler.ServeWrite(ctx, &Request{Filename: "menu.cfg@1"}); !errors.Is(err, ErrAccessViolation) {
+		t.Fatalf("Uploading a version returned %v instead of %v\n", err, ErrAccessViolation)
+	}
+
+	// names that only look a little like versions are ordinary files
+	upload(t, database, "user@example", "not a version")
+	if reader, err := handler.ServeRead(ctx, &Request{Filename: "user@example"}); err != nil {
+		t.Fatalf("Unable to read user@example: %v\n", err)
+	} else {
+		reader.(io.Closer).Close()
+	}
+}
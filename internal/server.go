@@ -2,209 +2,319 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"os"
 	"sync"
-	"time"
 )
 
-func ServerInit() error {
-	var err error
+var ErrServerClosed = errors.New("Server closed")
 
-	// Find the row with a matching filename and the greatest uploadCompleted value returning that row. The only parameter is filename.
-	ReserveStatementSelect, err = DB.Prepare(`SELECT * FROM files WHERE
-        filename = ? AND
-        (filename, uploadCompleted, consumers) IN ( SELECT filename, MAX(uploadCompleted), consumers FROM files GROUP BY filename )
-        LIMIT 1;`)
-	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
-	}
+/*
+ * A TFTP server answering requests sent to Cfg.Address with the files kept in Cfg.Directory.
+ * Every server owns its config, logger, database, and listener so that many can run in one process.
+ * Create with NewServer, answer requests with Serve, and stop with Shutdown.
+ */
+type Server struct {
+	Cfg Config
+	Log chan<- logEvent
+	// where versions of files are kept, nil when Cfg names a handler for both reads and writes
+	Store Store
 
-	// Increment the number of consumers attached to the row with a matching filename and the greatest uploadCompleted value. The only parameter is filename.
-	ReserveStatementUpdate, err = DB.Prepare(`UPDATE files SET consumers = consumers + 1 WHERE
-        filename = ? AND
-        (filename, uploadCompleted, consumers) IN ( SELECT filename, MAX(uploadCompleted), consumers FROM files GROUP BY filename );`)
-	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
-	}
+	logger       *Logger
+	readHandler  ReadHandler
+	writeHandler WriteHandler
+	// whether the store was opened by the server rather than handed to it
+	ownsStore bool
+	// stops watching the root directory, nil unless cfg.Watch
+	stopWatching context.CancelFunc
+	watching     sync.WaitGroup
 
-	// Find all rows with this filename that are out of date and not being consumed.
-	ReleaseStatementSelect, err = DB.Prepare(`SELECT * FROM files WHERE
-            filename = ? AND
-            uploadCompleted != 0 AND
-            consumers = 0 AND
-            (rowid, filename, uploadCompleted) NOT IN ( SELECT rowid, filename, MAX(uploadCompleted) FROM files GROUP BY filename );`)
-	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
-	}
+	// transfers in progress keyed by the path of the version of the file they send
+	multicastLock      sync.Mutex
+	multicastTransfers map[string]*multicastTransfer
 
-	// Decrement if greater than 0 the number of consumers attached to the row with a matching filename and the associated uploadStarted value. The only parameters are filename and uploadStarted time.
-	ReleaseStatementUpdate, err = DB.Prepare(`UPDATE files SET consumers = consumers - 1 WHERE
-        consumers != 0 AND
-        filename = ? AND
-        uploadStarted = ?;`)
-	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
-	}
+	// guards everything below
+	lock   sync.Mutex
+	closed bool
+	conn   net.PacketConn
+	// cancels every session started by Serve
+	cancelSessions context.CancelFunc
+	// Serve calls in progress, each waits for its sessions before returning
+	serving sync.WaitGroup
+}
 
-	// Clear files with same filename if out of date and not being accessed. Deletes row if number of consumers is 0, file is not being uploaded, filename is the same, and this is not the newest version of this file. The only parameters are filename.
-	ReleaseStatementDelete, err = DB.Prepare(`DELETE FROM files WHERE
-        consumers == 0 AND
-        uploadCompleted != 0 AND
-        filename = ? AND
-        (filename, uploadCompleted, consumers) NOT IN ( SELECT filename, MAX(uploadCompleted), consumers FROM files GROUP BY filename );`)
-	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
-	}
+/*
+ * Start the logger and open the store, nothing is listened to until Serve is called.
+ * The store answers whichever of reads and writes cfg has no handler for,
+ * it is cfg.Store when set, otherwise cfg.Directory as it is for cfg.PlainDirectory or the database at cfg.Sqlite3DBPath.
+ */
+func NewServer(cfg Config) (*Server, error) {
+	var server Server = Server{Cfg: cfg, multicastTransfers: make(map[string]*multicastTransfer)}
+	var err error
 
-	// Create entry for filename at uploadedStarted where those are the parameters. uploadCompleted and consumers are 0 by default.
-	PrepareStatement, err = DB.Prepare(`INSERT INTO files(filename, uploadStarted, uploadCompleted, consumers) VALUES (?, ?, 0, 0);`)
+	server.logger, err = NewLogger(&server.Cfg)
 	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
+		return nil, err
 	}
+	server.Log = server.logger.Events
 
-	// Delete row created at the beginning of the upload because it failed. Parameters are filename and uploadStarted.
-	OverwriteFailureStatement, err = DB.Prepare(`DELETE FROM files WHERE filename = ? AND uploadStarted = ?;`)
-	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
+	server.readHandler, server.writeHandler = cfg.ReadHandler, cfg.WriteHandler
+	if server.readHandler != nil && server.writeHandler != nil {
+		return &server, nil
 	}
 
-	// Find all rows with this filename that are out of date and not being consumed.
-	OverwriteSuccessSelect, err = DB.Prepare(`SELECT * FROM files WHERE
-            filename = ? AND
-            uploadCompleted != 0 AND
-            consumers = 0 AND
-            (rowid, filename, uploadCompleted) NOT IN ( SELECT rowid, filename, MAX(uploadCompleted) FROM files GROUP BY filename );`)
-	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
+	server.Store = cfg.Store
+	if server.Store == nil {
+		if cfg.PlainDirectory {
+			server.Store, err = OpenDirectoryStore(&server.Cfg, server.Log)
+		} else {
+			server.Store, err = OpenDatabase(&server.Cfg, server.Log)
+		}
+		if err != nil {
+			server.logger.Close()
+			return nil, err
+		}
+		server.ownsStore = true
+	}
+	if server.readHandler == nil {
+		server.readHandler = storeHandler{server.Store}
+	}
+	if server.writeHandler == nil {
+		server.writeHandler = storeHandler{server.Store}
 	}
 
-	// Update row created at the beginning of the upload to reflect its success. Parameters are uploadCompleted, filename, and uploadStarted.
-	OverwriteSuccessUpdate, err = DB.Prepare(`UPDATE files SET uploadCompleted = ? WHERE filename = ? AND uploadStarted = ?;`)
-	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
+	if cfg.Watch {
+		err = server.watch()
+		if err != nil {
+			if server.ownsStore {
+				server.Store.Close()
+			}
+			server.logger.Close()
+			return nil, err
+		}
 	}
 
-	// Clear files with same filename if out of date and not being accessed. Deletes row if number of consumers is 0, file is not being uploaded, filename is the same, and this is not the newest version of this file. The only parameters are filename.
-	OverwriteSuccessDelete, err = DB.Prepare(`DELETE FROM files WHERE
-        consumers == 0 AND
-        uploadCompleted != 0 AND
-        filename = ? AND
-        (filename, uploadCompleted, consumers) NOT IN ( SELECT filename, MAX(uploadCompleted), consumers FROM files GROUP BY filename );`)
-	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Failed setup to talk to internal database: %v", Cfg.Address))
-		return err
+	return &server, nil
+}
+
+// adopt files put in the root directory until Shutdown
+func (server *Server) watch() error {
+	database, ok := server.Store.(*Database)
+	if !ok {
+		server.Log <- NewErrorEvent("SERVER", "Only the sqlite database can watch the root directory")
+		return errors.New("Only the sqlite database can watch the root directory")
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	server.stopWatching = cancel
+	server.watching.Go(func() {
+		err := database.Watch(ctx)
+		if ctx.Err() == nil {
+			server.Log <- NewErrorEvent("SERVER", fmt.Sprintf("Stopped watching the root directory: %v", err))
+		}
+	})
+
 	return nil
 }
 
-func ServerRoutine(childToParent chan<- Signal, parentToChild <-chan Signal) {
+/*
+ * Answer requests until ctx is done or Shutdown is called, each one handled by a session of its own.
+ * Once ctx is done every session is cancelled, otherwise sessions are left to finish.
+ * Returns ErrServerClosed after Shutdown and whatever stopped the server otherwise.
+ */
+func (server *Server) Serve(ctx context.Context) error {
 	var (
 		// 0xffff is maximum possible in-transit packet size with TFTP
 		incoming []byte = make([]byte, 0xffff)
 		sessions sync.WaitGroup
 	)
 
-	serverAddr, err := net.ResolveUDPAddr("udp", Cfg.Address)
+	serverAddr, err := net.ResolveUDPAddr("udp", server.Cfg.Address)
 	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Unable to resolve address: %v", serverAddr.String()))
-		childToParent <- NewSignal(SignalTerminate, SignalRequest)
-		<-parentToChild
-		return
+		server.Log <- NewErrorEvent("SERVER", fmt.Sprintf("Unable to resolve address: %v", server.Cfg.Address))
+		return err
 	}
 
-	conn, err := net.ListenUDP("udp", serverAddr)
+	conn, err := server.Cfg.listenPacket(serverAddr)
 	if err != nil {
-		Log <- NewErrorEvent("SERVER", fmt.Sprintf("Unable to bind to address: %v", Cfg.Address))
-		childToParent <- NewSignal(SignalTerminate, SignalRequest)
-		<-parentToChild
-		return
+		server.Log <- NewErrorEvent("SERVER", fmt.Sprintf("Unable to bind to address: %v", server.Cfg.Address))
+		return err
 	}
-	defer conn.Close()
 
-	Log <- NewNormalEvent("SERVER", fmt.Sprintf("Server successfully bound to: %v", serverAddr.String()))
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// Prepare context and set prepared statements sessions goroutines need
-	ctx, cancel := context.WithCancel(context.Background())
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	if server.conn != nil {
+		server.lock.Unlock()
+		conn.Close()
+		return errors.New("Server already serving")
+	}
+	server.conn, server.cancelSessions = conn, cancel
+	server.serving.Add(1)
+	server.lock.Unlock()
+	defer func() {
+		server.lock.Lock()
+		server.conn, server.cancelSessions = nil, nil
+		server.lock.Unlock()
+		server.serving.Done()
+	}()
 
-	for true {
-		conn.SetReadDeadline(time.Now().Add(time.Second))
-		n, clientAddr, err := conn.ReadFromUDP(incoming)
+	server.Log <- NewNormalEvent("SERVER", fmt.Sprintf("Server successfully bound to: %v", conn.LocalAddr().String()))
 
-		select {
-		case sig := <-parentToChild:
-			childToParent <- NewSignal(sig.Kind, SignalAccept)
-			cancel()
+	// closing the listener is what stops the loop below
+	stopListening := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopListening()
+
+	// each session listens on a new port of the same address, this port becomes the server's transfer id
+	sessionAddr := &net.UDPAddr{IP: serverAddr.IP, Zone: serverAddr.Zone}
+
+	for {
+		n, from, err := conn.ReadFrom(incoming)
+		if err != nil {
+			conn.Close()
+
+			server.lock.Lock()
+			closed := server.closed
+			server.lock.Unlock()
+
+			if ctx.Err() != nil {
+				cancel()
+				err = context.Cause(ctx)
+			} else if closed {
+				err = ErrServerClosed
+			} else {
+				server.Log <- NewErrorEvent("SERVER", fmt.Sprintf("Unable to receive requests: %v", err))
+				cancel()
+			}
 			sessions.Wait()
-			return
-		default:
-			// no need to stop
+
+			return err
 		}
 
-		if os.IsTimeout(err) {
+		clientAddr, err := udpAddr(from)
+		if err != nil {
+			server.Log <- NewErrorEvent("SERVER", fmt.Sprintf("Unable to understand address: %v", from))
 			continue
-		} else if err != nil {
-			childToParent <- NewSignal(SignalTerminate, SignalRequest)
-			<-parentToChild
-			cancel()
-			sessions.Wait()
-			return
 		}
 
 		incomingCopy := make([]byte, n)
 		if copy(incomingCopy, incoming[:n]) != n {
-			Log <- NewErrorEvent("SERVER", "Truncation error when reading message")
+			server.Log <- NewErrorEvent("SERVER", "Truncation error when reading message")
 			continue
 		}
 
-		sessions.Go(func() { sessionRoutine(ctx, clientAddr, incomingCopy) })
+		sessions.Go(func() { server.sessionRoutine(sessionCtx, sessionAddr, clientAddr, incomingCopy) })
 	}
 }
 
-func sessionRoutine(ctx context.Context, destinationAddr *net.UDPAddr, bytes []byte) {
+// address requests are answered on, nil unless serving
+func (server *Server) Addr() net.Addr {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.conn == nil {
+		return nil
+	}
+
+	return server.conn.LocalAddr()
+}
+
+/*
+ * Stop listening and wait for every session to finish, then close the store it opened and the logger.
+ * When ctx is done before the sessions finish they are cancelled and ctx's error is returned.
+ * The server can not be used again afterwards.
+ */
+func (server *Server) Shutdown(ctx context.Context) error {
 	var err error
-	var destination *net.UDPConn
 
-	destination, err = net.DialUDP("udp", nil, destinationAddr)
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		return ErrServerClosed
+	}
+	server.closed = true
+	if server.conn != nil {
+		server.conn.Close()
+	}
+	server.lock.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		server.serving.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		// every session finished on its own
+	case <-ctx.Done():
+		server.lock.Lock()
+		if server.cancelSessions != nil {
+			server.cancelSessions()
+		}
+		server.lock.Unlock()
+		<-stopped
+		err = context.Cause(ctx)
+	}
+
+	if server.stopWatching != nil {
+		server.stopWatching()
+		server.watching.Wait()
+	}
+	if server.ownsStore {
+		server.Store.Close()
+	}
+	server.Log <- NewNormalEvent("SERVER", "Server shut down")
+	server.logger.Close()
+
+	return err
+}
+
+func (server *Server) sessionRoutine(ctx context.Context, sessionAddr *net.UDPAddr, destinationAddr *net.UDPAddr, bytes []byte) {
+	var err error
+	var destination net.PacketConn
+
+	// not connected to destinationAddr so that messages from other addresses can be refused
+	destination, err = server.Cfg.listenPacket(sessionAddr)
 	if err != nil {
-		Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Failed to create tftpSession: %v", err))
+		server.Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Failed to create tftpSession: %v", err))
 		return
 	}
-	session, err := NewTftpSession(ctx, destination)
+	session, err := NewTftpSession(ctx, &server.Cfg, server.Log, destination)
 	if err != nil {
-		Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Failed to create tftpSession: %v", err))
+		server.Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Failed to create tftpSession: %v", err))
 		return
 	}
 	defer session.Close()
+	session.Server = server
+	session.DestinationAddr = destinationAddr
+	session.TransferId = destinationAddr
 
 	operation, err := session.Accept(bytes)
 	if err != nil {
-		session.ErrorMessage(ErrorCodeUndefined, fmt.Sprintf("%v", err))
-		Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Session routine failed to accept: %v", err))
+		session.ReportError(err)
+		server.Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Session routine failed to accept: %v", err))
 		return
 	}
 
 	switch operation {
 	case ReadAsServer:
-		Log <- NewNormalEvent(session.DestinationAddr.String(), fmt.Sprintf("Client began download: %v", session.Filename))
+		server.Log <- NewNormalEvent(session.DestinationAddr.String(), fmt.Sprintf("Client began download: %v", session.Filename))
 		err = session.ReadAsServer()
 	case WriteAsServer:
-		Log <- NewNormalEvent(session.DestinationAddr.String(), fmt.Sprintf("Client began upload: %v", session.Filename))
+		server.Log <- NewNormalEvent(session.DestinationAddr.String(), fmt.Sprintf("Client began upload: %v", session.Filename))
 		err = session.WriteAsServer()
 	default:
-		session.ErrorMessage(ErrorCodeUndefined, "Client requested invalid operation")
-		Log <- NewErrorEvent(session.DestinationAddr.String(), "Client requested invalid operation")
+		err = newError(ErrIllegalOperation, "Client requested invalid operation")
+		session.ReportError(err)
+		server.Log <- NewErrorEvent(session.DestinationAddr.String(), fmt.Sprintf("%v", err))
 		return
 	}
 
@@ -212,19 +322,22 @@ func sessionRoutine(ctx context.Context, destinationAddr *net.UDPAddr, bytes []b
 	if err != nil {
 		switch operation {
 		case ReadAsServer:
-			Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Client failed download: %v", err))
+			server.Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Client failed download: %v", err))
 		case WriteAsServer:
-			Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Client failed upload: %v", err))
+			server.Log <- NewErrorEvent(destinationAddr.String(), fmt.Sprintf("Client failed upload: %v", err))
+		}
+		// the session may have already explained the problem to the client
+		if session.LastSentMessageType() != OpcodeErrorByte {
+			session.ReportError(err)
 		}
-		session.ErrorMessage(ErrorCodeUndefined, fmt.Sprintf("%v", err))
 		return
 	}
 
 	switch operation {
 	case ReadAsServer:
-		Log <- NewNormalEvent(destinationAddr.String(), fmt.Sprintf("Client completed download: %v", session.Filename))
+		server.Log <- NewNormalEvent(destinationAddr.String(), fmt.Sprintf("Client completed download: %v", session.Filename))
 	case WriteAsServer:
-		Log <- NewNormalEvent(destinationAddr.String(), fmt.Sprintf("Client completed upload: %v", session.Filename))
+		server.Log <- NewNormalEvent(destinationAddr.String(), fmt.Sprintf("Client completed upload: %v", session.Filename))
 	}
 	return
 }
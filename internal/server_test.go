@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// server with a root directory and database of its own listening on address of network
+func newTestServer(t *testing.T, network Network, address string) (*Server, <-chan error) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/root", 0755); err != nil {
+		t.Fatalf("Unable to create root: %v\n", err)
+	}
+	root, err := os.OpenRoot(dir + "/root")
+	if err != nil {
+		t.Fatalf("Unable to open root: %v\n", err)
+	}
+	t.Cleanup(func() { root.Close() })
+
+	server, err := NewServer(Config{
+		Network:       network,
+		Retries:       5,
+		Backoff:       1,
+		Directory:     root,
+		Sqlite3DBPath: dir + "/tftpcpd.db",
+		NormalLogFile: dir + "/normal.log",
+		ErrorLogFile:  dir + "/error.log",
+		Address:       address,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create server: %v\n", err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(context.Background()) }()
+	for deadline := time.Now().Add(time.Second); server.Addr() == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server never started listening on %v\n", address)
+		}
+	}
+
+	return server, served
+}
+
+func newTestClient(t *testing.T, network Network, address string) *Client {
+	client, err := NewClient(Config{Network: network, Retries: 5, Backoff: 1, Mode: ModeOctet, Address: address})
+	if err != nil {
+		t.Fatalf("Unable to create client: %v\n", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// two servers in one process share nothing but the network they listen on
+func TestServersAreIsolated(t *testing.T) {
+	network := NewMemoryNetwork()
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	first, firstServed := newTestServer(t, network, "127.0.0.1:69")
+	second, secondServed := newTestServer(t, network, "127.0.0.1:70")
+	firstClient := newTestClient(t, network, "127.0.0.1:69")
+	secondClient := newTestClient(t, network, "127.0.0.1:70")
+
+	contents := bytes.Repeat([]byte("tftpcpd"), 300)
+	if err := os.WriteFile("only-first.bin", contents, 0644); err != nil {
+		t.Fatalf("Unable to write upload: %v\n", err)
+	}
+	// the upload dallies for a while after it completes and shutting down waits for it
+	if err := firstClient.Write(context.Background(), "only-first.bin", map[string]string{"timeout": "1"}); err != nil {
+		t.Fatalf("Upload failed: %v\n", err)
+	}
+	os.Remove("only-first.bin")
+
+	if err := firstClient.Read(context.Background(), "only-first.bin", map[string]string{}); err != nil {
+		t.Fatalf("Download failed: %v\n", err)
+	}
+	if received, _ := os.ReadFile("only-first.bin"); !bytes.Equal(received, contents) {
+		t.Fatalf("Downloaded %v bytes that differ from the %v uploaded\n", len(received), len(contents))
+	}
+	os.Remove("only-first.bin")
+
+	if err := secondClient.Read(context.Background(), "only-first.bin", map[string]string{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Second server answered %v instead of %v\n", err, ErrNotFound)
+	}
+
+	// shutting one down leaves the other serving
+	if err := first.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v\n", err)
+	}
+	if err := <-firstServed; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve returned %v instead of %v\n", err, ErrServerClosed)
+	}
+	if second.Addr() == nil {
+		t.Fatalf("Second server stopped with the first\n")
+	}
+
+	if err := second.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v\n", err)
+	}
+	<-secondServed
+	if err := second.Shutdown(context.Background()); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Second shutdown returned %v instead of %v\n", err, ErrServerClosed)
+	}
+}
+
+// sessions still running when the shutdown context is done are cancelled
+func TestShutdownCancelsSessions(t *testing.T) {
+	network := NewMemoryNetwork()
+	server, served := newTestServer(t, network, "127.0.0.1:69")
+
+	// a write request nobody ever sends data for keeps its session waiting
+	conn, err := network.ListenPacket(nil)
+	if err != nil {
+		t.Fatalf("Unable to listen: %v\n", err)
+	}
+	defer conn.Close()
+	request, _ := NewWriteMessage("stuck.bin", ModeOctet, nil).MarshalBinary()
+	if _, err = conn.WriteTo(request, server.Addr()); err != nil {
+		t.Fatalf("Unable to send request: %v\n", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = conn.ReadFrom(make([]byte, 516)); err != nil {
+		t.Fatalf("Request never acknowledged: %v\n", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown returned %v instead of %v\n", err, context.DeadlineExceeded)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("Shutdown waited %v for a cancelled session\n", waited)
+	}
+	<-served
+}
+
+// a server and client over a network where what the server sends suffers serverFaults, with image.bin holding contents unless nil
+func newLossyTransfer(t *testing.T, serverFaults FaultSchedule, contents []byte) (*Server, *Client) {
+	network := NewMemoryNetwork()
+	server, served := newTestServer(t, &LossyNetwork{Network: network, Schedule: serverFaults, Delay: 5 * time.Millisecond}, "127.0.0.1:69")
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		<-served
+	})
+	if contents != nil {
+		upload(t, server.Store, "image.bin", string(contents))
+	}
+
+	return server, newTestClient(t, network, "127.0.0.1:69")
+}
+
+// the option acknowledgement the server sends again arrives before the one held back, which the client then ignores
+func TestLossyReorderedOptionAcknowledgement(t *testing.T) {
+	contents := bytes.Repeat([]byte("reordered"), 300)
+	var reordered atomic.Bool
+	reorderFirst := FaultFunc(func(from net.Addr, to net.Addr, buf []byte) Fault {
+		if len(buf) >= 2 && buf[1] == OpcodeOptionAcknowledgeByte && !reordered.Swap(true) {
+			return FaultReorder
+		}
+		return FaultNone
+	})
+	_, client := newLossyTransfer(t, reorderFirst, contents)
+
+	var received bytes.Buffer
+	_, err := client.Get(context.Background(), "image.bin", func() (io.Writer, error) { return &received, nil }, map[string]string{"blksize": "512", "timeout": "1"})
+	if err != nil {
+		t.Fatalf("Download failed: %v\n", err)
+	}
+	if !bytes.Equal(received.Bytes(), contents) {
+		t.Fatalf("Downloaded %v bytes that differ from the %v uploaded\n", received.Len(), len(contents))
+	}
+}
+
+// the client sends the last block again when the acknowledgement of it is lost and the dallying server acknowledges it once more
+func TestLossyLostFinalAcknowledgement(t *testing.T) {
+	contents := bytes.Repeat([]byte("lost"), 1000)
+	var dropped atomic.Bool
+	// the upload is 8 blocks long
+	dropFinal := FaultFunc(func(from net.Addr, to net.Addr, buf []byte) Fault {
+		if len(buf) == 4 && buf[1] == OpcodeAcknowledgeByte && buf[3] == 8 && !dropped.Swap(true) {
+			return FaultDrop
+		}
+		return FaultNone
+	})
+	server, client := newLossyTransfer(t, dropFinal, nil)
+
+	if _, err := client.Put(context.Background(), "lost.bin", bytes.NewReader(contents), map[string]string{"timeout": "1"}); err != nil {
+		t.Fatalf("Upload failed: %v\n", err)
+	}
+	if !dropped.Load() {
+		t.Fatalf("Final acknowledgement was never sent\n")
+	}
+	reader, err := server.Store.OpenLatest(context.Background(), "lost.bin")
+	if err != nil {
+		t.Fatalf("Upload was not kept: %v\n", err)
+	}
+	defer reader.Close()
+	if stored := readAllStored(t, reader); stored != string(contents) {
+		t.Fatalf("Kept %v bytes that differ from the %v uploaded\n", len(stored), len(contents))
+	}
+}
+
+// a data message whose block number was corrupted is not taken for the block it claims to be and the block is sent again
+func TestLossyCorruptedData(t *testing.T) {
+	// the final block is empty so corrupting its last byte corrupts the block number
+	contents := bytes.Repeat([]byte("corrupt!"), 64*4)
+	var corrupted atomic.Bool
+	corruptFinal := FaultFunc(func(from net.Addr, to net.Addr, buf []byte) Fault {
+		if len(buf) == DataPreambleLength && buf[1] == OpcodeDataByte && !corrupted.Swap(true) {
+			return FaultCorrupt
+		}
+		return FaultNone
+	})
+	_, client := newLossyTransfer(t, corruptFinal, contents)
+
+	var received bytes.Buffer
+	if _, err := client.Get(context.Background(), "image.bin", func() (io.Writer, error) { return &received, nil }, map[string]string{"timeout": "1"}); err != nil {
+		t.Fatalf("Download failed: %v\n", err)
+	}
+	if !corrupted.Load() {
+		t.Fatalf("Final block was never sent\n")
+	}
+	if !bytes.Equal(received.Bytes(), contents) {
+		t.Fatalf("Downloaded %v bytes that differ from the %v uploaded\n", received.Len(), len(contents))
+	}
+}
+
+// block numbers keep counting past 65535 by rolling over to 0 or, when asked for, to 1
+func TestRollover(t *testing.T) {
+	// 69633 blocks of 8 bytes, more than a block number counts to before rolling over
+	contents := make([]byte, 8*0x11000+3)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+	blocks := len(contents)/8 + 1
+
+	for _, rollover := range []uint64{0, 1} {
+		network := NewMemoryNetwork()
+		server, served := newTestServer(t, network, "127.0.0.1:69")
+
+		// the block number of every data message and acknowledgement the client sends
+		var data, acknowledgements []uint16
+		record := FaultFunc(func(from net.Addr, to net.Addr, buf []byte) Fault {
+			if len(buf) >= 4 && buf[1] == OpcodeDataByte {
+				data = append(data, uint16(buf[2])<<8|uint16(buf[3]))
+			} else if len(buf) >= 4 && buf[1] == OpcodeAcknowledgeByte {
+				acknowledgements = append(acknowledgements, uint16(buf[2])<<8|uint16(buf[3]))
+			}
+			return FaultNone
+		})
+		client := newTestClient(t, &LossyNetwork{Network: network, Schedule: record}, "127.0.0.1:69")
+		options := map[string]string{"blksize": "8", "rollover": fmt.Sprint(rollover), "timeout": "1"}
+
+		stats, err := client.Put(context.Background(), "big.bin", bytes.NewReader(contents), options)
+		if err != nil || stats.Bytes != uint64(len(contents)) || stats.Options["rollover"] != fmt.Sprint(rollover) {
+			t.Fatalf("rollover %v: upload sent %+v %v\n", rollover, stats, err)
+		}
+		var received bytes.Buffer
+		stats, err = client.Get(context.Background(), "big.bin", func() (io.Writer, error) { return &received, nil }, options)
+		if err != nil || stats.Bytes != uint64(len(contents)) {
+			t.Fatalf("rollover %v: download received %+v %v\n", rollover, stats, err)
+		}
+		if !bytes.Equal(received.Bytes(), contents) {
+			t.Fatalf("rollover %v: downloaded %v bytes that differ from the %v uploaded\n", rollover, received.Len(), len(contents))
+		}
+
+		// block i goes out as i rolled over, the acknowledgement of the options being block 0
+		wire := func(i int) uint16 {
+			if rollover == 1 && i > 0 {
+				return uint16((i-1)%0xffff + 1)
+			}
+			return uint16(i)
+		}
+		if len(data) != blocks {
+			t.Fatalf("rollover %v: sent %v data messages for %v blocks\n", rollover, len(data), blocks)
+		}
+		for i, blockNumber := range data {
+			if blockNumber != wire(i+1) {
+				t.Fatalf("rollover %v: sent block %v as #%v instead of #%v\n", rollover, i+1, blockNumber, wire(i+1))
+			}
+		}
+		if len(acknowledgements) != blocks+1 {
+			t.Fatalf("rollover %v: sent %v acknowledgements for %v blocks\n", rollover, len(acknowledgements), blocks)
+		}
+		for i, blockNumber := range acknowledgements {
+			if blockNumber != wire(i) {
+				t.Fatalf("rollover %v: acknowledged block %v as #%v instead of #%v\n", rollover, i, blockNumber, wire(i))
+			}
+		}
+
+		if err = server.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown failed: %v\n", err)
+		}
+		<-served
+	}
+}
@@ -2,19 +2,20 @@ package internal
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 )
 
 const (
 	DataPreambleLength = 4
+
+	// largest value allowed by the timeout option, waiting any longer is pointless
+	MaxTimeout = 255 * time.Second
 )
 
 const (
@@ -28,15 +29,37 @@ type TftpSession struct {
 	// context
 	Ctx context.Context
 
+	// belong to the server or client the session was started by
+	Cfg *Config
+	Log chan<- logEvent
+	// nil unless the session was started by a server
+	Server *Server
+
 	// used for connection
 	DestinationAddr net.Addr
-	Destination     *net.UDPConn
+	Destination     net.PacketConn
+	LastDestination *net.UDPAddr
 	SendBuf         []byte
 	ReceiveBuf      []byte
 
+	// address and port of the other side (RFC 1350 transfer identifier), nil until it is known
+	// messages from anywhere else are refused without disturbing the transfer
+	TransferId *net.UDPAddr
+
+	// set when a client takes part in an RFC 2090 multicast transfer
+	MulticastGroup *net.UDPAddr
+	MasterClient   bool
+
+	// used when the other side stops responding
+	Retries int
+	Backoff float64
+
 	// set when opening file
-	File      *os.File
-	UnixMicro int64
+	// Reader is what data messages are sent from and Writer what they are received into
+	Reader       io.ReadSeeker
+	Writer       io.Writer
+	Netascii     netasciiState
+	TranslateBuf []byte
 
 	// set when connection established
 	Operation uint16
@@ -49,25 +72,32 @@ type TftpSession struct {
 	Timeout      time.Duration
 	TransferSize uint64
 	WindowSize   uint16
+	Rollover     uint16
 
 	// updated upon acknowledgements
-	BlockNumber           uint16
-	TotalBytesTransferred uint32
-	LastValidMessage      any
-	MostRecentMessage     any
+	// BlockNumber counts blocks from the start of the transfer, use wireBlockNumber when it must fit in a message
+	BlockNumber           uint64
+	TotalBytesTransferred uint64
+	LastValidMessage      Message
+	MostRecentMessage     Message
 }
 
-func NewTftpSession(ctx context.Context, destination *net.UDPConn) (TftpSession, error) {
+func NewTftpSession(ctx context.Context, cfg *Config, log chan<- logEvent, destination net.PacketConn) (TftpSession, error) {
 	var session TftpSession
 
 	// Do not derive new context
 	session.Ctx = ctx
+	session.Cfg = cfg
+	session.Log = log
 
 	// Default values
 	session.BlockSize = 512
 	session.Timeout = time.Second * 5
 	session.TransferSize = 0 // 0 if unknown
-	session.WindowSize = 512
+	session.WindowSize = 1
+	session.Mode = ModeOctet
+	session.Retries = cfg.Retries
+	session.Backoff = max(cfg.Backoff, 1)
 
 	session.Destination = destination
 	session.DestinationAddr = destination.LocalAddr()
@@ -84,270 +114,205 @@ func (session *TftpSession) Close() error {
 	return session.Destination.Close()
 }
 
-func (session *TftpSession) LastSentMessageType() uint16 {
-	opcodeLen := 2
-	if session.SendBuf == nil || len(session.SendBuf) < opcodeLen {
-		return OpcodeInvalid
+// block numbers in messages are 16 bits so after 65535 they wrap to the value chosen with the rollover option
+func (session *TftpSession) wireBlockNumber(blockNumber uint64) uint16 {
+	if blockNumber <= 0xffff || session.Rollover == 0 {
+		return uint16(blockNumber)
 	}
 
-	return uint16(session.SendBuf[1])
+	// rolling over to 1 means 0 is skipped and the block numbers cycle through 65535 values
+	return uint16((blockNumber-1)%0xffff + 1)
 }
 
-// open file and increment consumers attached to that file
-func (session *TftpSession) Reserve() (int64, error) {
-	var model fileModel = newFileModel()
+// find how many blocks past blockNumber the block sent as wireBlockNumber is, negative if it comes before
+func (session *TftpSession) blockDistance(wireBlockNumber uint16, blockNumber uint64) int64 {
+	var cycle int64 = 0x10000
+	var from int64 = int64(blockNumber % 0x10000)
+	var to int64 = int64(wireBlockNumber)
 
-	// Acquire write lock on global map
-	tx, err := DB.BeginTx(session.Ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
-	if err != nil {
-		return 0, err
+	// rolling over to 1 skips 0, so 0 can only be the block before the first data message
+	if session.Rollover == 1 {
+		if wireBlockNumber == 0 || blockNumber == 0 {
+			return int64(wireBlockNumber) - int64(blockNumber)
+		}
+		cycle = 0xffff
+		from = int64((blockNumber - 1) % 0xffff)
+		to = int64(wireBlockNumber - 1)
 	}
 
-	stmt := tx.Stmt(ReserveStatementSelect)
-	row := stmt.QueryRow(session.Filename)
-	err = model.scanRow(row)
-	if err != nil {
-		_ = tx.Rollback()
-		return 0, err
+	// choose whichever of the two directions around the cycle is shorter
+	distance := (to - from) % cycle
+	if distance < 0 {
+		distance += cycle
 	}
-	unixMicro := model.timeStarted
-
-	stmt = tx.Stmt(ReserveStatementUpdate)
-	_, err = stmt.Exec(session.Filename)
-	if err != nil {
-		_ = tx.Rollback()
-		return 0, err
+	if distance > cycle/2 {
+		distance -= cycle
 	}
-	unixMicro = model.timeStarted
 
-	err = tx.Commit()
-	if err != nil {
-		return 0, err
-	}
+	return distance
+}
 
-	file, err := Cfg.Directory.Open(model.Path())
-	if err != nil {
-		return 0, err
+func (session *TftpSession) LastSentMessageType() uint16 {
+	opcodeLen := 2
+	if session.SendBuf == nil || len(session.SendBuf) < opcodeLen {
+		return OpcodeInvalid
 	}
-	session.File = file
 
-	return unixMicro, nil
+	return uint16(session.SendBuf[1])
 }
 
-// close file and decrement consumers attached to that file.
-// called from within sessionRoutine because both when loading options
-// or responding to a read request we may open a file for the first time.
-func (session *TftpSession) Release(unixMicro int64) error {
-	var stmt *sql.Stmt
-	var model fileModel = newFileModel()
+// the request being served as a handler sees it
+func (session *TftpSession) request() *Request {
+	var options map[string]string = make(map[string]string)
 
-	// file may be nil, means nothing was ever opened
-	if session.File == nil {
-		return nil
+	switch message := session.MostRecentMessage.(type) {
+	case *ReadMessage:
+		for key, value := range message.Options {
+			options[strings.ToLower(key)] = value
+		}
+	case *WriteMessage:
+		for key, value := range message.Options {
+			options[strings.ToLower(key)] = value
+		}
 	}
 
-	session.File.Close()
+	return &Request{Filename: session.Filename, Mode: session.Mode, Options: options, RemoteAddr: session.DestinationAddr}
+}
 
-	tx, err := DB.BeginTx(session.Ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
-	if err != nil {
-		return err
-	}
+func (session *TftpSession) ReadFile() error {
+	var n int
 
-	stmt = tx.Stmt(ReleaseStatementUpdate)
-	_, err = stmt.Exec(session.Filename, unixMicro)
+	// somewhat hacky way to avoid double copying
+	// we let AppendBinary handle the first 4 bytes and handle the rest by reading
+	var err error
+	session.SendBuf, err = NewDataMessage(session.wireBlockNumber(session.BlockNumber), nil).AppendBinary(session.SendBuf[:0])
 	if err != nil {
-		_ = tx.Rollback()
 		return err
 	}
 
-	stmt = tx.Stmt(ReleaseStatementSelect)
-	rows, err := stmt.Query(session.Filename)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
+	if cap(session.SendBuf) < int(session.BlockSize+DataPreambleLength) {
+		session.SendBuf = append(session.SendBuf, make([]byte, session.BlockSize)...)
 	}
-	defer rows.Close()
-	err = model.deleteFiles(session.Ctx, rows)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-
-	stmt = tx.Stmt(ReleaseStatementDelete)
-	_, err = stmt.Exec(session.Filename)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
+	session.SendBuf = session.SendBuf[:session.BlockSize+DataPreambleLength]
+	if session.Mode == ModeNetascii {
+		n, err = session.readNetascii(session.SendBuf[DataPreambleLength:])
+	} else {
+		n, err = io.ReadFull(session.Reader, session.SendBuf[DataPreambleLength:])
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
 	}
-
-	err = tx.Commit()
-	if err != nil {
+	if err != nil && !errors.Is(err, io.EOF) {
 		return err
 	}
 
-	return nil
+	// Need to adjust session.SendBuf slice length
+	// Writing bytes to session.SendBuf[DataPreambleLen:] does not update session.SendBuf itself
+	newSliceEnd := DataPreambleLength + n
+	session.SendBuf = session.SendBuf[0:newSliceEnd]
+	return err
 }
 
-// inform databse we want to begin writing a version of filename and get a time attached to it
-func (session *TftpSession) Prepare() (int64, error) {
-	var model fileModel = newFileModel()
+// fill block with the file translated into netascii
+func (session *TftpSession) readNetascii(block []byte) (int, error) {
+	var filled int
 
-	tx, err := DB.BeginTx(session.Ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
-	if err != nil {
-		return 0, err
-	}
-	unixMicro := time.Now().UnixMicro()
-	stmt := tx.Stmt(PrepareStatement)
-	_, err = stmt.Exec(session.Filename, unixMicro)
-	if err != nil {
-		_ = tx.Rollback()
-		return 0, err
-	}
-	err = tx.Commit()
-	if err != nil {
-		return 0, err
+	if cap(session.TranslateBuf) < len(block) {
+		session.TranslateBuf = make([]byte, len(block))
 	}
 
-	model = newFileModelWith(session.Filename, unixMicro, 0, 0)
-	file, err := Cfg.Directory.Create(model.Path())
-	if err != nil {
-		return 0, err
-	}
-
-	session.File = file
-	return unixMicro, err
-}
+	for filled < len(block) {
+		// every byte read becomes at least one byte of netascii so never read more than there is room for
+		room := len(block) - filled
+		if session.Netascii.hasPending {
+			room -= 1
+		}
+		var n int
+		var err error
+		if room > 0 {
+			n, err = session.Reader.Read(session.TranslateBuf[:room])
+			if err != nil && !errors.Is(err, io.EOF) {
+				return filled, err
+			}
+		}
 
-// inform database client succesfully uploaded entire file, mark it as available
-func (session *TftpSession) OverwriteSuccess(unixMicro int64) error {
-	var err error
-	var model fileModel = newFileModel()
+		written, consumed := session.Netascii.encode(block[filled:], session.TranslateBuf[:n])
+		filled += written
 
-	err = session.File.Close()
-	if err != nil {
-		return err
-	}
+		// bytes that did not fit are read again as part of the next block
+		if consumed < n {
+			if _, err := session.Reader.Seek(int64(consumed-n), io.SeekCurrent); err != nil {
+				return filled, err
+			}
+		}
 
-	tx, err := DB.BeginTx(session.Ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
-	if err != nil {
-		return err
+		if errors.Is(err, io.EOF) && !session.Netascii.hasPending {
+			return filled, io.EOF
+		}
 	}
 
-	stmt := tx.Stmt(OverwriteSuccessUpdate)
-	uploadCompleted := time.Now().UnixMicro()
-	_, err = stmt.Exec(uploadCompleted, session.Filename, unixMicro)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
+	return filled, nil
+}
 
-	stmt = tx.Stmt(OverwriteSuccessSelect)
-	rows, err := stmt.Query(session.Filename)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-	defer rows.Close()
-	err = model.deleteFiles(session.Ctx, rows)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
+// assumption made is that session.SendBuf already contains a data message as bytes
+func (session *TftpSession) WriteFile() error {
+	var n int
+	var err error
+	body := session.MostRecentMessage.(*DataMessage).Body
+	data := body
+
+	if session.Mode == ModeNetascii {
+		data = session.Netascii.decode(session.TranslateBuf[:0], body)
+		// Short message means end of file so a trailing CR will never be followed by anything
+		if len(body) < int(session.BlockSize) {
+			data = session.Netascii.flush(data)
+		}
+		session.TranslateBuf = data
 	}
 
-	stmt = tx.Stmt(OverwriteSuccessDelete)
-	_, err = stmt.Exec(session.Filename)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
+	// somewhat hacky way to avoid double copying
+	// We know that bytes 5 and onward must be actual data being sent
+	if len(data) > 0 {
+		n, err = session.Writer.Write(data)
+		if n != len(data) {
+			return fileError(errors.New("Truncated"), session.Filename)
+		}
+		if err != nil {
+			return fileError(err, session.Filename)
+		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		return err
+	// Short message means end of file
+	// Zero length data section means previous message was the last message containing file data
+	if len(body) < int(session.BlockSize) {
+		err = io.EOF
 	}
-
-	return nil
+	return err
 }
 
-// inform database client succesfully uploaded entire file, mark it as available
-func (session *TftpSession) OverwriteFailure(unixMicro int64) error {
-	// When err is nil then some error has prevented the file from being written as it should have been
-	// When err is os.ErrClosed then overwriteSuccess has already been called and all is good
-	// When err is any other error then something weird has happened
-	fileError := session.File.Close()
-	if errors.Is(fileError, os.ErrClosed) {
-		return nil
-	} else if fileError != nil {
-		return fileError
-	}
-
-	tx, err := DB.BeginTx(session.Ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: false})
-	if err != nil {
-		return err
-	}
-	stmt := tx.Stmt(OverwriteFailureStatement)
-	_, err = stmt.Exec(session.Filename, unixMicro)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-
-	return nil
+// position in session.Reader a block began reading from, used to resend blocks
+type filePosition struct {
+	offset   int64
+	netascii netasciiState
 }
 
-func (session *TftpSession) ReadFile() error {
-	if len(session.SendBuf) <= DataPreambleLength {
-		return errors.New("Buffer size way too small to read")
-	}
-
-	// somewhat hacky way to avoid double copying
-	// we let MessageAsBytes handle the first 4 bytes and handle the rest by reading
-	err := MessageAsBytes(NewDataMessage(session.BlockNumber, nil), &session.SendBuf)
+func (session *TftpSession) tell() (filePosition, error) {
+	offset, err := session.Reader.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return err
+		return filePosition{}, err
 	}
 
-	session.SendBuf = session.SendBuf[:session.BlockSize+DataPreambleLength]
-	n, err := session.File.Read(session.SendBuf[DataPreambleLength:])
-	if err != nil && !errors.Is(err, io.EOF) {
-		return err
-	}
-
-	// Need to adjust session.SendBuf slice length
-	// Writing bytes to session.SendBuf[DataPreambleLen:] does not update session.SendBuf itself
-	newSliceEnd := DataPreambleLength + n
-	session.SendBuf = session.SendBuf[0:newSliceEnd]
-	return err
+	return filePosition{offset, session.Netascii}, nil
 }
 
-// assumption made is that session.SendBuf already contains a data message as bytes
-func (session *TftpSession) WriteFile() error {
-	body := session.MostRecentMessage.(DataMessage).Body
-
-	// Zero length data section means previous message was the last message containing file data
-	if len(body) == 0 {
-		return io.EOF
-	}
-
-	// somewhat hacky way to avoid double copying
-	// We know that bytes 5 and onward must be actual data being sent
-	n, err := session.File.Write(body)
-	if n != len(body) {
-		return errors.New("Truncated")
-	}
+func (session *TftpSession) seek(position filePosition) error {
+	_, err := session.Reader.Seek(position.offset, io.SeekStart)
 	if err != nil {
 		return err
 	}
+	session.Netascii = position.netascii
 
-	// Short message means end of file
-	if n < int(session.BlockSize) {
-		err = io.EOF
-	}
-	return err
+	return nil
 }
 
 // send length bytes of session.SendBuf to client
@@ -359,11 +324,14 @@ func (session *TftpSession) Send(destination *net.UDPAddr) error {
 		return nil
 	}
 
+	session.LastDestination = destination
 	if destination == nil {
-		n, err = session.Destination.Write(session.SendBuf)
-	} else {
-		n, err = session.Destination.WriteToUDP(session.SendBuf, destination)
+		destination = session.TransferId
+	}
+	if destination == nil {
+		return errors.New("Nowhere to send message")
 	}
+	n, err = session.Destination.WriteTo(session.SendBuf, destination)
 	if err != nil {
 		return err
 	}
@@ -374,29 +342,86 @@ func (session *TftpSession) Send(destination *net.UDPAddr) error {
 	return nil
 }
 
+// send the last message sent again, used when the other side does not respond in time
+func (session *TftpSession) Resend() error {
+	return session.Send(session.LastDestination)
+}
+
 func (session *TftpSession) Receive() (*net.UDPAddr, error) {
-	// Allow ten timeouts, if we timeout then resend
-	for _ = range 10 {
+	return session.ReceiveOrResend(session.Resend)
+}
+
+// wait for the next message, calling resend each time we timeout
+// every timeout waits session.Backoff times longer than the one before it
+func (session *TftpSession) ReceiveOrResend(resend func() error) (*net.UDPAddr, error) {
+	var timeout time.Duration = session.Timeout
+
+	for attempt := 0; attempt <= session.Retries; attempt++ {
+		if attempt > 0 {
+			if session.Cfg.Debug {
+				session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Timed out after %v, resending (attempt %v of %v)", timeout, attempt, session.Retries))
+			}
+			if err := resend(); err != nil {
+				return nil, err
+			}
+
+			timeout = time.Duration(float64(timeout) * session.Backoff)
+			if timeout > MaxTimeout {
+				timeout = MaxTimeout
+			}
+		}
+
+		addr, err := session.ReceiveBefore(time.Now().Add(timeout))
+		if os.IsTimeout(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return addr, nil
+	}
+
+	return nil, errors.New("Client connection (likely) dead")
+}
+
+// wait for a single message from the other side until deadline
+// messages from any other address are answered with an error and otherwise ignored
+func (session *TftpSession) ReceiveBefore(deadline time.Time) (*net.UDPAddr, error) {
+	for {
 		select {
 		case <-session.Ctx.Done():
 			return nil, context.Cause(session.Ctx)
 		default:
+			// negotiating blksize may leave the buffer too small for the data messages that follow
+			if cap(session.ReceiveBuf) < int(session.BlockSize+DataPreambleLength) {
+				session.ReceiveBuf = make([]byte, session.BlockSize+DataPreambleLength)
+			}
 			session.ReceiveBuf = session.ReceiveBuf[:session.BlockSize+DataPreambleLength]
-			session.Destination.SetReadDeadline(time.Now().Add(session.Timeout))
-			//messageLength, addr, err := session.Destination.ReadFromUDP(session.ReceiveBuf)
-			messageLength, addr, err := session.Destination.ReadFromUDP(session.ReceiveBuf)
+			session.Destination.SetReadDeadline(deadline)
+			// a cancelled session stops waiting right away instead of at the deadline
+			stopWaking := context.AfterFunc(session.Ctx, func() { session.Destination.SetReadDeadline(time.Now()) })
+			messageLength, from, err := session.Destination.ReadFrom(session.ReceiveBuf)
+			stopWaking()
 			session.ReceiveBuf = session.ReceiveBuf[:messageLength]
+			if err != nil && session.Ctx.Err() != nil {
+				return nil, context.Cause(session.Ctx)
+			} else if err != nil {
+				return nil, err
+			}
+			addr, err := udpAddr(from)
 			if err != nil {
 				return nil, err
 			}
-			/*
-				ip1, ip2 := addr.IP, session.DestinationAddr.IP
-				port1, port2 := addr.Port, session.DestinationAddr.Port
-				zone1, zone2 := addr.Zone, session.DestinationAddr.Zone
-				if !ip1.Equal(ip2) || port1 != port2 || zone1 != zone2 {
-					return errors.New("Client changed ip/port... possible man in the middle attack?")
+
+			if session.TransferId != nil && !sameTransferId(addr, session.TransferId) {
+				if session.Cfg.Debug {
+					session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Refusing message from unknown transfer id: %v", addr))
+				}
+				if err = session.RefuseUnknownTransferId(addr); err != nil {
+					return nil, err
 				}
-			*/
+				continue
+			}
+
 			session.MostRecentMessage, err = BytesAsMessage(session.ReceiveBuf[:messageLength])
 			if err != nil {
 				return nil, err
@@ -404,21 +429,80 @@ func (session *TftpSession) Receive() (*net.UDPAddr, error) {
 			return addr, nil
 		}
 	}
+}
 
-	return nil, errors.New("Client connection (likely) dead")
+// transfer identifiers are the address and port a message was sent from
+func sameTransferId(addr *net.UDPAddr, transferId *net.UDPAddr) bool {
+	a, b := addr.AddrPort(), transferId.AddrPort()
+	return a.Addr().Unmap() == b.Addr().Unmap() && a.Port() == b.Port()
+}
+
+// tell whoever sent the message in session.ReceiveBuf that it does not belong to this transfer
+// session.SendBuf is left alone so the transfer can still resend its last message
+func (session *TftpSession) RefuseUnknownTransferId(addr *net.UDPAddr) error {
+	return refuseUnknownTransferId(session.Destination, session.ReceiveBuf, addr)
+}
+
+// answer received, a message sent to conn by addr, with an unknown transfer id error
+func refuseUnknownTransferId(conn net.PacketConn, received []byte, addr *net.UDPAddr) error {
+	var reply []byte
+
+	// never answer an error with an error, two confused peers could keep that going forever
+	if len(received) >= 2 && received[0] == 0 && received[1] == OpcodeErrorByte {
+		return nil
+	}
+
+	reply, err := NewErrorMessage(ErrUnknownTransferId.Code, ErrUnknownTransferId.Message).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(reply, addr)
+
+	return err
+}
+
+// wait after acknowledging the final data message in case the acknowledgement was lost
+// the other side resends the final data message when that happens so we acknowledge it again
+// it only resends after its own timeout so we wait for twice that, starting over every time we acknowledge again
+func (session *TftpSession) Dally() error {
+	deadline := time.Now().Add(2 * session.Timeout)
+
+	for time.Now().Before(deadline) {
+		_, err := session.ReceiveBefore(deadline)
+		if os.IsTimeout(err) || session.Ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			// nothing useful can be done about a malformed message this late
+			continue
+		}
+
+		switch session.MostRecentMessage.(type) {
+		case *DataMessage:
+			if session.blockDistance(session.MostRecentMessage.(*DataMessage).BlockNumber, session.BlockNumber) < 0 {
+				if session.Cfg.Debug {
+					session.Log <- NewDebugEvent(session.DestinationAddr.String(), "Final data message sent again, acknowledging it again")
+				}
+				if err = session.Resend(); err != nil {
+					return err
+				}
+				deadline = time.Now().Add(2 * session.Timeout)
+			}
+		default:
+			// pass
+		}
+	}
+
+	return nil
 }
 
 // create and send read message to server
 func (session *TftpSession) ReadMessage(filename string, options map[string]string) error {
-	// netascii is a nop
-	mode := "octal"
-
-	addr, err := net.ResolveUDPAddr("udp", Cfg.Address)
+	addr, err := net.ResolveUDPAddr("udp", session.Cfg.Address)
 	if err != nil {
 		return err
 	}
 
-	err = MessageAsBytes(NewReadMessage(filename, mode, options), &(session.SendBuf))
+	session.SendBuf, err = NewReadMessage(filename, session.Mode, options).AppendBinary(session.SendBuf[:0])
 	if err != nil {
 		return err
 	}
@@ -430,15 +514,12 @@ func (session *TftpSession) ReadMessage(filename string, options map[string]stri
 
 // create and send write message to server
 func (session *TftpSession) WriteMessage(filename string, options map[string]string) error {
-	// netascii is a nop
-	mode := "octal"
-
-	addr, err := net.ResolveUDPAddr("udp", Cfg.Address)
+	addr, err := net.ResolveUDPAddr("udp", session.Cfg.Address)
 	if err != nil {
 		return err
 	}
 
-	err = MessageAsBytes(NewWriteMessage(filename, mode, options), &(session.SendBuf))
+	session.SendBuf, err = NewWriteMessage(filename, session.Mode, options).AppendBinary(session.SendBuf[:0])
 	if err != nil {
 		return err
 	}
@@ -457,11 +538,12 @@ func (session *TftpSession) DataMessage() error {
 }
 
 // create and send acknowledge message to client
-func (session *TftpSession) AcknowledgeMessage() error {
+func (session *TftpSession) AcknowledgeMessage(blockNumber uint16) error {
 	acknowledgeOpcodeLen := 2
 	acknowledgeBlockNumLen := 2
 
-	err := MessageAsBytes(NewAcknowledgeMessage(session.BlockNumber), &session.SendBuf)
+	var err error
+	session.SendBuf, err = NewAcknowledgeMessage(blockNumber).AppendBinary(session.SendBuf[:0])
 	if err != nil {
 		return err
 	}
@@ -478,7 +560,8 @@ func (session *TftpSession) ErrorMessage(code uint8, message string) error {
 	errorCodeLen := 2
 	nullTerminatorLen := 1
 
-	err := MessageAsBytes(NewErrorMessage(uint16(code), message), &session.SendBuf)
+	var err error
+	session.SendBuf, err = NewErrorMessage(uint16(code), message).AppendBinary(session.SendBuf[:0])
 	if err != nil {
 		return err
 	}
@@ -489,11 +572,22 @@ func (session *TftpSession) ErrorMessage(code uint8, message string) error {
 	return session.Send(nil)
 }
 
+// tell the other side about err using the error code of the category it belongs to
+// errors sent by the other side are never answered
+func (session *TftpSession) ReportError(err error) error {
+	if isRemoteError(err) {
+		return nil
+	}
+
+	return session.ErrorMessage(uint8(ErrorCode(err)), err.Error())
+}
+
 // create and send option acknowledge message to client
 func (session *TftpSession) OptionAcknowledgeMessage() error {
 	optionAcknowledgeOpcodeLen := 2
 
-	err := MessageAsBytes(NewOptionAcknowledgeMessage(session.Options), &session.SendBuf)
+	var err error
+	session.SendBuf, err = NewOptionAcknowledgeMessage(session.Options).AppendBinary(session.SendBuf[:0])
 	if err != nil {
 		return err
 	}
@@ -514,25 +608,36 @@ func (session *TftpSession) OptionAcknowledgeMessage() error {
 func (session *TftpSession) Accept(bytes []byte) (uint16, error) {
 	var err error
 
+	// malformed messages are already illegal operations and say what was wrong with them
 	session.MostRecentMessage, err = BytesAsMessage(bytes)
 	if err != nil {
-		return OpcodeInvalid, errors.New("Client sent unknown message type when opening connecting")
+		return OpcodeInvalid, err
 	}
 
 	switch session.MostRecentMessage.(type) {
-	case ReadMessage:
+	case *ReadMessage:
 		session.Operation = ReadAsServer
-		session.Filename = session.MostRecentMessage.(ReadMessage).Filename
-		session.Mode = session.MostRecentMessage.(ReadMessage).Mode
+		session.Filename = session.MostRecentMessage.(*ReadMessage).Filename
+		session.Mode = session.MostRecentMessage.(*ReadMessage).Mode
 
-	case WriteMessage:
+	case *WriteMessage:
 		session.Operation = WriteAsServer
-		session.Filename = session.MostRecentMessage.(WriteMessage).Filename
-		session.Mode = session.MostRecentMessage.(WriteMessage).Mode
+		session.Filename = session.MostRecentMessage.(*WriteMessage).Filename
+		session.Mode = session.MostRecentMessage.(*WriteMessage).Mode
 
 	default:
-		session.ErrorMessage(ErrorCodeIllegalOperation, "Client requested invalid operation when opening connection")
-		return OpcodeInvalid, errors.New("Client requested invalid operation when opening connection")
+		return OpcodeInvalid, newError(ErrIllegalOperation, "Client requested invalid operation when opening connection")
+	}
+
+	// mail mode is obsolete and anything else is unknown
+	if session.Mode != ModeNetascii && session.Mode != ModeOctet {
+		return OpcodeInvalid, newError(ErrIllegalOperation, fmt.Sprintf("Unsupported transfer mode: %v", session.Mode))
+	}
+
+	// files may be in directories below the root directory but never outside of it
+	session.Filename, err = cleanFilename(session.Filename)
+	if err != nil {
+		return OpcodeInvalid, err
 	}
 
 	return session.Operation, nil
@@ -541,16 +646,30 @@ func (session *TftpSession) Accept(bytes []byte) (uint16, error) {
 func (session *TftpSession) ReadAsServer() error {
 	var err error
 
-	session.UnixMicro, err = session.Reserve()
+	// get access to the file asked for
+	if session.Cfg.Debug {
+		session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Opening %v", session.Filename))
+	}
+	session.Reader, err = session.Server.readHandler.ServeRead(session.Ctx, session.request())
 	if err != nil {
-		return errors.New("File does not exist!")
+		return err
+	}
+	if closer, ok := session.Reader.(io.Closer); ok {
+		defer closer.Close()
 	}
-	defer session.Release(session.UnixMicro)
 
-	err = session.UpdateOptions(session.MostRecentMessage.(ReadMessage).Options)
+	err = session.UpdateOptions(session.MostRecentMessage.(*ReadMessage).Options)
 	if err != nil {
-		session.ErrorMessage(ErrorCodeUndefined, "One or more options contain invalid values")
-		return errors.New("One or more options contain invalid values")
+		return err
+	}
+
+	// clients asking for multicast share a transfer, unless that is impossible and the client has to make do with unicast
+	if _, ok := session.Options["multicast"]; ok {
+		err = session.MulticastAsServer()
+		if !errors.Is(err, ErrMulticastUnavailable) {
+			return err
+		}
+		delete(session.Options, "multicast")
 	}
 
 	if len(session.Options) > 0 {
@@ -563,29 +682,42 @@ func (session *TftpSession) ReadAsServer() error {
 	// If we have just sent an options acknowledgement message we need to operate on the client's acknowledgement message
 	switch session.LastSentMessageType() {
 	case OpcodeOptionAcknowledgeByte:
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), "Awaiting acknowledgement from client of option acknowledge message")
+		if session.Cfg.Debug {
+			session.Log <- NewDebugEvent(session.DestinationAddr.String(), "Awaiting acknowledgement from client of option acknowledge message")
 		}
 		session.LastValidMessage = session.MostRecentMessage
 		if _, err = session.Receive(); err != nil {
 			return err
 		}
 
+		// the client sending its read request again means the option acknowledgement was lost
+		for i := 0; i < 5; i++ {
+			if _, isReadMessage := session.MostRecentMessage.(*ReadMessage); !isReadMessage {
+				break
+			}
+			if err = session.Resend(); err != nil {
+				return err
+			}
+			if _, err = session.Receive(); err != nil {
+				return err
+			}
+		}
+
 		switch session.MostRecentMessage.(type) {
-		case AcknowledgeMessage:
+		case *AcknowledgeMessage:
 			// pass
 		default:
-			return errors.New("Did not acknowledge the server's attempt to open a connection with supplied options")
+			return newError(ErrIllegalOperation, "Did not acknowledge the server's attempt to open a connection with supplied options")
 		}
 
-		if session.MostRecentMessage.(AcknowledgeMessage).BlockNumber != 0 {
-			return errors.New("Did not acknowledge the server's attempt to open a connection with supplied options")
+		if session.MostRecentMessage.(*AcknowledgeMessage).BlockNumber != 0 {
+			return newError(ErrIllegalOperation, "Did not acknowledge the server's attempt to open a connection with supplied options")
 		}
 
 		session.LastValidMessage = session.MostRecentMessage
 
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), "Received acknowledgement from client of option acknowledge message")
+		if session.Cfg.Debug {
+			session.Log <- NewDebugEvent(session.DestinationAddr.String(), "Received acknowledgement from client of option acknowledge message")
 		}
 	default:
 		// pass
@@ -594,22 +726,6 @@ func (session *TftpSession) ReadAsServer() error {
 	// we expect that client will acknowledge first data block with 1
 	session.BlockNumber = 1
 
-	// adjust buffer size because of blockSize
-	if len(session.SendBuf) != int(DataPreambleLength+session.BlockSize) {
-		session.SendBuf = make([]byte, session.BlockSize+DataPreambleLength)
-	}
-	if len(session.ReceiveBuf) != int(DataPreambleLength+session.BlockSize) {
-		session.ReceiveBuf = make([]byte, DataPreambleLength+session.BlockSize)
-	}
-
-	// get access to file with associated time
-	if Cfg.Debug {
-		Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Reserving %v", session.Filename))
-	}
-	if Cfg.Debug {
-		Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Reserved %v with file time %v", session.Filename, session.UnixMicro))
-	}
-
 	if err = session.SendDataLoop(false); err != nil {
 		return err
 	}
@@ -619,38 +735,44 @@ func (session *TftpSession) ReadAsServer() error {
 
 func (session *TftpSession) SendDataLoop(alreadyHoldingMessage bool) error {
 	var readEverything bool = false
+	var windowPositions []filePosition = make([]filePosition, 0, session.WindowSize)
 	var err error
 
 	// for loop designed to deal with multiple possible client messages
-	// if the client sends an acknowledgeMessage then we should send the next data message
+	// up to session.WindowSize data messages are sent before waiting for a single acknowledgement
+	// if the client acknowledges the last block of the window then we should send the next window
+	// if the client acknowledges a block inside the window then a gap was found and we resend from the block after it
+	// if the client does not respond in time then we resend the whole window
 	// if the client sends an errorMessage then we log it and return error
 	// if the client sends anything else return error
 	for !readEverything {
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Preparing data message with block number #%v", session.BlockNumber))
-		}
-		err = session.ReadFile()
-		if errors.Is(err, io.EOF) || len(session.SendBuf) < int(DataPreambleLength+session.BlockSize) {
-			readEverything = true
-		} else if err != nil {
-			return errors.New("File read error")
-		}
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Prepared data message with block number #%v", session.BlockNumber))
+		// remember where each block of the window begins so that it can be partially resent
+		var windowBlockNumber uint64 = session.BlockNumber
+		var windowBytes uint64
+		windowPositions, windowBytes, readEverything, err = session.sendWindow(windowPositions[:0])
+		if err != nil {
+			return err
 		}
+		var windowLength uint16 = uint16(len(windowPositions))
+		lastBlockNumber := session.BlockNumber - 1
 
-		if session.DataMessage() != nil {
-			return errors.New("Unable to send data to client")
+		resendWindow := func() error {
+			session.BlockNumber = windowBlockNumber
+			if err := session.seek(windowPositions[0]); err != nil {
+				return errors.New("File seek error")
+			}
+			_, _, _, err := session.sendWindow(windowPositions[:0])
+			return err
 		}
 
 		// setup for receive loop
 		var i int = 1
 		var awaitingRequest bool = true
 
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Awaiting client acknowledgement of block #%v", session.BlockNumber))
+		if session.Cfg.Debug {
+			session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Awaiting client acknowledgement of block #%v", lastBlockNumber))
 		}
-		// read until acknowledgement with correct blockNumber, handling gracefully retransmissions
+		// read until acknowledgement of a block within the window, handling gracefully retransmissions
 		for awaitingRequest {
 			// timeout after five bad messages
 			if i > 5 {
@@ -661,47 +783,121 @@ func (session *TftpSession) SendDataLoop(alreadyHoldingMessage bool) error {
 			// If the loop did not begin with a prior message then get next potentially valid message
 			if alreadyHoldingMessage {
 				alreadyHoldingMessage = false
-			} else if _, err = session.Receive(); err != nil {
+			} else if _, err = session.ReceiveOrResend(resendWindow); err != nil {
 				return err
 			}
 
-			// Read messages or acknowledgements of lesser block numbers are treated as retransmissions
+			// Read messages or acknowledgements of blocks before the window are treated as retransmissions
 			switch session.MostRecentMessage.(type) {
-			case ReadMessage:
+			case *ReadMessage, *OptionAcknowledgeMessage:
 				// pass
-			case AcknowledgeMessage:
-				if session.MostRecentMessage.(AcknowledgeMessage).BlockNumber == session.BlockNumber {
+			case *AcknowledgeMessage:
+				// acknowledgements sent again are expected when the client or we resend so they are not counted as bad messages
+				i = 0
+
+				// number of blocks from the start of the window the client has acknowledged
+				acknowledged := session.blockDistance(session.MostRecentMessage.(*AcknowledgeMessage).BlockNumber, windowBlockNumber) + 1
+				if acknowledged == int64(windowLength) {
+					session.TotalBytesTransferred += windowBytes
+					awaitingRequest = false
+				} else if acknowledged > 0 && acknowledged < int64(windowLength) {
+					// client found a gap, resume from the first block it did not receive
+					if session.Cfg.Debug {
+						session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Client acknowledged block #%v of window ending with #%v, resending", windowBlockNumber+uint64(acknowledged)-1, lastBlockNumber))
+					}
+					err = session.seek(windowPositions[acknowledged])
+					if err != nil {
+						return errors.New("File seek error")
+					}
+					session.BlockNumber = windowBlockNumber + uint64(acknowledged)
+					session.TotalBytesTransferred += uint64(acknowledged) * uint64(session.BlockSize)
+					readEverything = false
 					awaitingRequest = false
-				} else if session.MostRecentMessage.(AcknowledgeMessage).BlockNumber > session.BlockNumber {
-					return errors.New("Out of sync blockNumber")
 				}
-			case ErrorMessage:
-				return errors.New(session.MostRecentMessage.(ErrorMessage).Explanation)
+			case *ErrorMessage:
+				return errorFromMessage(session.MostRecentMessage.(*ErrorMessage))
 			default:
-				return errors.New("Client requested invalid operation during established connection")
+				return newError(ErrIllegalOperation, "Invalid operation during established connection")
 			}
 
 			i += 1
 		}
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Client acknowledged block #%v", session.BlockNumber))
+		if session.Cfg.Debug {
+			session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Client acknowledged block #%v", session.BlockNumber-1))
 		}
 
 		session.LastValidMessage = session.MostRecentMessage
-		session.BlockNumber += 1
 	}
 
 	return nil
 }
 
+// send data messages from session.Reader until the window is full or the file has been read
+// returns where each block began, the number of bytes sent, and whether the file has been read
+func (session *TftpSession) sendWindow(positions []filePosition) ([]filePosition, uint64, bool, error) {
+	var readEverything bool = false
+	var windowBytes uint64 = 0
+
+	for len(positions) < int(session.WindowSize) && !readEverything {
+		position, err := session.tell()
+		if err != nil {
+			return positions, windowBytes, readEverything, errors.New("File seek error")
+		}
+		positions = append(positions, position)
+
+		if session.Cfg.Debug {
+			session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Preparing data message with block number #%v", session.BlockNumber))
+		}
+		err = session.ReadFile()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return positions, windowBytes, readEverything, errors.New("File read error")
+		} else if len(session.SendBuf) < int(DataPreambleLength+session.BlockSize) {
+			// Short message means end of file
+			readEverything = true
+		}
+		if session.Cfg.Debug {
+			session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Prepared data message with block number #%v", session.BlockNumber))
+		}
+
+		if session.DataMessage() != nil {
+			return positions, windowBytes, readEverything, errors.New("Unable to send data to client")
+		}
+
+		windowBytes += uint64(len(session.SendBuf) - DataPreambleLength)
+		session.BlockNumber += 1
+	}
+
+	return positions, windowBytes, readEverything, nil
+}
+
 func (session *TftpSession) WriteAsServer() error {
-	var unixMicro int64
+	var writer io.WriteCloser
 	var err error
 
-	err = session.UpdateOptions(session.MostRecentMessage.(WriteMessage).Options)
+	// get somewhere to write the file before accepting it
+	if session.Cfg.Debug {
+		session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Preparing %v", session.Filename))
+	}
+	writer, err = session.Server.writeHandler.ServeWrite(session.Ctx, session.request())
+	if err != nil {
+		return err
+	}
+	session.Writer = writer
+	closed := false
+	defer func() {
+		if closed {
+			return
+		}
+		if aborter, ok := writer.(aborter); ok {
+			aborter.Abort()
+		} else {
+			writer.Close()
+		}
+	}()
+
+	err = session.UpdateOptions(session.MostRecentMessage.(*WriteMessage).Options)
 	if err != nil {
-		session.ErrorMessage(ErrorCodeUndefined, "One or more options contain invalid values")
-		return errors.New("One or more options contain invalid values")
+		return err
 	}
 
 	// acknowledgement message with block number 0 used to indicate accepting write when options are empty
@@ -711,7 +907,7 @@ func (session *TftpSession) WriteAsServer() error {
 		if err = session.OptionAcknowledgeMessage(); err != nil {
 			return errors.New("Unable to send option acknowledgement to write request")
 		}
-	} else if err = session.AcknowledgeMessage(); err != nil {
+	} else if err = session.AcknowledgeMessage(0); err != nil {
 		return errors.New("Unable to send acknowledgement to write request")
 	}
 	session.LastValidMessage = session.MostRecentMessage
@@ -719,56 +915,47 @@ func (session *TftpSession) WriteAsServer() error {
 	// we expect that client will acknowledge first data block with 1
 	session.BlockNumber = 1
 
-	// adjust buffer size because of blockSize
-	if len(session.SendBuf) != int(DataPreambleLength+session.BlockSize) {
-		session.SendBuf = make([]byte, session.BlockSize+DataPreambleLength)
-	}
-	if len(session.ReceiveBuf) != int(DataPreambleLength+session.BlockSize) {
-		session.ReceiveBuf = make([]byte, DataPreambleLength+session.BlockSize)
-	}
-
-	// get access to a file and associated time
-	if Cfg.Debug {
-		Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Preparing %v", session.Filename))
-	}
-	unixMicro, err = session.Prepare()
-	if err != nil {
-		return err
-	}
-	defer session.OverwriteFailure(unixMicro)
-	if Cfg.Debug {
-		Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Prepared %v with file time %v", session.Filename, unixMicro))
-	}
-
-	err = session.ReceiveDataLoop(false)
+	// the upload is only complete once the writer agrees, so the client is not told it succeeded until then
+	err = session.ReceiveDataLoop(false, func() error {
+		closed = true
+		if err := writer.Close(); err != nil {
+			return fileError(err, session.Filename)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	// It is okay to try to close an already closed file, the second close just fails
-	err = session.OverwriteSuccess(unixMicro)
-	if err != nil {
+	// the file is already available to others, stick around in case the client never saw the final acknowledgement
+	if err = session.Dally(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (session *TftpSession) ReceiveDataLoop(alreadyHoldingMessage bool) error {
+// receive data until the last block, calling finish when it is non-nil before that block is acknowledged
+func (session *TftpSession) ReceiveDataLoop(alreadyHoldingMessage bool, finish func() error) error {
 	var wroteEverything bool = false
 	var err error
 
-	// if the client sends an dataMessage then we should acknowledge it
+	// up to session.WindowSize data messages are received before acknowledging the last of them
+	// if the client sends the data message we expect then we write it and move on to the next block
+	// if the client skips ahead of the data message we expect then we acknowledge the last block written so the window restarts
 	// if the client sends an errorMessage then we log it and return error
 	// if the client sends anything else return error
 	for !wroteEverything {
 		// setup for receive loop
 		var i int = 1
 		var awaitingRequest = true
+		var windowLength uint16 = 0
+		var gapAcknowledged bool = false
+		var staleAcknowledged bool = false
 
-		// read until acknowledgement with correct blockNumber, handle gracefully retransmission
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Awaiting client data block #%v", session.BlockNumber))
+		// read until the window is full or the last block arrives, handle gracefully retransmission
+		if session.Cfg.Debug {
+			session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Awaiting client data block #%v", session.BlockNumber))
 		}
 		for awaitingRequest {
 			if i > 5 {
@@ -782,107 +969,85 @@ func (session *TftpSession) ReceiveDataLoop(alreadyHoldingMessage bool) error {
 			}
 
 			switch session.MostRecentMessage.(type) {
-			case WriteMessage:
-				// pass
-			case DataMessage:
-				if session.MostRecentMessage.(DataMessage).BlockNumber == session.BlockNumber {
-					awaitingRequest = false
-				} else if session.MostRecentMessage.(DataMessage).BlockNumber > session.BlockNumber {
-					return errors.New("Out of sync blockNumber")
+			case *WriteMessage, *OptionAcknowledgeMessage:
+				// the request or option acknowledgement was sent again so our response to it was lost
+				if session.BlockNumber == 1 && !staleAcknowledged {
+					if err = session.Resend(); err != nil {
+						return err
+					}
+					staleAcknowledged = true
 				}
-			case ErrorMessage:
-				return errors.New(session.MostRecentMessage.(ErrorMessage).Explanation)
+			case *DataMessage:
+				// number of blocks the client is ahead of the block we expect
+				ahead := session.blockDistance(session.MostRecentMessage.(*DataMessage).BlockNumber, session.BlockNumber)
+				if ahead == 0 {
+					if session.Cfg.Debug {
+						session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Writing data message with block number #%v", session.BlockNumber))
+					}
+					err = session.WriteFile()
+					if errors.Is(err, io.EOF) {
+						wroteEverything = true
+					} else if err != nil {
+						return err
+					}
+					if session.Cfg.Debug {
+						session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Wrote data message with block number #%v", session.BlockNumber))
+					}
+
+					session.LastValidMessage = session.MostRecentMessage
+					session.TotalBytesTransferred += uint64(len(session.MostRecentMessage.(*DataMessage).Body))
+					session.BlockNumber += 1
+					windowLength += 1
+					gapAcknowledged = false
+					staleAcknowledged = false
+
+					if wroteEverything || windowLength == session.WindowSize {
+						awaitingRequest = false
+					}
+				} else if ahead > 0 && ahead < int64(session.WindowSize) && !gapAcknowledged {
+					// a block went missing, acknowledge what we have so the window restarts from there
+					if session.Cfg.Debug {
+						session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Expected data block #%v but received #%v", session.BlockNumber, session.BlockNumber+uint64(ahead)))
+					}
+					if err = session.AcknowledgeMessage(session.wireBlockNumber(session.BlockNumber - 1)); err != nil {
+						return err
+					}
+					windowLength = 0
+					gapAcknowledged = true
+				} else if ahead < 0 && !staleAcknowledged {
+					// our acknowledgement was likely lost so the client sent old data again
+					if err = session.Resend(); err != nil {
+						return err
+					}
+					staleAcknowledged = true
+				}
+
+				// blocks arriving out of order are expected when windowing so they are not counted as bad messages
+				i = 0
+			case *ErrorMessage:
+				return errorFromMessage(session.MostRecentMessage.(*ErrorMessage))
 			default:
-				return errors.New("Client requested invalid operation during established connection")
+				return newError(ErrIllegalOperation, "Invalid operation during established connection")
 			}
-		}
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Client sent data block #%v", session.BlockNumber))
-		}
 
-		// write to file
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Writing data message with block number #%v", session.BlockNumber))
+			i += 1
 		}
-		err = session.WriteFile()
-		if errors.Is(err, io.EOF) {
-			wroteEverything = true
-		} else if err != nil {
-			return err
+		if session.Cfg.Debug {
+			session.Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Client sent data block #%v", session.BlockNumber-1))
 		}
-		if Cfg.Debug {
-			Log <- NewDebugEvent(session.DestinationAddr.String(), fmt.Sprintf("Wrote data message with block number #%v", session.BlockNumber))
+
+		// a failure to keep what was received is reported instead of the final acknowledgement
+		if wroteEverything && finish != nil {
+			if err = finish(); err != nil {
+				return err
+			}
 		}
 
 		// acknowledge
-		if err = session.AcknowledgeMessage(); err != nil {
+		if err = session.AcknowledgeMessage(session.wireBlockNumber(session.BlockNumber - 1)); err != nil {
 			return err
 		}
-
-		session.LastValidMessage = session.MostRecentMessage
-		session.BlockNumber += 1
 	}
 
 	return nil
 }
-
-func (session *TftpSession) UpdateOptions(options map[string]string) error {
-	for keyCased, valueAscii := range options {
-		key := strings.ToLower(keyCased)
-		valueInt, err := strconv.ParseInt(valueAscii, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-
-		switch key {
-		case "blksize":
-			if valueInt < 8 || valueInt > 65464 {
-				return errors.New(fmt.Sprintf("Invalid blksize value %v requested by client", valueInt))
-			} else {
-				session.BlockSize = uint16(valueInt)
-				options["blksize"] = valueAscii
-			}
-		case "timeout":
-			if valueInt < 1 || valueInt > 255 {
-				// refer to original specification to learn about what should be done in this case
-			} else {
-				session.Timeout = time.Second * time.Duration(valueInt)
-				options["timeout"] = valueAscii
-			}
-		case "tsize":
-			// tsize of 0 as in read request is special
-			// server responds in optionAcknowledge message with size of file
-			if valueInt == 0 {
-				if session.Operation == ReadAsServer {
-					model := newFileModelWith(session.Filename, session.UnixMicro, 0, 0)
-					info, err := Cfg.Directory.Lstat(model.Path())
-					if err != nil {
-						return errors.New(fmt.Sprintf("Unable to get the size of %v", session.Filename))
-					}
-					valueInt = info.Size()
-				} else {
-					return errors.New(fmt.Sprintf("Invalid blksize value %v requested by client", valueInt))
-				}
-			}
-
-			session.TransferSize = uint64(valueInt)
-			options["tsize"] = strconv.FormatInt(valueInt, 10)
-		case "multicast":
-			// not implement
-			continue
-		case "windowsize":
-			continue
-			//if valueInt < 1 || valueInt > 65535 {
-			// refer to original specification to learn about what should be done in this case
-			//}
-			//session.WindowSize = uint16(valueInt)
-			//options["windowsize"] = valueAscii
-		default:
-			continue
-		}
-	}
-
-	session.Options = options
-
-	return nil
-}
@@ -1,5 +1,428 @@
 package internal
 
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWireBlockNumber(t *testing.T) {
+	var session TftpSession
+
+	cases := []struct {
+		rollover    uint16
+		blockNumber uint64
+		expected    uint16
+	}{
+		{0, 1, 1},
+		{0, 0xffff, 0xffff},
+		{0, 0x10000, 0},
+		{0, 0x10001, 1},
+		{1, 0xffff, 0xffff},
+		{1, 0x10000, 1},
+		{1, 0x10001, 2},
+		{1, 0xffff * 2, 0xffff},
+		{1, 0xffff*2 + 1, 1},
+	}
+
+	for _, c := range cases {
+		session.Rollover = c.rollover
+		wire := session.wireBlockNumber(c.blockNumber)
+		if wire != c.expected {
+			t.Fatalf("rollover %v: wireBlockNumber(%v) = %v != %v\n", c.rollover, c.blockNumber, wire, c.expected)
+		}
+	}
+}
+
+func TestBlockDistance(t *testing.T) {
+	var session TftpSession
+
+	cases := []struct {
+		rollover    uint16
+		wire        uint16
+		blockNumber uint64
+		expected    int64
+	}{
+		{0, 5, 1, 4},
+		{0, 0, 1, -1},
+		{0, 2, 0xfffe, 4},
+		{0, 0xfffe, 0x10002, -4},
+		{1, 0, 1, -1},
+		{1, 2, 0xfffe, 3},
+		{1, 0xfffe, 0x10001, -3},
+		{1, 0, 0x10001, -0x10001},
+	}
+
+	for _, c := range cases {
+		session.Rollover = c.rollover
+		distance := session.blockDistance(c.wire, c.blockNumber)
+		if distance != c.expected {
+			t.Fatalf("rollover %v: blockDistance(%v, %v) = %v != %v\n", c.rollover, c.wire, c.blockNumber, distance, c.expected)
+		}
+	}
+}
+
+// log events are thrown away until the test finishes
+func discardLog(t *testing.T) chan<- logEvent {
+	log := make(chan logEvent)
+	go func() {
+		for range log {
+		}
+	}()
+	t.Cleanup(func() { close(log) })
+
+	return log
+}
+
+func TestUnknownTransferIdRefused(t *testing.T) {
+	network := NewMemoryNetwork()
+	listen := func() net.PacketConn {
+		conn, err := network.ListenPacket(nil)
+		if err != nil {
+			t.Fatalf("Unable to listen: %v\n", err)
+		}
+		return conn
+	}
+	conn, peer, stray := listen(), listen(), listen()
+	defer conn.Close()
+	defer peer.Close()
+	defer stray.Close()
+
+	session, err := NewTftpSession(context.Background(), &Config{}, discardLog(t), conn)
+	if err != nil {
+		t.Fatalf("Unable to create session: %v\n", err)
+	}
+	session.TransferId = peer.LocalAddr().(*net.UDPAddr)
+
+	// the stray message arrives first and must not be mistaken for the peer's
+	if _, err = stray.WriteTo([]byte{0, OpcodeAcknowledgeByte, 0, 7}, conn.LocalAddr()); err != nil {
+		t.Fatalf("Unable to send: %v\n", err)
+	}
+	if _, err = peer.WriteTo([]byte{0, OpcodeAcknowledgeByte, 0, 1}, conn.LocalAddr()); err != nil {
+		t.Fatalf("Unable to send: %v\n", err)
+	}
+
+	addr, err := session.ReceiveBefore(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Receive failed: %v\n", err)
+	}
+	if !sameTransferId(addr, session.TransferId) {
+		t.Fatalf("Received message from %v instead of %v\n", addr, session.TransferId)
+	}
+	if ack, ok := session.MostRecentMessage.(*AcknowledgeMessage); !ok || ack.BlockNumber != 1 {
+		t.Fatalf("Received %v instead of the peer's acknowledgement\n", session.MostRecentMessage)
+	}
+
+	buf := make([]byte, 516)
+	stray.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := stray.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Stray sender was not answered: %v\n", err)
+	}
+	message, err := BytesAsMessage(buf[:n])
+	if err != nil {
+		t.Fatalf("Unable to decode answer: %v\n", err)
+	}
+	if errorMessage, ok := message.(*ErrorMessage); !ok || errorMessage.ErrorCode != ErrorCodeUnknownTransferId {
+		t.Fatalf("Stray sender received %v instead of an unknown transfer id error\n", message)
+	}
+}
+
+// session sending or receiving file over conn to or from peer
+func newTransferSession(t *testing.T, conn net.PacketConn, peer net.Addr, file *os.File, operation uint16, windowSize uint16) *TftpSession {
+	session, err := NewTftpSession(context.Background(), &Config{}, discardLog(t), conn)
+	if err != nil {
+		t.Fatalf("Unable to create session: %v\n", err)
+	}
+	session.TransferId = peer.(*net.UDPAddr)
+	session.Reader, session.Writer = file, file
+	session.Operation = operation
+	session.WindowSize = windowSize
+	session.Timeout = 20 * time.Millisecond
+	session.Retries = 10
+	session.BlockNumber = 1
+
+	return &session
+}
+
+// a file being sent from one session to another over an in-memory network
+type testTransfer struct {
+	sender   *TftpSession
+	receiver *TftpSession
+	expected []byte
+	dst      string
+}
+
+// what each side sends suffers the faults of its schedule, nil for none
+func newTestTransfer(t *testing.T, size int, windowSize uint16, senderFaults FaultSchedule, receiverFaults FaultSchedule) *testTransfer {
+	var transfer testTransfer
+	dir := t.TempDir()
+
+	transfer.expected = make([]byte, size)
+	for i := range transfer.expected {
+		transfer.expected[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(dir+"/src", transfer.expected, 0644); err != nil {
+		t.Fatalf("Unable to write source: %v\n", err)
+	}
+	src, err := os.Open(dir + "/src")
+	if err != nil {
+		t.Fatalf("Unable to open source: %v\n", err)
+	}
+	t.Cleanup(func() { src.Close() })
+	transfer.dst = dir + "/dst"
+	dst, err := os.Create(transfer.dst)
+	if err != nil {
+		t.Fatalf("Unable to create destination: %v\n", err)
+	}
+	t.Cleanup(func() { dst.Close() })
+
+	senderConn, receiverConn := NewPacketPipe()
+	t.Cleanup(func() { senderConn.Close() })
+	t.Cleanup(func() { receiverConn.Close() })
+	if senderFaults != nil {
+		senderConn = NewLossyConn(senderConn, senderFaults, 5*time.Millisecond)
+	}
+	if receiverFaults != nil {
+		receiverConn = NewLossyConn(receiverConn, receiverFaults, 5*time.Millisecond)
+	}
+
+	transfer.sender = newTransferSession(t, senderConn, receiverConn.LocalAddr(), src, ReadAsServer, windowSize)
+	transfer.receiver = newTransferSession(t, receiverConn, senderConn.LocalAddr(), dst, ReadAsClient, windowSize)
+
+	// the receiver resends its last message when it sees old data, as if it had just accepted the options
+	transfer.receiver.SendBuf, _ = NewAcknowledgeMessage(0).AppendBinary(transfer.receiver.SendBuf[:0])
+
+	return &transfer
+}
+
+// send the whole file, the receiver dallies the way a server does after an upload
+func (transfer *testTransfer) run(t *testing.T) {
+	sent := make(chan error, 1)
+	go func() { sent <- transfer.sender.SendDataLoop(false) }()
+
+	err := transfer.receiver.ReceiveDataLoop(false, nil)
+	if err == nil {
+		err = transfer.receiver.Dally()
+	}
+	if err != nil {
+		t.Fatalf("size %v windowsize %v: receiving failed: %v\n", len(transfer.expected), transfer.receiver.WindowSize, err)
+	}
+	if err = <-sent; err != nil {
+		t.Fatalf("size %v windowsize %v: sending failed: %v\n", len(transfer.expected), transfer.sender.WindowSize, err)
+	}
+
+	received, err := os.ReadFile(transfer.dst)
+	if err != nil {
+		t.Fatalf("Unable to read destination: %v\n", err)
+	}
+	if !bytes.Equal(transfer.expected, received) {
+		t.Fatalf("size %v windowsize %v: received %v bytes that differ from the %v sent\n", len(transfer.expected), transfer.sender.WindowSize, len(received), len(transfer.expected))
+	}
+}
+
+func TestTransferOverMemoryNetwork(t *testing.T) {
+	cases := []struct {
+		size       int
+		windowSize uint16
+	}{
+		{0, 1},
+		{100, 1},
+		{512 * 4, 1},
+		{512*9 + 100, 1},
+		{512 * 4, 4},
+		{512*9 + 100, 4},
+	}
+
+	for _, c := range cases {
+		newTestTransfer(t, c.size, c.windowSize, nil, nil).run(t)
+	}
+}
+
+// fault only packets starting with opcode, counting each of them
+func faultOpcode(opcode byte, fault func(count int, buf []byte) Fault) FaultFunc {
+	var count int
+	return func(from net.Addr, to net.Addr, buf []byte) Fault {
+		if len(buf) < 2 || buf[1] != opcode {
+			return FaultNone
+		}
+		count += 1
+		return fault(count, buf)
+	}
+}
+
+// duplicated acknowledgements must not make the sender send every block twice
+func TestTransferSorcerersApprentice(t *testing.T) {
+	var dataSent int
+	countData := faultOpcode(OpcodeDataByte, func(count int, buf []byte) Fault {
+		dataSent = count
+		return FaultNone
+	})
+	duplicateAcknowledgements := faultOpcode(OpcodeAcknowledgeByte, func(count int, buf []byte) Fault {
+		return FaultDuplicate
+	})
+
+	transfer := newTestTransfer(t, 512*20+1, 1, countData, duplicateAcknowledgements)
+	transfer.run(t)
+	if dataSent != 21 {
+		t.Fatalf("Sent %v data messages for 21 blocks\n", dataSent)
+	}
+}
+
+// the receiver acknowledges the final block again when the sender never saw the first acknowledgement
+func TestTransferLostFinalAcknowledgement(t *testing.T) {
+	for _, windowSize := range []uint16{1, 4} {
+		var dropped bool
+		dropFinalAcknowledgement := faultOpcode(OpcodeAcknowledgeByte, func(count int, buf []byte) Fault {
+			if buf[2] == 0 && buf[3] == 10 && !dropped {
+				dropped = true
+				return FaultDrop
+			}
+			return FaultNone
+		})
+
+		newTestTransfer(t, 512*9+100, windowSize, nil, dropFinalAcknowledgement).run(t)
+	}
+}
+
+// an option acknowledgement sent again arriving after the first data message is ignored
+func TestTransferReorderedOptionAcknowledgement(t *testing.T) {
+	transfer := newTestTransfer(t, 512*3, 1, NewScriptedFaults(FaultNone, FaultReorder), nil)
+	transfer.sender.Options = map[string]string{"blksize": "512"}
+	transfer.receiver.Options = map[string]string{"blksize": "512"}
+
+	// the second option acknowledgement is held back until the first data message is sent
+	for i := 0; i < 2; i++ {
+		if err := transfer.sender.OptionAcknowledgeMessage(); err != nil {
+			t.Fatalf("Unable to send option acknowledgement: %v\n", err)
+		}
+	}
+	if _, err := transfer.receiver.Receive(); err != nil {
+		t.Fatalf("Option acknowledgement never arrived: %v\n", err)
+	}
+	if _, ok := transfer.receiver.MostRecentMessage.(*OptionAcknowledgeMessage); !ok {
+		t.Fatalf("Received %v instead of an option acknowledgement\n", transfer.receiver.MostRecentMessage)
+	}
+	if err := transfer.receiver.AcknowledgeMessage(0); err != nil {
+		t.Fatalf("Unable to acknowledge options: %v\n", err)
+	}
+	if _, err := transfer.sender.Receive(); err != nil {
+		t.Fatalf("Acknowledgement of options never arrived: %v\n", err)
+	}
+
+	transfer.run(t)
+}
+
+// block numbers of the messages starting with opcode in the order they were sent, faulting them as fault says
+func recordBlockNumbers(opcode byte, blockNumbers *[]uint16, fault func(blockNumber uint16, count int) Fault) FaultFunc {
+	return faultOpcode(opcode, func(count int, buf []byte) Fault {
+		blockNumber := uint16(buf[2])<<8 | uint16(buf[3])
+		*blockNumbers = append(*blockNumbers, blockNumber)
+		if fault == nil {
+			return FaultNone
+		}
+		return fault(blockNumber, count)
+	})
+}
+
+// every window is sent in full before a single acknowledgement of its last block, the last window is cut short by the end of the file
+func TestTransferWindowed(t *testing.T) {
+	cases := []struct {
+		size            int
+		windowSize      uint16
+		acknowledgments []uint16
+	}{
+		{512*9 + 100, 1, []uint16{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{512*9 + 100, 2, []uint16{2, 4, 6, 8, 10}},
+		{512*9 + 100, 4, []uint16{4, 8, 10}},
+		{512 * 8, 4, []uint16{4, 8, 9}},
+		{512*9 + 100, 16, []uint16{10}},
+		{0, 4, []uint16{1}},
+	}
+
+	for _, c := range cases {
+		var data, acknowledgements []uint16
+		transfer := newTestTransfer(t, c.size, c.windowSize, recordBlockNumbers(OpcodeDataByte, &data, nil), recordBlockNumbers(OpcodeAcknowledgeByte, &acknowledgements, nil))
+		transfer.run(t)
+
+		if blocks := c.size/512 + 1; len(data) != blocks || data[0] != 1 || int(data[len(data)-1]) != blocks {
+			t.Fatalf("size %v windowsize %v: sent data %v\n", c.size, c.windowSize, data)
+		}
+		if !slices.Equal(acknowledgements, c.acknowledgments) {
+			t.Fatalf("size %v windowsize %v: acknowledged %v instead of %v\n", c.size, c.windowSize, acknowledgements, c.acknowledgments)
+		}
+		if transfer.sender.TotalBytesTransferred != uint64(c.size) || transfer.receiver.TotalBytesTransferred != uint64(c.size) {
+			t.Fatalf("size %v windowsize %v: counted %v bytes sent and %v received\n", c.size, c.windowSize, transfer.sender.TotalBytesTransferred, transfer.receiver.TotalBytesTransferred)
+		}
+	}
+}
+
+// a block missing from a window is acknowledged once as a gap and the sender resumes from it instead of resending the window
+func TestTransferGapResend(t *testing.T) {
+	var data, acknowledgements []uint16
+	dropSecond := func(blockNumber uint16, count int) Fault {
+		if blockNumber == 2 && count == 2 {
+			return FaultDrop
+		}
+		return FaultNone
+	}
+
+	transfer := newTestTransfer(t, 512*9+100, 4, recordBlockNumbers(OpcodeDataByte, &data, dropSecond), recordBlockNumbers(OpcodeAcknowledgeByte, &acknowledgements, nil))
+	transfer.run(t)
+
+	if expected := []uint16{1, 2, 3, 4, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !slices.Equal(data, expected) {
+		t.Fatalf("Sent data %v instead of %v\n", data, expected)
+	}
+	if expected := []uint16{1, 5, 9, 10}; !slices.Equal(acknowledgements, expected) {
+		t.Fatalf("Acknowledged %v instead of %v\n", acknowledgements, expected)
+	}
+	if transfer.sender.TotalBytesTransferred != 512*9+100 {
+		t.Fatalf("Counted %v bytes sent\n", transfer.sender.TotalBytesTransferred)
+	}
+}
+
+// when the acknowledgement of a gap is lost the sender times out and resends the whole window
+func TestTransferGapAcknowledgementLost(t *testing.T) {
+	var data, acknowledgements []uint16
+	dropSecond := func(blockNumber uint16, count int) Fault {
+		if blockNumber == 2 && count == 2 {
+			return FaultDrop
+		}
+		return FaultNone
+	}
+	dropGap := func(blockNumber uint16, count int) Fault {
+		if count == 1 {
+			return FaultDrop
+		}
+		return FaultNone
+	}
+
+	transfer := newTestTransfer(t, 512*9+100, 4, recordBlockNumbers(OpcodeDataByte, &data, dropSecond), recordBlockNumbers(OpcodeAcknowledgeByte, &acknowledgements, dropGap))
+	transfer.run(t)
+
+	if expected := []uint16{1, 2, 3, 4, 1, 2, 3, 4}; len(data) < len(expected) || !slices.Equal(data[:len(expected)], expected) {
+		t.Fatalf("Sent data %v, expected it to begin with %v\n", data, expected)
+	}
+	// the resent first block is old so the gap is acknowledged again
+	if len(acknowledgements) < 2 || acknowledgements[1] != 1 || acknowledgements[len(acknowledgements)-1] != 10 {
+		t.Fatalf("Acknowledged %v\n", acknowledgements)
+	}
+}
+
+func TestTransferRandomFaults(t *testing.T) {
+	rates := FaultRates{Drop: 0.05, Duplicate: 0.05, Reorder: 0.05, Delay: 0.05}
+
+	for seed := uint64(1); seed <= 4; seed++ {
+		for _, windowSize := range []uint16{1, 4} {
+			newTestTransfer(t, 512*30+7, windowSize, NewRandomFaults(seed, rates), NewRandomFaults(seed+100, rates)).run(t)
+		}
+	}
+}
+
 // Testing the functions used by the server is important.
 // The read and write functions, however, seem far easier to test using real TFTP clients
 
@@ -0,0 +1,335 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Keeps every version of every file a server serves.
+ * Readers always get the newest completed version and keep it for as long as they read it,
+ * an upload becomes the newest version only once it is committed,
+ * and versions that are out of date and no longer read are deleted.
+ * Database keeps versions in a directory tracked by sqlite, MemoryStore keeps them in memory,
+ * and DirectoryStore keeps only the newest version of each file under its real name.
+ */
+type Store interface {
+	// reserve the newest completed version of filename, the reservation is released by closing the reader
+	OpenLatest(ctx context.Context, filename string) (StoredReader, error)
+	// reserve the completed version of filename that was started at started
+	OpenVersion(ctx context.Context, filename string, started int64) (StoredReader, error)
+	// start a new version of filename that nobody can read until it is committed
+	BeginUpload(ctx context.Context, filename string) (Upload, error)
+	// every version of filename oldest first, including uploads in progress
+	Versions(ctx context.Context, filename string) ([]Version, error)
+	// delete every version of every file that is out of date and not being read
+	GarbageCollect(ctx context.Context) error
+	Close() error
+}
+
+// a version of a file reserved for reading, closing it releases the reservation
+type StoredReader interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	Version() Version
+}
+
+// a version of a file being uploaded, exactly one of Commit and Abort must be called
+type Upload interface {
+	io.Writer
+	// make the version the newest one and delete out of date versions nobody is reading
+	Commit() error
+	// throw the version away
+	Abort() error
+}
+
+// one version of a file, times are in unix microseconds
+type Version struct {
+	Filename string
+	// identifies the version among those of the same file
+	Started int64
+	// 0 while the upload is in progress
+	Completed int64
+	// readers holding a reservation
+	Consumers int64
+	// bytes recorded once the upload completes, -1 when unknown
+	Size int64
+	// when the version was last promoted to be served again, 0 when it never was
+	Promoted int64
+}
+
+// when the version started being served, of the completed versions of a file the one that did last is served
+func (version Version) Served() int64 {
+	return max(version.Completed, version.Promoted)
+}
+
+// filename.<uploadStarted>, unique among every version of every file and where the sqlite database keeps its file
+func (version Version) Path() string {
+	return version.Filename + "." + strconv.FormatInt(version.Started, 10)
+}
+
+// answers requests with the versions kept in store
+type storeHandler struct {
+	store Store
+}
+
+// reads of name@<uploadStarted> get that version of name instead of the newest one
+func (handler storeHandler) ServeRead(ctx context.Context, request *Request) (io.ReadSeeker, error) {
+	if filename, started, ok := SplitVersion(request.Filename); ok {
+		reader, err := handler.store.OpenVersion(ctx, filename, started)
+		if !errors.Is(err, ErrNotFound) {
+			return reader, err
+		}
+		// a file that only happens to be named like a version
+	}
+
+	return handler.store.OpenLatest(ctx, request.Filename)
+}
+
+// uploads can not be named like a version because they could never be read
+func (handler storeHandler) ServeWrite(ctx context.Context, request *Request) (io.WriteCloser, error) {
+	if _, _, ok := SplitVersion(request.Filename); ok {
+		return nil, newError(ErrAccessViolation, request.Filename)
+	}
+
+	upload, err := handler.store.BeginUpload(ctx, request.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return storeUpload{upload}, nil
+}
+
+// split name@<uploadStarted> into name and uploadStarted, ok is false for every other filename
+func SplitVersion(filename string) (name string, started int64, ok bool) {
+	at := strings.LastIndexByte(filename, '@')
+	if at <= 0 {
+		return filename, 0, false
+	}
+	unixMicro, err := strconv.ParseUint(filename[at+1:], 10, 63)
+	if err != nil {
+		return filename, 0, false
+	}
+
+	return filename[:at], int64(unixMicro), true
+}
+
+// closing an upload given to a session commits it
+type storeUpload struct {
+	Upload
+}
+
+func (upload storeUpload) Close() error {
+	return upload.Commit()
+}
+
+/*
+ * A Store keeping versions in memory, for tests and servers that need not remember anything once stopped.
+ * Create with NewMemoryStore.
+ */
+type MemoryStore struct {
+	lock sync.Mutex
+	// versions of each file oldest first
+	files map[string][]*memoryVersion
+	// last time handed out to an upload so that every version has its own
+	lastStarted int64
+	// which out of date versions are kept once nobody reads them
+	retention RetentionPolicy
+}
+
+type memoryVersion struct {
+	Version
+	contents []byte
+}
+
+// retention works as it does for the sqlite database, nil keeps only the newest version of each file and the one before it
+func NewMemoryStore(retention RetentionPolicy) *MemoryStore {
+	return &MemoryStore{files: make(map[string][]*memoryVersion), retention: retention}
+}
+
+func (store *MemoryStore) OpenLatest(ctx context.Context, filename string) (StoredReader, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var latest *memoryVersion
+	for _, version := range store.files[filename] {
+		if version.Completed != 0 && (latest == nil || version.Completed > latest.Completed) {
+			latest = version
+		}
+	}
+	if latest == nil {
+		return nil, newError(ErrNotFound, filename)
+	}
+
+	return store.reserve(latest), nil
+}
+
+func (store *MemoryStore) OpenVersion(ctx context.Context, filename string, started int64) (StoredReader, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for _, version := range store.files[filename] {
+		if version.Started == started && version.Completed != 0 {
+			return store.reserve(version), nil
+		}
+	}
+
+	return nil, newError(ErrNotFound, filename)
+}
+
+// must hold store.lock
+func (store *MemoryStore) reserve(version *memoryVersion) StoredReader {
+	version.Consumers += 1
+
+	return &memoryReader{Reader: bytes.NewReader(version.contents), store: store, version: version}
+}
+
+func (store *MemoryStore) BeginUpload(ctx context.Context, filename string) (Upload, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	started := max(time.Now().UnixMicro(), store.lastStarted+1)
+	store.lastStarted = started
+	version := &memoryVersion{Version: Version{Filename: filename, Started: started, Size: -1}}
+	store.files[filename] = append(store.files[filename], version)
+
+	return &memoryUpload{store: store, version: version}, nil
+}
+
+func (store *MemoryStore) Versions(ctx context.Context, filename string) ([]Version, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var versions []Version
+	for _, version := range store.files[filename] {
+		versions = append(versions, version.Version)
+	}
+
+	return versions, nil
+}
+
+func (store *MemoryStore) GarbageCollect(ctx context.Context) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for filename := range store.files {
+		store.deleteOutOfDate(filename)
+	}
+
+	return nil
+}
+
+// nothing to clean up, versions are forgotten along with the store
+func (store *MemoryStore) Close() error {
+	return nil
+}
+
+// delete versions of filename that are out of date, not being read or uploaded, and not kept by the retention policy
+// must hold store.lock
+func (store *MemoryStore) deleteOutOfDate(filename string) {
+	var completed []*memoryVersion
+	var now time.Time = time.Now()
+
+	for _, version := range store.files[filename] {
+		if version.Completed != 0 {
+			completed = append(completed, version)
+		}
+	}
+	slices.SortFunc(completed, func(a *memoryVersion, b *memoryVersion) int {
+		return cmp.Compare(b.Completed, a.Completed)
+	})
+
+	for newer, version := range completed {
+		if version.Consumers == 0 && !store.retention.retains(filename, newer, version.Completed, now) {
+			store.forget(version)
+		}
+	}
+}
+
+// must hold store.lock
+func (store *MemoryStore) forget(version *memoryVersion) {
+	store.files[version.Filename] = slices.DeleteFunc(store.files[version.Filename], func(other *memoryVersion) bool {
+		return other == version
+	})
+	if len(store.files[version.Filename]) == 0 {
+		delete(store.files, version.Filename)
+	}
+}
+
+type memoryReader struct {
+	*bytes.Reader
+	store   *MemoryStore
+	version *memoryVersion
+	closed  bool
+}
+
+func (reader *memoryReader) Version() Version {
+	reader.store.lock.Lock()
+	defer reader.store.lock.Unlock()
+
+	return reader.version.Version
+}
+
+func (reader *memoryReader) Close() error {
+	reader.store.lock.Lock()
+	defer reader.store.lock.Unlock()
+
+	if reader.closed {
+		return errors.New("Reader already closed")
+	}
+	reader.closed = true
+	reader.version.Consumers -= 1
+	reader.store.deleteOutOfDate(reader.version.Filename)
+
+	return nil
+}
+
+type memoryUpload struct {
+	bytes.Buffer
+	store   *MemoryStore
+	version *memoryVersion
+	done    bool
+}
+
+func (upload *memoryUpload) Commit() error {
+	upload.store.lock.Lock()
+	defer upload.store.lock.Unlock()
+
+	if upload.done {
+		return errors.New("Upload already finished")
+	}
+	upload.done = true
+	upload.version.contents = upload.Bytes()
+	upload.version.Size = int64(upload.Len())
+	// never complete before the version being replaced did
+	upload.version.Completed = upload.version.Started
+	for _, other := range upload.store.files[upload.version.Filename] {
+		upload.version.Completed = max(upload.version.Completed, other.Completed+1)
+	}
+	upload.version.Completed = max(upload.version.Completed, time.Now().UnixMicro())
+	upload.store.deleteOutOfDate(upload.version.Filename)
+
+	return nil
+}
+
+func (upload *memoryUpload) Abort() error {
+	upload.store.lock.Lock()
+	defer upload.store.lock.Unlock()
+
+	if upload.done {
+		return errors.New("Upload already finished")
+	}
+	upload.done = true
+	upload.store.forget(upload.version)
+
+	return nil
+}
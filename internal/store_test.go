@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// every backend, each empty and keeping out of date versions by retention
+func testStores(t *testing.T, retention RetentionPolicy) map[string]Store {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/root", 0755); err != nil {
+		t.Fatalf("Unable to create root: %v\n", err)
+	}
+	root, err := os.OpenRoot(dir + "/root")
+	if err != nil {
+		t.Fatalf("Unable to open root: %v\n", err)
+	}
+	t.Cleanup(func() { root.Close() })
+
+	database, err := OpenDatabase(&Config{Directory: root, Sqlite3DBPath: dir + "/tftpcpd.db", Retention: retention}, discardLog(t))
+	if err != nil {
+		t.Fatalf("Unable to open database: %v\n", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	return map[string]Store{"database": database, "memory": NewMemoryStore(retention)}
+}
+
+func upload(t *testing.T, store Store, filename string, contents string) {
+	upload, err := store.BeginUpload(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("Unable to begin upload of %v: %v\n", filename, err)
+	}
+	if _, err = io.WriteString(upload, contents); err != nil {
+		t.Fatalf("Unable to write %v: %v\n", filename, err)
+	}
+	if err = upload.Commit(); err != nil {
+		t.Fatalf("Unable to commit %v: %v\n", filename, err)
+	}
+}
+
+func readAllStored(t *testing.T, reader StoredReader) string {
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Unable to read %v: %v\n", reader.Version().Filename, err)
+	}
+
+	return string(contents)
+}
+
+func TestStoreVersions(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t, nil) {
+		if _, err := store.OpenLatest(ctx, "config"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%v: Opening missing file returned %v instead of %v\n", name, err, ErrNotFound)
+		}
+
+		upload(t, store, "config", "first")
+		old, err := store.OpenLatest(ctx, "config")
+		if err != nil {
+			t.Fatalf("%v: Unable to open first version: %v\n", name, err)
+		}
+
+		// uploads are invisible until committed and gone once aborted
+		pending, err := store.BeginUpload(ctx, "config")
+		if err != nil {
+			t.Fatalf("%v: Unable to begin upload: %v\n", name, err)
+		}
+		io.WriteString(pending, "aborted")
+		if versions, _ := store.Versions(ctx, "config"); len(versions) != 2 || versions[1].Completed != 0 {
+			t.Fatalf("%v: Versions during upload %+v\n", name, versions)
+		}
+		if err = pending.Abort(); err != nil {
+			t.Fatalf("%v: Unable to abort: %v\n", name, err)
+		}
+
+		// a reader keeps the version it reserved after a newer one is committed
+		upload(t, store, "config", "second")
+		latest, err := store.OpenLatest(ctx, "config")
+		if err != nil {
+			t.Fatalf("%v: Unable to open second version: %v\n", name, err)
+		}
+		if contents := readAllStored(t, latest); contents != "second" {
+			t.Fatalf("%v: Latest version is %q\n", name, contents)
+		}
+		if contents := readAllStored(t, old); contents != "first" {
+			t.Fatalf("%v: Reserved version became %q\n", name, contents)
+		}
+
+		versions, err := store.Versions(ctx, "config")
+		if err != nil || len(versions) != 2 || versions[0].Started != old.Version().Started || versions[1].Started != latest.Version().Started {
+			t.Fatalf("%v: Versions %+v %v\n", name, versions, err)
+		}
+		again, err := store.OpenVersion(ctx, "config", old.Version().Started)
+		if err != nil {
+			t.Fatalf("%v: Unable to open first version again: %v\n", name, err)
+		}
+		if contents := readAllStored(t, again); contents != "first" {
+			t.Fatalf("%v: First version opened again is %q\n", name, contents)
+		}
+
+		// the out of date version goes once nobody reads it and it is no longer the one before the newest
+		again.Close()
+		old.Close()
+		latest.Close()
+		upload(t, store, "config", "third")
+		if err = store.GarbageCollect(ctx); err != nil {
+			t.Fatalf("%v: Unable to collect garbage: %v\n", name, err)
+		}
+		versions, _ = store.Versions(ctx, "config")
+		if len(versions) != 2 || versions[0].Started != latest.Version().Started {
+			t.Fatalf("%v: Versions after release %+v instead of the newest and the one before it\n", name, versions)
+		}
+		for _, version := range versions {
+			if version.Started == old.Version().Started || version.Consumers != 0 {
+				t.Fatalf("%v: Versions after release %+v\n", name, versions)
+			}
+		}
+		if _, err = store.OpenVersion(ctx, "config", old.Version().Started); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%v: Deleted version opened: %v\n", name, err)
+		}
+	}
+}
+
+// every backend keeps the versions the retention policy asks for and the one before the newest
+func TestStoreRetention(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t, RetentionPolicy{{Pattern: "*.cfg", Keep: 3}}) {
+		for _, filename := range []string{"menu.cfg", "kernel"} {
+			for _, contents := range []string{"first", "second", "third", "fourth"} {
+				upload(t, store, filename, contents)
+			}
+		}
+		if err := store.GarbageCollect(ctx); err != nil {
+			t.Fatalf("%v: Unable to collect garbage: %v\n", name, err)
+		}
+
+		cases := map[string][]string{
+			"menu.cfg": {"second", "third", "fourth"},
+			"kernel":   {"third", "fourth"},
+		}
+		for filename, expected := range cases {
+			versions, err := store.Versions(ctx, filename)
+			if err != nil || len(versions) != len(expected) {
+				t.Fatalf("%v: Versions of %v %+v %v instead of %v\n", name, filename, versions, err, expected)
+			}
+			for i, version := range versions {
+				reader, err := store.OpenVersion(ctx, filename, version.Started)
+				if err != nil {
+					t.Fatalf("%v: Unable to open kept version of %v: %v\n", name, filename, err)
+				}
+				contents := readAllStored(t, reader)
+				reader.Close()
+				if contents != expected[i] {
+					t.Fatalf("%v: Kept version %v of %v is %q instead of %q\n", name, i, filename, contents, expected[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+ * Where sessions get the packet conns they send and receive with.
+ * The server listens for requests, each session and client gets a conn of its own, and multicast transfers share one.
+ * Addresses handed out by ReadFrom and LocalAddr are *net.UDPAddr so that transfer ids compare the same on every network.
+ * Config.Network picks the network used, nil means real UDP sockets.
+ */
+type Network interface {
+	// listen on laddr, a port of 0 picks one that is free
+	ListenPacket(laddr *net.UDPAddr) (net.PacketConn, error)
+}
+
+// sockets provided by the operating system
+type udpNetwork struct{}
+
+func (network udpNetwork) ListenPacket(laddr *net.UDPAddr) (net.PacketConn, error) {
+	return net.ListenUDP("udp", laddr)
+}
+
+// join group on every interface the operating system picks
+func (network udpNetwork) ListenMulticast(group *net.UDPAddr) (net.PacketConn, error) {
+	return net.ListenMulticastUDP("udp", nil, group)
+}
+
+var UDPNetwork Network = udpNetwork{}
+
+// networks that deliver what is sent to a multicast group to everyone listening on it
+type multicastNetwork interface {
+	// receive what is sent to group
+	ListenMulticast(group *net.UDPAddr) (net.PacketConn, error)
+}
+
+// listen on laddr using whichever network was configured
+func (cfg *Config) listenPacket(laddr *net.UDPAddr) (net.PacketConn, error) {
+	if cfg.Network == nil {
+		return UDPNetwork.ListenPacket(laddr)
+	}
+
+	return cfg.Network.ListenPacket(laddr)
+}
+
+// receive what is sent to group on the configured network, networks that can not do so leave it to the operating system's sockets
+func (cfg *Config) listenMulticast(group *net.UDPAddr) (net.PacketConn, error) {
+	if network, ok := cfg.Network.(multicastNetwork); ok {
+		return network.ListenMulticast(group)
+	}
+
+	return UDPNetwork.(multicastNetwork).ListenMulticast(group)
+}
+
+// transfer ids are compared as udp addresses no matter what network they came from
+func udpAddr(addr net.Addr) (*net.UDPAddr, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr, nil
+	}
+
+	return net.ResolveUDPAddr("udp", addr.String())
+}
+
+var ErrAddressInUse = errors.New("Address already in use")
+
+// packets waiting to be read from a memory conn, more than this are dropped like a full socket buffer would
+const memoryConnBacklog = 256
+
+/*
+ * A network that only exists inside this process, packets never touch a socket.
+ * Like UDP, packets sent to an address nobody is listening on or to a conn that is not keeping up are dropped.
+ * Packets sent to a multicast group reach every conn from ListenMulticast for that group.
+ * Ports of 0 are given the next free port counting up from 49152 so the same test always sees the same addresses.
+ * Safe for use by many goroutines.
+ */
+type MemoryNetwork struct {
+	lock     sync.Mutex
+	conns    map[netip.AddrPort]*memoryConn
+	nextPort uint16
+	// conns receiving what is sent to each group
+	groups map[netip.AddrPort][]*memoryConn
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{conns: make(map[netip.AddrPort]*memoryConn), nextPort: 49152, groups: make(map[netip.AddrPort][]*memoryConn)}
+}
+
+// two packet conns on a network of their own, each sends to the other with WriteTo(buf, other.LocalAddr())
+func NewPacketPipe() (net.PacketConn, net.PacketConn) {
+	network := NewMemoryNetwork()
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	// a new network has every port free
+	a, _ := network.ListenPacket(loopback)
+	b, _ := network.ListenPacket(loopback)
+
+	return a, b
+}
+
+// listen on laddr, no address at all or an unspecified one listens on 127.0.0.1
+func (network *MemoryNetwork) ListenPacket(laddr *net.UDPAddr) (net.PacketConn, error) {
+	var addr netip.AddrPort
+	var ip netip.Addr = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	var port uint16
+
+	if laddr != nil {
+		if parsed, ok := netip.AddrFromSlice(laddr.IP); ok && !parsed.Unmap().IsUnspecified() {
+			ip = parsed.Unmap()
+		}
+		port = uint16(laddr.Port)
+	}
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if port == 0 {
+		for tried := 0; ; tried++ {
+			if tried > 0xffff {
+				return nil, ErrAddressInUse
+			}
+			port = network.nextPort
+			network.nextPort = max(network.nextPort+1, 49152)
+			if _, inUse := network.conns[netip.AddrPortFrom(ip, port)]; !inUse {
+				break
+			}
+		}
+	}
+
+	addr = netip.AddrPortFrom(ip, port)
+	if _, inUse := network.conns[addr]; inUse {
+		return nil, ErrAddressInUse
+	}
+
+	conn := &memoryConn{
+		network:         network,
+		addr:            addr,
+		packets:         make(chan memoryPacket, memoryConnBacklog),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	network.conns[addr] = conn
+
+	return conn, nil
+}
+
+/*
+ * Receive what is sent to group on a conn of its own listening on a free port of 127.0.0.1.
+ * Every conn joining the same group gets its own copy of each packet.
+ */
+func (network *MemoryNetwork) ListenMulticast(group *net.UDPAddr) (net.PacketConn, error) {
+	dst, ok := netip.AddrFromSlice(group.IP)
+	if !ok || !dst.Unmap().IsMulticast() {
+		return nil, errors.New("Not a multicast group: " + group.String())
+	}
+
+	conn, err := network.ListenPacket(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	member := conn.(*memoryConn)
+	member.group = netip.AddrPortFrom(dst.Unmap(), uint16(group.Port))
+	network.groups[member.group] = append(network.groups[member.group], member)
+
+	return member, nil
+}
+
+// deliver buf from src to whoever listens on dst, or to every member when dst is a group
+func (network *MemoryNetwork) deliver(buf []byte, src netip.AddrPort, dst netip.AddrPort) {
+	var conns []*memoryConn
+
+	network.lock.Lock()
+	if dst.Addr().IsMulticast() {
+		conns = append(conns, network.groups[dst]...)
+	} else if conn, ok := network.conns[dst]; ok {
+		conns = append(conns, conn)
+	}
+	network.lock.Unlock()
+
+	for _, conn := range conns {
+		select {
+		case conn.packets <- memoryPacket{buf, net.UDPAddrFromAddrPort(src)}:
+		default:
+			// dropped, the reader is not keeping up
+		}
+	}
+}
+
+type memoryPacket struct {
+	bytes []byte
+	addr  *net.UDPAddr
+}
+
+type memoryConn struct {
+	network *MemoryNetwork
+	addr    netip.AddrPort
+	packets chan memoryPacket
+	// the multicast group joined with ListenMulticast, invalid for other conns
+	group netip.AddrPort
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// closed and replaced whenever the deadline changes so blocked readers notice
+	lock            sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+}
+
+func (conn *memoryConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	for {
+		conn.lock.Lock()
+		deadline, deadlineChanged := conn.readDeadline, conn.deadlineChanged
+		conn.lock.Unlock()
+
+		// a nil channel never fires, used when there is no deadline
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			if !time.Now().Before(deadline) {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		select {
+		case packet := <-conn.packets:
+			stopTimer(timer)
+			// like UDP, whatever does not fit in buf is lost
+			return copy(buf, packet.bytes), packet.addr, nil
+		case <-conn.closed:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-deadlineChanged:
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (conn *memoryConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+		// pass
+	}
+
+	dst, err := udpAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	// the sender may reuse buf as soon as we return
+	conn.network.deliver(append([]byte(nil), buf...), conn.addr, netip.AddrPortFrom(dst.AddrPort().Addr().Unmap(), uint16(dst.Port)))
+
+	return len(buf), nil
+}
+
+func (conn *memoryConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.network.lock.Lock()
+		delete(conn.network.conns, conn.addr)
+		if conn.group.IsValid() {
+			members := conn.network.groups[conn.group]
+			members = slices.DeleteFunc(members, func(member *memoryConn) bool { return member == conn })
+			if len(members) == 0 {
+				delete(conn.network.groups, conn.group)
+			} else {
+				conn.network.groups[conn.group] = members
+			}
+		}
+		conn.network.lock.Unlock()
+
+		close(conn.closed)
+	})
+
+	return nil
+}
+
+func (conn *memoryConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(conn.addr)
+}
+
+func (conn *memoryConn) SetDeadline(deadline time.Time) error {
+	return conn.SetReadDeadline(deadline)
+}
+
+func (conn *memoryConn) SetReadDeadline(deadline time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.readDeadline = deadline
+	close(conn.deadlineChanged)
+	conn.deadlineChanged = make(chan struct{})
+
+	return nil
+}
+
+// writes never block so there is nothing for a write deadline to do
+func (conn *memoryConn) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPacketPipe(t *testing.T) {
+	a, b := NewPacketPipe()
+	defer a.Close()
+	defer b.Close()
+
+	if _, err := a.WriteTo([]byte("ping"), b.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo failed: %v\n", err)
+	}
+
+	buf := make([]byte, 16)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v\n", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("%q != ping\n", buf[:n])
+	}
+	if !sameTransferId(addr.(*net.UDPAddr), a.LocalAddr().(*net.UDPAddr)) {
+		t.Fatalf("%v != %v\n", addr, a.LocalAddr())
+	}
+}
+
+func TestMemoryNetworkPorts(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	a, err := network.ListenPacket(nil)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v\n", err)
+	}
+	b, err := network.ListenPacket(&net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v\n", err)
+	}
+	if a.LocalAddr().String() != "127.0.0.1:49152" || b.LocalAddr().String() != "127.0.0.1:49153" {
+		t.Fatalf("Unexpected addresses %v and %v\n", a.LocalAddr(), b.LocalAddr())
+	}
+
+	if _, err = network.ListenPacket(a.LocalAddr().(*net.UDPAddr)); !errors.Is(err, ErrAddressInUse) {
+		t.Fatalf("%v != %v\n", err, ErrAddressInUse)
+	}
+
+	// closing frees the address
+	a.Close()
+	if _, err = network.ListenPacket(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 49152}); err != nil {
+		t.Fatalf("ListenPacket failed after close: %v\n", err)
+	}
+}
+
+func TestMemoryConnDeadline(t *testing.T) {
+	a, b := NewPacketPipe()
+	defer a.Close()
+	defer b.Close()
+	buf := make([]byte, 16)
+
+	a.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, _, err := a.ReadFrom(buf); !os.IsTimeout(err) {
+		t.Fatalf("Expired deadline returned %v\n", err)
+	}
+
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := a.ReadFrom(buf); !os.IsTimeout(err) {
+		t.Fatalf("Deadline returned %v\n", err)
+	}
+
+	// moving the deadline while blocked wakes the reader
+	a.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.SetReadDeadline(time.Now())
+	}()
+	if _, _, err := a.ReadFrom(buf); !os.IsTimeout(err) {
+		t.Fatalf("Changed deadline returned %v\n", err)
+	}
+}
+
+func TestMemoryConnClose(t *testing.T) {
+	a, b := NewPacketPipe()
+	defer a.Close()
+
+	b.Close()
+	if _, _, err := b.ReadFrom(make([]byte, 16)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("%v != %v\n", err, net.ErrClosed)
+	}
+	if _, err := b.WriteTo([]byte("ping"), a.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("%v != %v\n", err, net.ErrClosed)
+	}
+
+	// like UDP, sending to nobody succeeds and goes nowhere
+	if _, err := a.WriteTo([]byte("ping"), b.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo closed address failed: %v\n", err)
+	}
+}
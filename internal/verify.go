@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+/*
+ * What checking the files table against the root directory found.
+ * Nothing is changed, so verifying is safe while a server uses the database.
+ */
+type VerifyReport struct {
+	// completed versions with a row but no file
+	RowsWithoutFiles []Version
+	// completed versions whose file is not the size recorded when the upload completed
+	Truncated []Version
+	// files named like versions that have no row
+	FilesWithoutRows []string
+	// files that are not versions, a server started with -import imports them
+	Unmanaged []string
+}
+
+// how many things are wrong, unmanaged files are only waiting to be imported
+func (report VerifyReport) Problems() int {
+	return len(report.RowsWithoutFiles) + len(report.Truncated) + len(report.FilesWithoutRows)
+}
+
+// check that every completed version has its file at the size recorded and every file is a version or waiting to be imported
+func (database *Database) Verify(ctx context.Context) (VerifyReport, error) {
+	var report VerifyReport
+
+	rows, err := database.rowsByPath(ctx)
+	if err != nil {
+		return report, err
+	}
+	newest := newestCompleted(rows)
+
+	// size of every file in every directory below the root directory
+	present := make(map[string]int64)
+	err = fs.WalkDir(database.Directory.FS(), ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if database.ownFile(name) {
+			return skipOwn(entry)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		present[name] = info.Size()
+
+		if _, ok := rows[name]; ok {
+			return nil
+		}
+		if isVersionName(name) {
+			report.FilesWithoutRows = append(report.FilesWithoutRows, name)
+		} else if !alreadyImported(name, info.ModTime(), newest) {
+			report.Unmanaged = append(report.Unmanaged, name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for path, model := range rows {
+		if model.timeCompleted == 0 {
+			continue
+		}
+		size, ok := present[path]
+		if !ok {
+			report.RowsWithoutFiles = append(report.RowsWithoutFiles, model.version())
+		} else if model.size >= 0 && size != model.size {
+			report.Truncated = append(report.Truncated, model.version())
+		}
+	}
+
+	sortVersions(report.RowsWithoutFiles)
+	sortVersions(report.Truncated)
+
+	return report, nil
+}
+
+// sort versions by the path they are kept at
+func sortVersions(versions []Version) {
+	slices.SortFunc(versions, func(a, b Version) int { return strings.Compare(a.Path(), b.Path()) })
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	database := testStores(t, nil)["database"].(*Database)
+
+	upload(t, database, "kernel", "served")
+	upload(t, database, "initrd", "lost")
+	if report, err := database.Verify(ctx); err != nil || report.Problems() != 0 || len(report.Unmanaged) != 0 {
+		t.Fatalf("Verifying a healthy database reported %+v %v\n", report, err)
+	}
+
+	versions, _ := database.Versions(ctx, "initrd")
+	if err := database.Directory.Remove(versions[0].Path()); err != nil {
+		t.Fatalf("Unable to remove %v: %v\n", versions[0].Path(), err)
+	}
+	for _, name := range []string{"ghost.1700000000000000", "dropped.bin"} {
+		if err := os.WriteFile(database.Directory.Name()+"/"+name, nil, 0644); err != nil {
+			t.Fatalf("Unable to write %v: %v\n", name, err)
+		}
+	}
+
+	report, err := database.Verify(ctx)
+	if err != nil {
+		t.Fatalf("Unable to verify: %v\n", err)
+	}
+	if report.Problems() != 2 || len(report.RowsWithoutFiles) != 1 || report.RowsWithoutFiles[0].Started != versions[0].Started ||
+		!slices.Equal(report.FilesWithoutRows, []string{"ghost.1700000000000000"}) || !slices.Equal(report.Unmanaged, []string{"dropped.bin"}) {
+		t.Fatalf("Verify reported %+v\n", report)
+	}
+
+	// nothing was changed
+	if _, err = os.Stat(database.Directory.Name() + "/dropped.bin"); err != nil {
+		t.Fatalf("Verifying moved dropped.bin: %v\n", err)
+	}
+}
@@ -0,0 +1,149 @@
+//go:build linux
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// changes to a watched directory that matter, IN_CREATE is only used to find new directories
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_ONLYDIR
+
+/*
+ * Adopt every file written to or renamed into the root directory as the newest version of itself until ctx is done.
+ * Directories below the root directory are watched too, including ones created while watching.
+ * Files are adopted once the writer closes them, so copying a file in and renaming one in both work,
+ * though renaming a finished file into place is the only way to be sure a half written one is never served.
+ * Hidden files are only adopted when renamed into place, since rsync, install, and other tools write to one and rename it once done.
+ * Versions and the database's own files are ignored, which includes every upload.
+ */
+func (database *Database) Watch(ctx context.Context) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	// non-blocking so that reads wait in the runtime's poller and closing the file interrupts them
+	events := os.NewFile(uintptr(fd), "inotify")
+	defer events.Close()
+
+	// path below the root directory of every watched directory by watch descriptor
+	var directories map[int32]string = make(map[int32]string)
+	if err = database.watchTree(ctx, fd, directories, ".", false); err != nil {
+		return err
+	}
+
+	stopWatching := context.AfterFunc(ctx, func() { events.Close() })
+	defer stopWatching()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := events.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				database.log <- NewErrorEvent("DATABASE", "Missed changes to the root directory, restart to index them")
+				continue
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				// the directory is gone
+				delete(directories, event.Wd)
+				continue
+			}
+			directory, ok := directories[event.Wd]
+			if !ok {
+				continue
+			}
+
+			// names are padded with NUL bytes
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			if name == "" {
+				continue
+			}
+			name = path.Join(directory, name)
+
+			if event.Mask&syscall.IN_ISDIR != 0 {
+				// files may already be inside a directory renamed into place or written before it was watched
+				if err = database.watchTree(ctx, fd, directories, name, true); err != nil {
+					database.log <- NewErrorEvent("DATABASE", fmt.Sprintf("Unable to watch %v: %v", name, err))
+				}
+				continue
+			}
+			if event.Mask&syscall.IN_CREATE != 0 {
+				// still being written
+				continue
+			}
+			if event.Mask&syscall.IN_CLOSE_WRITE != 0 && isHiddenName(name) {
+				// likely written to be renamed into place, which fails once it was adopted
+				continue
+			}
+
+			database.watchedFile(ctx, name)
+		}
+	}
+}
+
+// watch the directory name and every directory below it, adopting the files found when adopt is set
+func (database *Database) watchTree(ctx context.Context, fd int, directories map[int32]string, name string, adopt bool) error {
+	return fs.WalkDir(database.Directory.FS(), name, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if database.ownFile(name) {
+			return skipOwn(entry)
+		}
+
+		if entry.IsDir() {
+			wd, err := syscall.InotifyAddWatch(fd, filepath.Join(database.Directory.Name(), filepath.FromSlash(name)), watchMask)
+			if err != nil {
+				return os.NewSyscallError("inotify_add_watch", err)
+			}
+			directories[int32(wd)] = name
+		} else if adopt && entry.Type().IsRegular() && !isHiddenName(name) {
+			// hidden files in new directories may still be written to be renamed into place
+			database.watchedFile(ctx, name)
+		}
+
+		return nil
+	})
+}
+
+// whether the file name is hidden, the way tools name files they rename into place once written
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(path.Base(name), ".")
+}
+
+// adopt the file name unless it is a version or belongs to the database
+func (database *Database) watchedFile(ctx context.Context, name string) {
+	if isVersionName(name) || database.ownFile(name) {
+		return
+	}
+
+	version, err := database.Adopt(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		// moved away again before it could be adopted
+		return
+	} else if err != nil {
+		database.log <- NewErrorEvent("DATABASE", fmt.Sprintf("Unable to adopt %v: %v", name, err))
+		return
+	}
+	database.log <- NewNormalEvent("DATABASE", fmt.Sprintf("Adopted %v as version %v", name, version.Path()))
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// wait for the newest version of filename to contain contents
+func waitForContents(t *testing.T, database *Database, filename string, contents string) {
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if reader, err := database.OpenLatest(context.Background(), filename); err == nil {
+			got, _ := io.ReadAll(reader)
+			reader.Close()
+			if string(got) == contents {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v never became %q\n", filename, contents)
+		}
+	}
+}
+
+func TestWatchAdoptsFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/root", 0755); err != nil {
+		t.Fatalf("Unable to create root: %v\n", err)
+	}
+	root, err := os.OpenRoot(dir + "/root")
+	if err != nil {
+		t.Fatalf("Unable to open root: %v\n", err)
+	}
+	t.Cleanup(func() { root.Close() })
+	database, err := OpenDatabase(&Config{Directory: root, Sqlite3DBPath: dir + "/root/tftpcpd.db"}, discardLog(t))
+	if err != nil {
+		t.Fatalf("Unable to open database: %v\n", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	upload(t, database, "image.bin", "uploaded")
+	reader, err := database.OpenLatest(ctx, "image.bin")
+	if err != nil {
+		t.Fatalf("Unable to open image.bin: %v\n", err)
+	}
+	defer reader.Close()
+
+	watched := make(chan error, 1)
+	go func() { watched <- database.Watch(ctx) }()
+	// nothing tells us when the watch is in place
+	time.Sleep(50 * time.Millisecond)
+
+	// copied in
+	if err = os.WriteFile(dir+"/root/image.bin", []byte("copied"), 0644); err != nil {
+		t.Fatalf("Unable to copy image.bin: %v\n", err)
+	}
+	waitForContents(t, database, "image.bin", "copied")
+
+	// renamed in after being written somewhere else
+	if err = os.WriteFile(dir+"/renamed.bin", []byte("renamed"), 0644); err != nil {
+		t.Fatalf("Unable to write renamed.bin: %v\n", err)
+	}
+	if err = os.Rename(dir+"/renamed.bin", dir+"/root/image.bin"); err != nil {
+		t.Fatalf("Unable to rename image.bin: %v\n", err)
+	}
+	waitForContents(t, database, "image.bin", "renamed")
+
+	// written under a hidden name next to it and renamed into place the way rsync and install do
+	if err = os.WriteFile(dir+"/root/.image.bin.Xa81Qz", []byte("atomic"), 0644); err != nil {
+		t.Fatalf("Unable to write .image.bin.Xa81Qz: %v\n", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err = os.Rename(dir+"/root/.image.bin.Xa81Qz", dir+"/root/image.bin"); err != nil {
+		t.Fatalf("Unable to rename .image.bin.Xa81Qz into place: %v\n", err)
+	}
+	waitForContents(t, database, "image.bin", "atomic")
+	if versions, _ := database.Versions(ctx, ".image.bin.Xa81Qz"); len(versions) != 0 {
+		t.Fatalf("Hidden file was adopted as %+v\n", versions)
+	}
+
+	// directories created while watching are watched too
+	if err = os.MkdirAll(dir+"/root/pxelinux.cfg", 0755); err != nil {
+		t.Fatalf("Unable to create pxelinux.cfg: %v\n", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err = os.WriteFile(dir+"/root/pxelinux.cfg/default", []byte("nested"), 0644); err != nil {
+		t.Fatalf("Unable to copy pxelinux.cfg/default: %v\n", err)
+	}
+	waitForContents(t, database, "pxelinux.cfg/default", "nested")
+
+	// as are files already inside a directory renamed into place
+	if err = os.MkdirAll(dir+"/boot/grub", 0755); err == nil {
+		err = os.WriteFile(dir+"/boot/grub/grub.cfg", []byte("grub"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("Unable to write boot/grub/grub.cfg: %v\n", err)
+	}
+	if err = os.Rename(dir+"/boot", dir+"/root/boot"); err != nil {
+		t.Fatalf("Unable to rename boot: %v\n", err)
+	}
+	waitForContents(t, database, "boot/grub/grub.cfg", "grub")
+
+	// the reader of the first version keeps it
+	if got, _ := io.ReadAll(reader); string(got) != "uploaded" {
+		t.Fatalf("Reserved version became %q\n", got)
+	}
+
+	// uploads are never adopted a second time
+	upload(t, database, "image.bin", "uploaded again")
+	waitForContents(t, database, "image.bin", "uploaded again")
+	versions, _ := database.Versions(ctx, "image.bin")
+	if len(versions) != 3 {
+		t.Fatalf("Versions %+v instead of the reserved one, the one before the upload, and the upload\n", versions)
+	}
+
+	cancel()
+	select {
+	case err = <-watched:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Watch returned %v instead of %v\n", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Watch never stopped\n")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package internal
+
+import (
+	"context"
+	"errors"
+)
+
+// only inotify is supported for now
+func (database *Database) Watch(ctx context.Context) error {
+	return errors.New("Watching the root directory is only supported on Linux")
+}
@@ -0,0 +1,288 @@
+// Package server answers TFTP requests from inside other Go programs.
+//
+// By default files are served from versions kept in a directory and tracked by a sqlite database, the same as tftpcpd.
+// Setting PlainDirectory serves the files in the directory under their real names instead.
+// Setting ReadHandler or WriteHandler answers requests some other way, such as with content generated on the fly.
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/moretiles/tftpcpd/internal"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// transfer modes a Request may ask for
+const (
+	ModeOctet    = internal.ModeOctet
+	ModeNetascii = internal.ModeNetascii
+)
+
+/*
+ * Failures with an error code of their own.
+ * Handlers returning an error wrapping one of these, for example fmt.Errorf("%w: %v", ErrNotFound, filename),
+ * have the client sent that error code, anything else is sent as error 0.
+ */
+var (
+	ErrNotFound          = internal.ErrNotFound
+	ErrAccessViolation   = internal.ErrAccessViolation
+	ErrDiskFull          = internal.ErrDiskFull
+	ErrIllegalOperation  = internal.ErrIllegalOperation
+	ErrUnknownTransferId = internal.ErrUnknownTransferId
+	ErrFileExists        = internal.ErrFileExists
+	ErrOptionRefused     = internal.ErrOptionRefused
+)
+
+// returned by ListenAndServe after Shutdown and by every call to Shutdown after the first
+var ErrServerClosed = internal.ErrServerClosed
+
+// a read or write request as the client sent it
+type Request = internal.Request
+
+/*
+ * Answers read requests with the contents of the file asked for.
+ * The reader is closed once the transfer is over when it implements io.Closer.
+ */
+type ReadHandler = internal.ReadHandler
+
+/*
+ * Answers write requests with where the file received should be written.
+ * Close is called once every block was received and before the last one is acknowledged, the upload is complete only if it succeeds
+ * and otherwise the client is sent the error instead.
+ * When the upload fails Abort() error is called instead if the writer has it, otherwise Close is.
+ */
+type WriteHandler = internal.WriteHandler
+
+/*
+ * Keeps every version of every file the default handlers serve.
+ * Readers always get the newest completed version and keep it for as long as they read it.
+ */
+type Store = internal.Store
+
+// a Store keeping versions in memory, for tests and servers that need not remember anything once stopped, retention is applied as Server.Retention is to the sqlite database
+func NewMemoryStore(retention RetentionPolicy) Store {
+	return internal.NewMemoryStore(retention)
+}
+
+/*
+ * Which out of date versions the sqlite database or a memory store keeps once nobody reads them.
+ * The first rule whose pattern matches the filename applies, files matching none keep only the newest version and the one before it.
+ * Kept versions are read by asking for name@<uploadStarted>.
+ */
+type RetentionPolicy = internal.RetentionPolicy
+type RetentionRule = internal.RetentionRule
+
+// parse a rule written as pattern=value[,value] where each value is a number of versions or a duration, like "*.img=3,72h"
+func ParseRetentionRule(text string) (RetentionRule, error) {
+	return internal.ParseRetentionRule(text)
+}
+
+// what Server.Fsck asks for before serving, checking only logs what is wrong with the sqlite database while repairing also fixes it
+const (
+	FsckCheck  = internal.FsckCheck
+	FsckRepair = internal.FsckRepair
+)
+
+// lets ordinary functions be used as handlers
+type ReadHandlerFunc = internal.ReadHandlerFunc
+type WriteHandlerFunc = internal.WriteHandlerFunc
+
+/*
+ * Where a server gets the packet conns it listens on.
+ * Addresses handed out by the conns must be *net.UDPAddr.
+ */
+type Network interface {
+	// listen on laddr, a port of 0 picks one that is free
+	ListenPacket(laddr *net.UDPAddr) (net.PacketConn, error)
+}
+
+/*
+ * A TFTP server, set the fields and call ListenAndServe.
+ * The zero value of each field picks a sensible default and fields must not change once serving.
+ */
+type Server struct {
+	// host:port requests are received on, ":69" unless set
+	Address string
+	// answer requests with these instead of the versions kept in Store
+	ReadHandler  ReadHandler
+	WriteHandler WriteHandler
+	// where versions are kept when a handler is missing, left open on Shutdown
+	// nil for a sqlite database at Database tracking versions in Directory, "tftpcpd.db" and "." unless set
+	Store     Store
+	Directory string
+	Database  string
+	// which out of date versions the sqlite database keeps, nil to keep only the newest version of each file and the one before it
+	// ignored when Store is set, give NewMemoryStore its own instead
+	Retention RetentionPolicy
+	// FsckCheck or FsckRepair to check the sqlite database against Directory before serving, empty to skip
+	Fsck string
+	// serve the files in Directory under their real names without a sqlite database, only the newest version of each is kept
+	PlainDirectory bool
+	// serve files copied or renamed into Directory while serving, Linux only and ignored when Store or PlainDirectory is set
+	Watch bool
+	// serve files already in Directory when starting by hard linking them in as versions, ignored when Store or PlainDirectory is set
+	Import bool
+	// create missing directories for uploads instead of refusing them
+	CreateDirectories bool
+	// first group address and port offered to clients asking for RFC 2090 multicast, empty to refuse
+	MulticastAddress string
+	// times a message is sent again when the client does not respond, 5 unless set, negative for none
+	Retries int
+	// multiply the time waited for a response by this after every resend, 2 unless set
+	Backoff float64
+	// where events are logged, nil to throw them away
+	Log   io.Writer
+	Debug bool
+	// nil for real UDP sockets
+	Network Network
+
+	// guards everything below
+	lock   sync.Mutex
+	closed bool
+	inner  *internal.Server
+	root   *os.Root
+}
+
+/*
+ * Answer requests until ctx is done or Shutdown is called.
+ * Once ctx is done every transfer is cancelled and the server is shut down.
+ * Always returns an error, ErrServerClosed after Shutdown.
+ */
+func (server *Server) ListenAndServe(ctx context.Context) error {
+	inner, err := server.start()
+	if err != nil {
+		return err
+	}
+
+	err = inner.Serve(ctx)
+	if !errors.Is(err, ErrServerClosed) {
+		// nothing is left to wait for
+		server.Shutdown(context.Background())
+	}
+
+	return err
+}
+
+// address requests are received on, nil unless serving
+func (server *Server) Addr() net.Addr {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.inner == nil {
+		return nil
+	}
+
+	return server.inner.Addr()
+}
+
+/*
+ * Stop listening and wait for every transfer to finish.
+ * When ctx is done before they finish they are cancelled and ctx's error is returned.
+ * The server can not be used again afterwards.
+ */
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		return ErrServerClosed
+	}
+	server.closed = true
+	inner, root := server.inner, server.root
+	server.lock.Unlock()
+
+	if inner == nil {
+		return nil
+	}
+
+	err := inner.Shutdown(ctx)
+	if root != nil {
+		root.Close()
+	}
+
+	return err
+}
+
+// create the internal server, opening the directory and database only when they are needed
+func (server *Server) start() (*internal.Server, error) {
+	var cfg internal.Config = internal.Config{
+		Debug:             server.Debug,
+		Retries:           server.Retries,
+		Backoff:           server.Backoff,
+		LogOutput:         server.Log,
+		Sqlite3DBPath:     server.Database,
+		MulticastAddress:  server.MulticastAddress,
+		Store:             server.Store,
+		Retention:         server.Retention,
+		Fsck:              server.Fsck,
+		PlainDirectory:    server.PlainDirectory,
+		Watch:             server.Watch && server.Store == nil && !server.PlainDirectory,
+		Import:            server.Import && server.Store == nil && !server.PlainDirectory,
+		CreateDirectories: server.CreateDirectories,
+		ReadHandler:       server.ReadHandler,
+		WriteHandler:      server.WriteHandler,
+		Address:           server.Address,
+	}
+	var err error
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.closed {
+		return nil, ErrServerClosed
+	}
+	if server.inner != nil {
+		return nil, errors.New("Server already serving")
+	}
+
+	if cfg.Address == "" {
+		cfg.Address = ":69"
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = 5
+	} else if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = 2
+	}
+	if cfg.LogOutput == nil {
+		cfg.LogOutput = io.Discard
+	}
+	if server.Network != nil {
+		cfg.Network = server.Network
+	}
+
+	if cfg.Store == nil && (cfg.ReadHandler == nil || cfg.WriteHandler == nil) {
+		directory := server.Directory
+		if directory == "" {
+			directory = "."
+		}
+		if cfg.Sqlite3DBPath == "" && !cfg.PlainDirectory {
+			cfg.Sqlite3DBPath = "tftpcpd.db"
+		}
+
+		directory, err = filepath.Abs(directory)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Directory, err = os.OpenRoot(directory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	server.inner, err = internal.NewServer(cfg)
+	if err != nil {
+		if cfg.Directory != nil {
+			cfg.Directory.Close()
+		}
+		return nil, err
+	}
+	server.root = cfg.Directory
+
+	return server.inner, nil
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moretiles/tftpcpd/client"
+	"github.com/moretiles/tftpcpd/internal"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve with server on a network of its own, returning a client for it
+func startTestServer(t *testing.T, server *Server) *client.Client {
+	network := internal.NewMemoryNetwork()
+	server.Address = "127.0.0.1:69"
+	server.Network = network
+
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe(context.Background()) }()
+	for deadline := time.Now().Add(time.Second); server.Addr() == nil; time.Sleep(time.Millisecond) {
+		select {
+		case err := <-served:
+			t.Fatalf("Server stopped before listening: %v\n", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server never started listening\n")
+		}
+	}
+
+	t.Cleanup(func() {
+		// uploads dally after they complete, no need to wait for them
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		server.Shutdown(ctx)
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ListenAndServe returned %v instead of %v\n", err, ErrServerClosed)
+		}
+	})
+
+	return &client.Client{Address: "127.0.0.1:69", Network: network}
+}
+
+// an upload kept in memory, handed to done once it is closed or aborted
+type memoryUpload struct {
+	bytes.Buffer
+	name    string
+	aborted bool
+	done    chan<- *memoryUpload
+	// returned by Close
+	err error
+}
+
+func (upload *memoryUpload) Close() error {
+	upload.done <- upload
+	return upload.err
+}
+
+func (upload *memoryUpload) Abort() error {
+	upload.aborted = true
+	upload.done <- upload
+	return nil
+}
+
+func TestHandlers(t *testing.T) {
+	requests := make(chan Request, 2)
+	done := make(chan *memoryUpload, 1)
+
+	server := &Server{
+		ReadHandler: ReadHandlerFunc(func(ctx context.Context, request *Request) (io.ReadSeeker, error) {
+			requests <- *request
+			if !strings.HasPrefix(request.Filename, "hello-") {
+				return nil, fmt.Errorf("%w: %v", ErrNotFound, request.Filename)
+			}
+			return strings.NewReader(strings.Repeat("hello "+request.Filename[6:]+"\n", 200)), nil
+		}),
+		WriteHandler: WriteHandlerFunc(func(ctx context.Context, request *Request) (io.WriteCloser, error) {
+			if request.Filename == "forbidden.bin" {
+				return nil, fmt.Errorf("%w: %v", ErrAccessViolation, request.Filename)
+			}
+			return &memoryUpload{name: request.Filename, done: done}, nil
+		}),
+	}
+	tftp := startTestServer(t, server)
+
+	// content generated for the request without touching a filesystem
+	var received bytes.Buffer
+	result, err := tftp.Get(context.Background(), "hello-world", &received, &client.Options{BlockSize: 1024, TransferSize: true})
+	if err != nil {
+		t.Fatalf("Get failed: %v\n", err)
+	}
+	expected := strings.Repeat("hello world\n", 200)
+	if received.String() != expected {
+		t.Fatalf("Got %q instead of generated content\n", received.String())
+	}
+	if result.TransferSize != int64(len(expected)) {
+		t.Fatalf("Transfer size %v instead of %v\n", result.TransferSize, len(expected))
+	}
+	if request := <-requests; request.Mode != ModeOctet || request.Options["blksize"] != "1024" || request.RemoteAddr == nil {
+		t.Fatalf("Handler saw %+v\n", request)
+	}
+
+	if _, err = tftp.Get(context.Background(), "missing", io.Discard, nil); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Get of missing file returned %v instead of %v\n", err, client.ErrNotFound)
+	}
+
+	contents := bytes.Repeat([]byte{1, 2, 3}, 1000)
+	if _, err = tftp.Put(context.Background(), "kept.bin", bytes.NewReader(contents), -1, nil); err != nil {
+		t.Fatalf("Put failed: %v\n", err)
+	}
+	// the client only hears the upload succeeded once it was closed
+	select {
+	case upload := <-done:
+		if upload.aborted || !bytes.Equal(upload.Bytes(), contents) {
+			t.Fatalf("Upload of %v bytes aborted %v instead of keeping %v\n", upload.Len(), upload.aborted, len(contents))
+		}
+	default:
+		t.Fatalf("Put returned before the upload was closed\n")
+	}
+
+	if _, err = tftp.Put(context.Background(), "forbidden.bin", bytes.NewReader(contents), -1, nil); !errors.Is(err, client.ErrAccessViolation) {
+		t.Fatalf("Put of forbidden file returned %v instead of %v\n", err, client.ErrAccessViolation)
+	}
+}
+
+// failed uploads are aborted rather than closed
+func TestWriteHandlerAborted(t *testing.T) {
+	done := make(chan *memoryUpload, 1)
+
+	server := &Server{
+		ReadHandler: ReadHandlerFunc(func(ctx context.Context, request *Request) (io.ReadSeeker, error) {
+			return nil, ErrNotFound
+		}),
+		WriteHandler: WriteHandlerFunc(func(ctx context.Context, request *Request) (io.WriteCloser, error) {
+			return &memoryUpload{name: request.Filename, done: done}, nil
+		}),
+	}
+	tftp := startTestServer(t, server)
+
+	// the client gives up part way through
+	reader := io.MultiReader(bytes.NewReader(make([]byte, 2000)), readerFunc(func([]byte) (int, error) {
+		return 0, errors.New("Source went away")
+	}))
+	if _, err := tftp.Put(context.Background(), "partial.bin", reader, -1, nil); err == nil {
+		t.Fatalf("Put of failing reader succeeded\n")
+	}
+
+	// the server learns the client gave up from its error message
+	if upload := <-done; !upload.aborted {
+		t.Fatalf("Failed upload of %v bytes closed instead of aborted\n", upload.Len())
+	}
+}
+
+// an upload the handler fails to keep is reported to the client instead of acknowledged
+func TestWriteHandlerCloseFails(t *testing.T) {
+	done := make(chan *memoryUpload, 1)
+
+	server := &Server{
+		ReadHandler: ReadHandlerFunc(func(ctx context.Context, request *Request) (io.ReadSeeker, error) {
+			return nil, ErrNotFound
+		}),
+		WriteHandler: WriteHandlerFunc(func(ctx context.Context, request *Request) (io.WriteCloser, error) {
+			return &memoryUpload{name: request.Filename, done: done, err: fmt.Errorf("%w: %v", ErrDiskFull, request.Filename)}, nil
+		}),
+	}
+	tftp := startTestServer(t, server)
+
+	if _, err := tftp.Put(context.Background(), "full.bin", bytes.NewReader(make([]byte, 2000)), -1, nil); !errors.Is(err, client.ErrDiskFull) {
+		t.Fatalf("Put returned %v instead of %v\n", err, client.ErrDiskFull)
+	}
+	if upload := <-done; upload.aborted {
+		t.Fatalf("Upload was aborted instead of closed\n")
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (read readerFunc) Read(buf []byte) (int, error) {
+	return read(buf)
+}
+
+// without handlers files are kept as versions in the store
+func TestDefaultStore(t *testing.T) {
+	dir := t.TempDir()
+	servers := []*Server{
+		{Directory: dir, Database: dir + "/tftpcpd.db"},
+		{Store: NewMemoryStore(nil)},
+	}
+
+	for _, server := range servers {
+		tftp := startTestServer(t, server)
+
+		for _, contents := range []string{"first version", "second version"} {
+			if _, err := tftp.Put(context.Background(), "config.txt", strings.NewReader(contents), int64(len(contents)), &client.Options{Timeout: time.Second}); err != nil {
+				t.Fatalf("Put failed: %v\n", err)
+			}
+
+			var received bytes.Buffer
+			if _, err := tftp.Get(context.Background(), "config.txt", &received, nil); err != nil {
+				t.Fatalf("Get failed: %v\n", err)
+			}
+			if received.String() != contents {
+				t.Fatalf("Got %q instead of %q\n", received.String(), contents)
+			}
+		}
+	}
+}
+
+func TestShutdownBeforeServing(t *testing.T) {
+	server := &Server{}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned %v\n", err)
+	}
+	if err := server.ListenAndServe(context.Background()); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("ListenAndServe returned %v instead of %v\n", err, ErrServerClosed)
+	}
+	if err := server.Shutdown(context.Background()); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Second shutdown returned %v instead of %v\n", err, ErrServerClosed)
+	}
+}
+
+// files may be kept in directories below the root directory but never outside of it
+func TestNestedPaths(t *testing.T) {
+	dir := t.TempDir()
+	server := &Server{Directory: dir + "/root", Database: dir + "/tftpcpd.db", CreateDirectories: true}
+	if err := os.Mkdir(dir+"/root", 0755); err != nil {
+		t.Fatalf("Unable to create root: %v\n", err)
+	}
+	tftp := startTestServer(t, server)
+
+	contents := "default menu"
+	if _, err := tftp.Put(context.Background(), "pxelinux.cfg/default", strings.NewReader(contents), -1, &client.Options{Timeout: time.Second}); err != nil {
+		t.Fatalf("Put failed: %v\n", err)
+	}
+
+	// Windows clients separate directories with backslashes
+	for _, filename := range []string{"pxelinux.cfg/default", `pxelinux.cfg\default`} {
+		var received bytes.Buffer
+		if _, err := tftp.Get(context.Background(), filename, &received, nil); err != nil {
+			t.Fatalf("Get of %v failed: %v\n", filename, err)
+		}
+		if received.String() != contents {
+			t.Fatalf("Got %q from %v instead of %q\n", received.String(), filename, contents)
+		}
+	}
+	if _, err := tftp.Get(context.Background(), "default", io.Discard, nil); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Get of default returned %v instead of %v\n", err, client.ErrNotFound)
+	}
+
+	for _, filename := range []string{"../tftpcpd.db", "/etc/passwd", `C:\boot.ini`, `pxelinux.cfg\..\..\tftpcpd.db`} {
+		if _, err := tftp.Get(context.Background(), filename, io.Discard, nil); !errors.Is(err, client.ErrAccessViolation) {
+			t.Fatalf("Get of %v returned %v instead of %v\n", filename, err, client.ErrAccessViolation)
+		}
+		if _, err := tftp.Put(context.Background(), filename, strings.NewReader(contents), -1, nil); !errors.Is(err, client.ErrAccessViolation) {
+			t.Fatalf("Put of %v returned %v instead of %v\n", filename, err, client.ErrAccessViolation)
+		}
+	}
+}
+
+// files are written under their real names and nothing else is left in the directory
+func TestPlainDirectory(t *testing.T) {
+	dir := t.TempDir()
+	tftp := startTestServer(t, &Server{Directory: dir, PlainDirectory: true, CreateDirectories: true})
+
+	for _, contents := range []string{"first version", "second version"} {
+		if _, err := tftp.Put(context.Background(), "pxelinux.cfg/default", strings.NewReader(contents), -1, &client.Options{Timeout: time.Second}); err != nil {
+			t.Fatalf("Put failed: %v\n", err)
+		}
+
+		// the upload was renamed into place before the client saw the final acknowledgement
+		entries, _ := os.ReadDir(dir + "/pxelinux.cfg")
+		written, _ := os.ReadFile(dir + "/pxelinux.cfg/default")
+		if len(entries) != 1 || entries[0].Name() != "default" || string(written) != contents {
+			t.Fatalf("pxelinux.cfg holds %v with default containing %q\n", entries, written)
+		}
+
+		var received bytes.Buffer
+		if _, err := tftp.Get(context.Background(), "pxelinux.cfg/default", &received, nil); err != nil {
+			t.Fatalf("Get failed: %v\n", err)
+		}
+		if received.String() != contents {
+			t.Fatalf("Got %q instead of %q\n", received.String(), contents)
+		}
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || entries[0].Name() != "pxelinux.cfg" {
+		t.Fatalf("Root directory holds %v\n", entries)
+	}
+}